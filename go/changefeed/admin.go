@@ -0,0 +1,381 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// TeardownOptions configures TeardownFeed.
+type TeardownOptions struct {
+	// KeepData keeps the [feed:<table>] table, e.g. for archiving
+	KeepData bool
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+}
+
+// TeardownFeed calls drop_feed, dropping everything setup_feed created for the
+// table: tables, sequence, type, procedures, certificate and roles.
+func TeardownFeed(ctx context.Context, db Execer, table string, opts TeardownOptions) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`exec %s.drop_feed @table_name = @table_name, @keep_data = @keep_data`, schemaName(opts.Schema)),
+		sql.Named("table_name", table),
+		sql.Named("keep_data", opts.KeepData))
+	if err != nil {
+		return fmt.Errorf("dropping feed %s: %w", table, mapError(err))
+	}
+	return nil
+}
+
+// MigratePrimaryKey rebuilds [outbox:<table>], [feed:<table>],
+// [deadletter:<table>] and [type:read:<table>] of an outbox feed after the primary key of the source
+// table has changed, and re-generates the procedures and [outbox_type:<table>] using upgrade_feed.
+//
+// mapping is a select statement that returns the new primary key columns for
+// a row in the old tables; it is used as "cross apply (<mapping>) as new",
+// with the old primary key columns available as old.<column>. For instance,
+// when adding Tenant to the primary key of myservice.MyEvent:
+//
+//	select e.Tenant from myservice.MyEvent as e
+//	where e.AggregateID = old.AggregateID and e.Version = old.Version
+//
+// Existing feed rows keep their ULIDs, and pending outbox rows keep their
+// order. Everything happens in one transaction that is rolled back if the
+// mapping does not return exactly one row for every old row, or if any shard
+// does not have as many rows after the copy as before. A table with the
+// trigger of InstallOutboxTrigger is refused, since the trigger lists the old
+// primary key; drop it first, with publishers stopped, and install it again
+// after the migration. The transaction
+// needs permission to create schemas, since the new tables are built in a
+// temporary schema before being moved into the changefeed schema. The feed
+// must already be upgraded to the installed library version.
+func MigratePrimaryKey(ctx context.Context, db *sql.DB, table, mapping string, opts ...Option) error {
+	schema := newOptions(opts).schema
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var objectID sql.NullInt64
+	var sourceSchema, unquoted, newColumns, newColumnsFromMapping sql.NullString
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@p1, 'U');
+select @object_id,
+    object_schema_name(@object_id),
+    %[1]s.sql_unquoted_qualified_table_name(@object_id),
+    %[1]s.sql_primary_key_columns_joined_by_comma(@object_id, N''),
+    %[1]s.sql_primary_key_columns_joined_by_comma(@object_id, N'new.')`, schemaName(schema)), table).
+		Scan(&objectID, &sourceSchema, &unquoted, &newColumns, &newColumnsFromMapping)
+	if err != nil {
+		return err
+	}
+	if !objectID.Valid {
+		return fmt.Errorf("%w: table %s does not exist", ErrFeedNotFound, table)
+	}
+	if !newColumns.Valid {
+		return fmt.Errorf("table %s has no primary key", table)
+	}
+	name := func(s, kind string) string {
+		return feedObjectName(s, kind, unquoted.String)
+	}
+
+	var isFeed, isOutbox bool
+	err = tx.QueryRowContext(ctx, `select iif(object_id(@p1, 'U') is null, 0, 1), iif(object_id(@p2, 'U') is null, 0, 1)`,
+		name(schema, "state"), name(schema, "outbox")).Scan(&isFeed, &isOutbox)
+	if err != nil {
+		return err
+	}
+	if !isFeed {
+		return fmt.Errorf("%w: no feed set up for %s", ErrFeedNotFound, table)
+	}
+	if !isOutbox {
+		return fmt.Errorf("%w: %s", ErrNotOutbox, table)
+	}
+
+	// The trigger of install_outbox_trigger lists the old primary key columns, and the
+	// expressions it was installed with are not kept anywhere, so it cannot be re-generated
+	var hasTrigger bool
+	trigger := sqlutil.QuoteName(sourceSchema.String) + "." + sqlutil.QuoteName(schema+".outbox:"+unquoted.String)
+	if err := tx.QueryRowContext(ctx, `select iif(object_id(@p1, 'TR') is null, 0, 1)`, trigger).Scan(&hasTrigger); err != nil {
+		return err
+	}
+	if hasTrigger {
+		return fmt.Errorf("%s has the outbox trigger %s; drop it before migrating the primary key, and install it again afterwards", table, trigger)
+	}
+
+	// Keep writers and readers out until the tables have been swapped
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+select top(0) 1 from %s with (tablockx, holdlock);
+select top(0) 1 from %s with (tablockx, holdlock);
+select top(0) 1 from %s with (tablockx, holdlock);
+select top(0) 1 from %s with (tablockx, holdlock);
+`, name(schema, "state"), name(schema, "outbox"), name(schema, "feed"), name(schema, "deadletter")))
+	if err != nil {
+		return err
+	}
+
+	scratch := "changefeed_migrate_" + sqlutil.RandomHex(8)
+	if _, err := tx.ExecContext(ctx, `exec ('create schema ' + @p1)`, sqlutil.QuoteName(scratch)); err != nil {
+		return fmt.Errorf("creating scratch schema: %w", err)
+	}
+	for _, generator := range []string{"sql_create_feed_table", "sql_create_outbox_table", "sql_create_read_type", "sql_create_deadletter_table"} {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`declare @sql nvarchar(max) = %s.%s(@p1, @p2); exec sp_executesql @sql;`, schemaName(schema), generator),
+			objectID.Int64, scratch)
+		if err != nil {
+			return fmt.Errorf("creating new tables: %w", err)
+		}
+	}
+
+	// Copy rows, checking that the mapping gives exactly one new key per row, and
+	// that every shard ends up with as many rows as before
+	for _, c := range []struct{ kind, columns string }{
+		{"feed", "shard_id, ulid"},
+		{"outbox", "shard_id, order_sequence, time_hint"},
+		{"deadletter", "shard_id, ulid, error, attempts, dead_lettered_time"},
+	} {
+		var unmapped, shardsDiffering int64
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+declare @unmapped bigint = (
+    select count_big(*) from %[1]s as old
+    where (select count_big(*) from (
+%[7]s
+    ) as new) <> 1
+);
+if @unmapped = 0
+    insert into %[2]s (%[3]s, %[4]s)
+    select old.%[5]s, %[6]s
+    from %[1]s as old
+    cross apply (
+%[7]s
+    ) as new;
+select @unmapped, count_big(*)
+from (select shard_id, count_big(*) as n from %[1]s group by shard_id) as old
+full join (select shard_id, count_big(*) as n from %[2]s group by shard_id) as new on new.shard_id = old.shard_id
+where @unmapped = 0 and (old.n is null or new.n is null or old.n <> new.n);
+`, name(schema, c.kind), name(scratch, c.kind), c.columns, newColumns.String,
+			strings.ReplaceAll(c.columns, ", ", ", old."), newColumnsFromMapping.String, mapping)).Scan(&unmapped, &shardsDiffering)
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", name(schema, c.kind), err)
+		}
+		if unmapped != 0 {
+			return fmt.Errorf("copying %s: mapping did not return exactly one row for %d rows; it should return exactly one row for each", name(schema, c.kind), unmapped)
+		}
+		if shardsDiffering != 0 {
+			return fmt.Errorf("copying %s: number of rows changed in %d shards", name(schema, c.kind), shardsDiffering)
+		}
+	}
+
+	// Continue the outbox order_sequence where the old sequence left off
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+declare @next bigint = 1 + isnull(convert(bigint, (select current_value from sys.sequences where object_id = object_id(@p1))), 0);
+declare @sql nvarchar(max) = concat('alter sequence %s restart with ', @next);
+exec sp_executesql @sql;
+`, strings.ReplaceAll(name(scratch, "sequence"), "'", "''")), name(schema, "sequence"))
+	if err != nil {
+		return fmt.Errorf("restarting sequence: %w", err)
+	}
+
+	// Swap; [outbox_type:<table>] is re-created by upgrade_feed, with the procedure using it
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+drop procedure if exists %[15]s;
+drop type if exists %[16]s;
+drop table %[2]s;
+drop table %[3]s;
+drop sequence %[4]s;
+drop type %[5]s;
+drop table %[12]s;
+alter schema %[1]s transfer %[6]s;
+alter schema %[1]s transfer %[7]s;
+alter schema %[1]s transfer %[8]s;
+alter schema %[1]s transfer type::%[9]s;
+alter schema %[1]s transfer %[13]s;
+drop schema %[10]s;
+grant insert on %[3]s to %[11]s;
+grant select, insert, update, delete on %[12]s to %[14]s;
+`, schemaName(schema),
+		name(schema, "feed"), name(schema, "outbox"), name(schema, "sequence"), name(schema, "type:read"),
+		name(scratch, "feed"), name(scratch, "outbox"), name(scratch, "sequence"), name(scratch, "type:read"),
+		sqlutil.QuoteName(scratch), sqlutil.QuoteName(schema+".writers:"+unquoted.String),
+		name(schema, "deadletter"), name(scratch, "deadletter"), sqlutil.QuoteName(schema+".readers:"+unquoted.String),
+		name(schema, "publish"), outboxTypeName(schema, unquoted.String)))
+	if err != nil {
+		return fmt.Errorf("swapping tables: %w", err)
+	}
+
+	if err := UpgradeFeed(ctx, tx, table, Outbox, opts...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Mode is the kind of feed passed to setup_feed.
+type Mode string
+
+const (
+	// Outbox feeds are set up with @outbox = 1
+	Outbox Mode = "outbox"
+	// Blocking feeds are set up with @blocking = 1
+	Blocking Mode = "blocking"
+)
+
+// SetupFeed calls setup_feed for table.
+func SetupFeed(ctx context.Context, db Execer, table string, mode Mode, opts ...Option) error {
+	if mode != Outbox && mode != Blocking {
+		return fmt.Errorf("%w %q; expected %q or %q", ErrInvalidMode, mode, Outbox, Blocking)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`exec %s.setup_feed @p1, @outbox = @p2, @blocking = @p3`, schemaName(newOptions(opts).schema)),
+		table, mode == Outbox, mode == Blocking)
+	if err != nil {
+		return fmt.Errorf("setting up feed %s: %w", table, mapError(err))
+	}
+	return nil
+}
+
+// UpgradeFeed calls upgrade_feed for table, re-generating its procedures
+// with the installed library. For outbox feeds, [read_feed:<table>] is signed
+// again with a new certificate, since altering it drops the signature that
+// allows members of the readers role to update [state:<table>].
+func UpgradeFeed(ctx context.Context, db Execer, table string, mode Mode, opts ...Option) error {
+	if mode != Outbox && mode != Blocking {
+		return fmt.Errorf("%w %q; expected %q or %q", ErrInvalidMode, mode, Outbox, Blocking)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`exec %s.upgrade_feed @p1, @outbox = @p2, @blocking = @p3`, schemaName(newOptions(opts).schema)),
+		table, mode == Outbox, mode == Blocking)
+	if err != nil {
+		return fmt.Errorf("upgrading feed %s: %w", table, mapError(err))
+	}
+	return nil
+}
+
+// InstallOutboxTrigger calls install_outbox_trigger, creating an after insert
+// trigger on the source table of an outbox feed that publishes every inserted
+// row to [outbox:<table>]. shardExpr and timeHintExpr are SQL expressions over
+// the columns of the source table, e.g. "AggregateID % 4" and "CreatedTime";
+// they default to "0" and "sysutcdatetime()" when empty. Calling it again
+// replaces the trigger. Fails with ErrNotOutbox if table has no outbox feed.
+func InstallOutboxTrigger(ctx context.Context, db Execer, table, shardExpr, timeHintExpr string, opts ...Option) error {
+	if shardExpr == "" {
+		shardExpr = "0"
+	}
+	if timeHintExpr == "" {
+		timeHintExpr = "sysutcdatetime()"
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`exec %s.install_outbox_trigger @p1, @shard_expr = @p2, @time_hint_expr = @p3`, schemaName(newOptions(opts).schema)),
+		table, shardExpr, timeHintExpr)
+	if err != nil {
+		return fmt.Errorf("installing outbox trigger on %s: %w", table, mapError(err))
+	}
+	return nil
+}
+
+// RenderSetup returns the script setup_feed would execute for table, as
+// batches separated by "go", without executing anything. This allows the
+// objects created for a feed to be reviewed, or created by a deployment tool
+// in place of calling setup_feed.
+func RenderSetup(ctx context.Context, db Querier, table string, mode Mode, opts ...Option) (string, error) {
+	if mode != Outbox && mode != Blocking {
+		return "", fmt.Errorf("%w %q; expected %q or %q", ErrInvalidMode, mode, Outbox, Blocking)
+	}
+	schema := newOptions(opts).schema
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@p1, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+select description, sql
+from %s.sql_setup_feed_batches(@object_id, @p2, @p3, @p4, 0)
+order by ordinal`, schemaName(schema)), table, schema, mode == Outbox, mode == Blocking)
+	if err != nil {
+		return "", fmt.Errorf("rendering setup for %s: %w", table, mapError(err))
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var description, batch string
+		if err := rows.Scan(&description, &batch); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "-- %s\n%s\ngo\n", description, strings.TrimSpace(batch))
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("rendering setup for %s: %w", table, mapError(err))
+	}
+	return b.String(), nil
+}
+
+// Feed is an entry in the [changefeed].feeds registry.
+type Feed struct {
+	ObjectID int
+	// Table is the unquoted, qualified name of the source table
+	Table          string
+	Mode           Mode
+	LibraryVersion int
+	Created        time.Time
+	Upgraded       time.Time
+}
+
+// ListFeeds returns the feeds registered by setup_feed and upgrade_feed. Feeds
+// set up before the registry existed are registered by Install, with
+// LibraryVersion 0.
+func ListFeeds(ctx context.Context, db Querier, opts ...Option) ([]Feed, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+select object_id, table_name, mode, library_version, created_time, upgraded_time
+from %s.feeds
+order by table_name`, schemaName(newOptions(opts).schema)))
+	if err != nil {
+		return nil, fmt.Errorf("listing feeds: %w", mapError(err))
+	}
+	defer rows.Close()
+	var result []Feed
+	for rows.Next() {
+		var f Feed
+		if err := rows.Scan(&f.ObjectID, &f.Table, &f.Mode, &f.LibraryVersion, &f.Created, &f.Upgraded); err != nil {
+			return nil, fmt.Errorf("listing feeds: %w", mapError(err))
+		}
+		result = append(result, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing feeds: %w", mapError(err))
+	}
+	return result, nil
+}
+
+// UpgradeAll runs upgrade_feed for every registered feed generated by a
+// library version older than LibraryVersion, and returns the feeds upgraded
+// as they were before the upgrade. The installed library must be at least
+// LibraryVersion; run Install first.
+func UpgradeAll(ctx context.Context, db *sql.DB, opts ...Option) ([]Feed, error) {
+	schema := schemaName(newOptions(opts).schema)
+	var installed int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`select %s.library_version()`, schema)).Scan(&installed); err != nil {
+		return nil, fmt.Errorf("reading installed library version: %w", mapError(err))
+	}
+	if installed < LibraryVersion {
+		return nil, fmt.Errorf("installed library version %d is older than %d; run Install first", installed, LibraryVersion)
+	}
+
+	feeds, err := ListFeeds(ctx, db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var upgraded []Feed
+	for _, f := range feeds {
+		if f.LibraryVersion >= installed {
+			continue
+		}
+		_, err := db.ExecContext(ctx, fmt.Sprintf(`
+declare @table_name nvarchar(max) = concat(quotename(object_schema_name(@object_id)), '.', quotename(object_name(@object_id)));
+if object_id(@table_name, 'U') is null throw 71000, 'Could not find @table_name', 0;
+declare @outbox bit = iif(@mode = 'outbox', 1, 0);
+declare @blocking bit = iif(@mode = 'blocking', 1, 0);
+exec %s.upgrade_feed @table_name, @outbox = @outbox, @blocking = @blocking;
+`, schema), sql.Named("object_id", f.ObjectID), sql.Named("mode", string(f.Mode)))
+		if err != nil {
+			return upgraded, fmt.Errorf("upgrading %s: %w", f.Table, mapError(err))
+		}
+		upgraded = append(upgraded, f)
+	}
+	return upgraded, nil
+}
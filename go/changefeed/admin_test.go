@@ -0,0 +1,377 @@
+package changefeed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// feedPrincipals returns the database principals and certificates created by setup_feed for table
+func feedPrincipals(t *testing.T, ctx context.Context, table string) (names []string) {
+	rows, err := fixture.AdminDB.QueryContext(ctx, `
+select name from sys.database_principals where name like concat('changefeed.%:', @p1)
+union all
+select name from sys.certificates where name like concat('changefeed.%:', @p1)
+`, table)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	return
+}
+
+// feedObjects returns the objects and types in the changefeed schema for table
+func feedObjects(t *testing.T, ctx context.Context, table string) (names []string) {
+	rows, err := fixture.AdminDB.QueryContext(ctx, `
+select name from sys.objects where schema_id = schema_id('changefeed') and name like concat('%:', @p1)
+union all
+select name from sys.types where schema_id = schema_id('changefeed') and name like concat('%:', @p1)
+`, table)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	return
+}
+
+func TestTeardownFeedOutbox(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestTeardownOutbox"
+	setup := func() {
+		_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestTeardownOutbox', @outbox = 1;
+alter role [changefeed.writers:myservice.TestTeardownOutbox] add member myuser;
+alter role [changefeed.readers:myservice.TestTeardownOutbox] add member myreaduser;
+`)
+		require.NoError(t, err)
+	}
+	setup()
+	assert.ElementsMatch(t, []string{
+		"changefeed.readers:" + table,
+		"changefeed.writers:" + table,
+		"changefeed.user.readers:" + table,
+		"changefeed.cert.readers:" + table,
+	}, feedPrincipals(t, ctx, table))
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, NewOutboxWriter(table).Publish(ctx, tx, OutboxRow{Key: map[string]interface{}{"AggregateID": 1, "Version": 1}}))
+	require.NoError(t, tx.Commit())
+	_, err = NewOutboxReader(fixture.ReadUserDB, table).ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{KeepData: true}))
+	assert.Empty(t, feedPrincipals(t, ctx, table))
+	assert.Equal(t, []string{"feed:" + table}, feedObjects(t, ctx, table))
+	var count int
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, `select count(*) from [changefeed].[feed:myservice.TestTeardownOutbox]`).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	// The kept [feed:*] table is not a feed any more, so it can not be dropped with drop_feed
+	assert.Error(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	_, err = fixture.AdminDB.ExecContext(ctx, `drop table [changefeed].[feed:myservice.TestTeardownOutbox]`)
+	require.NoError(t, err)
+
+	// The feed can be set up again after teardown, and torn down completely
+	setup()
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	assert.Empty(t, feedPrincipals(t, ctx, table))
+	assert.Empty(t, feedObjects(t, ctx, table))
+}
+
+func TestTeardownFeedBlocking(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestTeardownBlocking"
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestTeardownBlocking', @blocking = 1;
+alter role [changefeed.writers:myservice.TestTeardownBlocking] add member myuser;
+`)
+	require.NoError(t, err)
+	assert.NotEmpty(t, feedObjects(t, ctx, table))
+
+	// The source table is gone; drop_feed then takes the unquoted name of the feed
+	_, err = fixture.AdminDB.ExecContext(ctx, `drop table myservice.TestTeardownBlocking`)
+	require.NoError(t, err)
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	assert.Empty(t, feedPrincipals(t, ctx, table))
+	assert.Empty(t, feedObjects(t, ctx, table))
+}
+
+func TestTeardownFeedNotFound(t *testing.T) {
+	err := TeardownFeed(context.Background(), fixture.AdminDB, "myservice.DoesNotExist", TeardownOptions{})
+	assert.ErrorContains(t, err, "Could not find a feed")
+}
+
+func TestMigratePrimaryKey(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestMigratePrimaryKey"
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestMigratePrimaryKey', @outbox = 1;
+alter role [changefeed.writers:myservice.TestMigratePrimaryKey] add member myuser;
+insert into myservice.TestMigratePrimaryKey (AggregateID, Version, Tenant) values (1, 1, 'a'), (1, 2, 'a'), (2, 1, 'b');
+`)
+	require.NoError(t, err)
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, NewOutboxWriter(table).Publish(ctx, tx,
+		OutboxRow{Key: map[string]interface{}{"AggregateID": 1, "Version": 1}},
+		OutboxRow{Key: map[string]interface{}{"AggregateID": 1, "Version": 2}},
+		OutboxRow{Key: map[string]interface{}{"AggregateID": 2, "Version": 1}},
+	))
+	require.NoError(t, tx.Commit())
+
+	// Leave the first two events in the feed and the last in the outbox
+	reader := NewOutboxReader(fixture.AdminDB, table)
+	before, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(before))
+
+	// The outbox trigger lists the old primary key, so it has to be dropped first
+	require.NoError(t, InstallOutboxTrigger(ctx, fixture.AdminDB, table, "0", "sysutcdatetime()"))
+	err = MigratePrimaryKey(ctx, fixture.AdminDB, table, `select 'a' as Tenant`)
+	assert.ErrorContains(t, err, "has the outbox trigger")
+	_, err = fixture.AdminDB.ExecContext(ctx, `drop trigger myservice.[changefeed.outbox:myservice.TestMigratePrimaryKey]`)
+	require.NoError(t, err)
+
+	_, err = fixture.AdminDB.ExecContext(ctx, `
+alter table myservice.TestMigratePrimaryKey drop constraint [pk:TestMigratePrimaryKey];
+alter table myservice.TestMigratePrimaryKey add constraint [pk:TestMigratePrimaryKey] primary key (Tenant, AggregateID, Version);
+`)
+	require.NoError(t, err)
+
+	err = MigratePrimaryKey(ctx, fixture.AdminDB, "myservice.DoesNotExist", `select 'a' as Tenant`)
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+	err = MigratePrimaryKey(ctx, fixture.AdminDB, "myservice.MyTable", `select 'a' as Tenant`)
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+
+	// A mapping that misses rows is rolled back
+	err = MigratePrimaryKey(ctx, fixture.AdminDB, table, `
+select e.Tenant from myservice.TestMigratePrimaryKey as e
+where e.AggregateID = old.AggregateID and e.Version = old.Version and e.Tenant = 'a'`)
+	assert.ErrorContains(t, err, "mapping did not return exactly one row for 1 rows")
+	diffs, err := Verify(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.NotEmpty(t, diffs)
+
+	// ... and so is one that returns two rows for one event and none for another,
+	// even though the total count is right
+	err = MigratePrimaryKey(ctx, fixture.AdminDB, table, `
+select t.Tenant from (values ('a'), ('x')) as t(Tenant)
+where old.Version = 1`)
+	assert.ErrorContains(t, err, "mapping did not return exactly one row")
+
+	require.NoError(t, MigratePrimaryKey(ctx, fixture.AdminDB, table, `
+select e.Tenant from myservice.TestMigratePrimaryKey as e
+where e.AggregateID = old.AggregateID and e.Version = old.Version`))
+	diffs, err = Verify(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// Writers can still publish, now with the new key
+	tx, err = fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, NewOutboxWriter(table).Publish(ctx, tx,
+		OutboxRow{Key: map[string]interface{}{"AggregateID": 3, "Version": 1, "Tenant": "c"}}))
+	require.NoError(t, tx.Commit())
+
+	after, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(after))
+	for i := range before {
+		assert.Equal(t, before[i].ULID, after[i].ULID)
+	}
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(1), "Version": int64(1), "Tenant": "a"}, after[0].Values)
+
+	rest, err := reader.ReadPage(ctx, 0, after[1].ULID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rest))
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(2), "Version": int64(1), "Tenant": "b"}, rest[0].Values)
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(3), "Version": int64(1), "Tenant": "c"}, rest[1].Values)
+}
+
+func findFeed(t *testing.T, ctx context.Context, table string) (Feed, bool) {
+	feeds, err := ListFeeds(ctx, fixture.AdminDB)
+	require.NoError(t, err)
+	for _, f := range feeds {
+		if f.Table == table {
+			return f, true
+		}
+	}
+	return Feed{}, false
+}
+
+func TestUpgradeAll(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestFeedsRegistry"
+	_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed 'myservice.TestFeedsRegistry', @outbox = 1`)
+	require.NoError(t, err)
+
+	feed, ok := findFeed(t, ctx, table)
+	require.True(t, ok)
+	assert.Equal(t, Outbox, feed.Mode)
+	assert.Equal(t, LibraryVersion, feed.LibraryVersion)
+	assert.Equal(t, feed.Created, feed.Upgraded)
+
+	// Pretend the feed was set up before the registry existed; Install registers it again
+	_, err = fixture.AdminDB.ExecContext(ctx, `delete from [changefeed].feeds where table_name = @p1`, table)
+	require.NoError(t, err)
+	_, ok = findFeed(t, ctx, table)
+	require.False(t, ok)
+	require.NoError(t, Install(ctx, fixture.AdminDB))
+	feed, ok = findFeed(t, ctx, table)
+	require.True(t, ok)
+	assert.Equal(t, Outbox, feed.Mode)
+	assert.Equal(t, 0, feed.LibraryVersion)
+
+	upgraded, err := UpgradeAll(ctx, fixture.AdminDB)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(upgraded))
+	assert.Equal(t, table, upgraded[0].Table)
+	assert.Equal(t, 0, upgraded[0].LibraryVersion)
+
+	feed, ok = findFeed(t, ctx, table)
+	require.True(t, ok)
+	assert.Equal(t, LibraryVersion, feed.LibraryVersion)
+	assert.False(t, feed.Upgraded.Before(feed.Created))
+
+	upgraded, err = UpgradeAll(ctx, fixture.AdminDB)
+	require.NoError(t, err)
+	assert.Empty(t, upgraded)
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	_, ok = findFeed(t, ctx, table)
+	assert.False(t, ok)
+}
+
+func TestRenderSetup(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestRenderSetup"
+
+	script, err := RenderSetup(ctx, fixture.AdminDB, table, Outbox)
+	require.NoError(t, err)
+	var last int
+	for _, object := range []string{
+		"[changefeed].[state:myservice.TestRenderSetup]",
+		"[changefeed].[feed:myservice.TestRenderSetup]",
+		"[changefeed].[outbox:myservice.TestRenderSetup]",
+		"[changefeed].[type:read:myservice.TestRenderSetup]",
+		"[changefeed].[feed_write_lock:myservice.TestRenderSetup]",
+		"[changefeed].[update_state:myservice.TestRenderSetup]",
+		"[changefeed].[read_feed:myservice.TestRenderSetup]",
+		"[changefeed].register_feed",
+	} {
+		i := strings.Index(script[last:], object)
+		require.True(t, i >= 0, "%s not found after position %d", object, last)
+		last += i
+	}
+
+	// Rendering does not execute anything
+	_, ok := findFeed(t, ctx, table)
+	assert.False(t, ok)
+
+	for _, batch := range sqlutil.SplitBatches(script) {
+		if strings.TrimSpace(batch) == "" {
+			continue
+		}
+		_, err := fixture.AdminDB.ExecContext(ctx, batch)
+		require.NoError(t, err, batch)
+	}
+	feed, ok := findFeed(t, ctx, table)
+	require.True(t, ok)
+	assert.Equal(t, Outbox, feed.Mode)
+	diffs, err := Verify(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	blocking, err := RenderSetup(ctx, fixture.AdminDB, table, Blocking)
+	require.NoError(t, err)
+	assert.Contains(t, blocking, "[changefeed].[lock:myservice.TestRenderSetup]")
+	assert.NotContains(t, blocking, "[changefeed].[outbox:myservice.TestRenderSetup]")
+
+	_, err = RenderSetup(ctx, fixture.AdminDB, "myservice.DoesNotExist", Outbox)
+	assert.Error(t, err)
+	_, err = RenderSetup(ctx, fixture.AdminDB, table, Mode("both"))
+	assert.Error(t, err)
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+}
+
+func TestOutboxTrigger(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestOutboxTrigger"
+	_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed 'myservice.TestOutboxTrigger', @blocking = 1, @with_trigger = 1`)
+	assert.ErrorIs(t, mapError(err), ErrInvalidMode)
+	_, err = fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestOutboxTrigger', @outbox = 1, @with_trigger = 1,
+    @trigger_shard_expr = 'AggregateID % 2', @trigger_time_hint_expr = 'Created';`)
+	require.NoError(t, err)
+	require.NoError(t, GrantReader(ctx, fixture.AdminDB, table, "myreaduser"))
+
+	// The publisher only inserts into the source table; multi-row inserts
+	// publish every row
+	_, err = fixture.UserDB.ExecContext(ctx, `
+insert into myservice.TestOutboxTrigger (AggregateID, Version, Created)
+values (1, 1, '2023-05-31 12:00:00'), (2, 1, '2023-05-31 12:01:00'), (1, 2, '2023-05-31 12:02:00'), (3, 1, '2023-05-31 12:03:00');`)
+	require.NoError(t, err)
+
+	reader := NewOutboxReader(fixture.ReadUserDB, table)
+	keys := func(page []Event) (result []string) {
+		for _, e := range page {
+			result = append(result, fmt.Sprintf("%d/%d@%s", e.Values["AggregateID"], e.Values["Version"],
+				time.UnixMilli(int64(e.ULID.Time())).UTC().Format("15:04")))
+		}
+		return
+	}
+	page, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2/1@12:01"}, keys(page))
+	page, err = reader.ReadPage(ctx, 1, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/1@12:00", "1/2@12:02", "3/1@12:03"}, keys(page))
+	cursor := page[len(page)-1].ULID
+
+	// Installing the trigger again replaces it
+	require.NoError(t, InstallOutboxTrigger(ctx, fixture.AdminDB, table, "1", ""))
+	_, err = fixture.UserDB.ExecContext(ctx, `
+insert into myservice.TestOutboxTrigger (AggregateID, Version, Created)
+values (4, 1, '2023-05-31 12:04:00'), (6, 1, '2023-05-31 12:05:00');`)
+	require.NoError(t, err)
+	page, err = reader.ReadPage(ctx, 1, cursor, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page))
+	assert.Equal(t, int64(4), page[0].Values["AggregateID"])
+	assert.Equal(t, int64(6), page[1].Values["AggregateID"])
+
+	// A rolled back insert publishes nothing
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = tx.ExecContext(ctx, `insert into myservice.TestOutboxTrigger (AggregateID, Version, Created) values (5, 1, sysutcdatetime())`)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+	page, err = reader.ReadPage(ctx, 1, page[1].ULID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, page)
+
+	assert.ErrorIs(t, InstallOutboxTrigger(ctx, fixture.AdminDB, "myservice.TestBlockingWriter", "0", ""), ErrNotOutbox)
+
+	// drop_feed drops the trigger, so inserts work without the outbox
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	_, err = fixture.UserDB.ExecContext(ctx, `insert into myservice.TestOutboxTrigger (AggregateID, Version, Created) values (7, 1, sysutcdatetime())`)
+	require.NoError(t, err)
+}
@@ -0,0 +1,71 @@
+// Package changefeed is a Go client for the mssql-changefeed SQL library.
+//
+// The library itself lives in SQL (see migrations/2001.changefeed-v2.sql);
+// the code in this package only wraps the generated stored procedures and
+// tables so that Go services do not have to hand-write the same batches.
+//
+// Feeds are identified by the unquoted, qualified name of the source table,
+// e.g. "myservice.MyEvent"; the same name that is passed to setup_feed.
+package changefeed
+
+import (
+	"strings"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// fullyQuotedName turns "myschema.MyTable" into "[myschema].[MyTable]". Like
+// sql_unquoted_qualified_table_name, the first dot is assumed to be the separator.
+// Names that are already quoted, e.g. "[my.schema].[MyTable]", are passed through.
+func fullyQuotedName(table string) string {
+	if strings.HasPrefix(table, "[") {
+		return table
+	}
+	schema, name, found := strings.Cut(table, ".")
+	if !found {
+		return sqlutil.QuoteName(table)
+	}
+	return sqlutil.QuoteName(schema) + "." + sqlutil.QuoteName(name)
+}
+
+// DefaultSchema is the schema the SQL library is installed in, unless
+// another one is passed to Install with WithSchema.
+const DefaultSchema = "changefeed"
+
+// Option configures Install and the readers and publishers.
+type Option func(*options)
+
+type options struct {
+	schema string
+}
+
+func newOptions(opts []Option) options {
+	o := options{schema: DefaultSchema}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithSchema uses a changefeed schema other than DefaultSchema. This allows
+// several independent copies of the library in the same database.
+func WithSchema(schema string) Option {
+	return func(o *options) {
+		o.schema = schema
+	}
+}
+
+// feedObjectName returns the name of one of the objects generated by setup_feed;
+// e.g. feedObjectName("", "read_feed", "myservice.MyEvent") returns
+// "[changefeed].[read_feed:myservice.MyEvent]". The empty schema means DefaultSchema.
+func feedObjectName(schema, kind, table string) string {
+	return schemaName(schema) + "." + sqlutil.QuoteName(kind+":"+table)
+}
+
+// schemaName returns the quoted changefeed schema; the empty schema means DefaultSchema.
+func schemaName(schema string) string {
+	if schema == "" {
+		schema = DefaultSchema
+	}
+	return sqlutil.QuoteName(schema)
+}
@@ -0,0 +1,123 @@
+package changefeedtest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+// ulidsPerLock is the number of ULIDs reserved by each call to [lock:<table>]
+const ulidsPerLock = 100000000000
+
+// BlockingFeed is an in-memory emulation of a feed set up with @blocking = 1,
+// together with the source table. Lock corresponds to calling
+// [lock:<table>], Insert to inserting a row into the source table, and
+// ReadPage to paging on the ULID column of the source table.
+type BlockingFeed struct {
+	mu         sync.Mutex
+	states     map[int]*shardState
+	shardLocks map[int]*sync.Mutex
+	rows       map[int][]changefeed.Event
+}
+
+var (
+	_ changefeed.Reader            = &BlockingFeed{}
+	_ changefeed.BlockingPublisher = &BlockingFeed{}
+)
+
+func NewBlockingFeed() *BlockingFeed {
+	return &BlockingFeed{
+		states:     make(map[int]*shardState),
+		shardLocks: make(map[int]*sync.Mutex),
+		rows:       make(map[int][]changefeed.Event),
+	}
+}
+
+// Lock must be called with a *Tx. Like the updlock taken on [state:<table>],
+// other writers to the same shard will wait until the transaction ends.
+func (f *BlockingFeed) Lock(ctx context.Context, tx changefeed.Execer, shardID int, timeHint time.Time) (changefeed.ULIDs, error) {
+	t, ok := tx.(*Tx)
+	if !ok || t == nil {
+		return changefeed.ULIDs{}, ErrNotInTransaction
+	}
+	if timeHint.IsZero() {
+		timeHint = time.Now()
+	}
+
+	f.mu.Lock()
+	shardLock, ok := f.shardLocks[shardID]
+	if !ok {
+		shardLock = &sync.Mutex{}
+		f.shardLocks[shardID] = shardLock
+	}
+	f.mu.Unlock()
+
+	// Calling Lock again for the same shard in the same transaction must not deadlock
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return changefeed.ULIDs{}, ErrTxDone
+	}
+	held := false
+	for _, l := range t.locks {
+		if l == shardLock {
+			held = true
+		}
+	}
+	t.mu.Unlock()
+
+	if !held {
+		if err := lockContext(ctx, shardLock); err != nil {
+			return changefeed.ULIDs{}, err
+		}
+		t.mu.Lock()
+		t.locks = append(t.locks, shardLock)
+		t.unlock = append(t.unlock, shardLock.Unlock)
+		t.mu.Unlock()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := update(f.states, shardID, timeHint, ulidsPerLock)
+	return changefeed.ULIDs{High: r.nextULIDHigh, Low: r.nextULIDLow}, nil
+}
+
+// Insert adds a row to the source table, visible to readers when tx commits.
+// The ULID should come from the range returned by Lock.
+func (f *BlockingFeed) Insert(ctx context.Context, tx changefeed.Execer, shardID int, u ulid.ULID, values map[string]interface{}) error {
+	event := changefeed.Event{ULID: u, Values: copyValues(values)}
+	return do(tx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		rows := append(f.rows[shardID], event)
+		sort.Slice(rows, func(i, j int) bool { return rows[i].ULID.Compare(rows[j].ULID) < 0 })
+		f.rows[shardID] = rows
+	})
+}
+
+func (f *BlockingFeed) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]changefeed.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return pageAfter(f.rows[shardID], cursor, pageSize), nil
+}
+
+// lockContext locks m, giving up if ctx is done first
+func lockContext(ctx context.Context, m *sync.Mutex) error {
+	if m.TryLock() {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+			if m.TryLock() {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// Package chaos wraps a driver.Connector to inject faults into the
+// statements sent to the database: dropped connections, delays and
+// cancellations. Combined with changefeedtest.Workload it is used to check
+// that no events are lost or reordered when read_feed or publishing is
+// interrupted at an unfortunate time.
+//
+// Usage:
+//
+//	connector, _ := mssql.NewConnector(dsn)
+//	db := sql.OpenDB(chaos.New(connector,
+//		chaos.Fault{Match: "[read_feed", Kind: chaos.Drop, When: chaos.After, Probability: 0.1}))
+package chaos
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Kind int
+
+const (
+	// Drop closes the connection. The server will roll back any open
+	// transaction on the session.
+	Drop Kind = iota
+	// Delay sleeps for Fault.Duration
+	Delay
+	// Cancel cancels the context of the statement Fault.Duration after it
+	// was sent, causing the driver to send an attention to the server.
+	Cancel
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Drop:
+		return "drop"
+	case Delay:
+		return "delay"
+	case Cancel:
+		return "cancel"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+type When int
+
+const (
+	// Before the statement is sent to the server; the statement is never executed
+	Before When = iota
+	// After the statement has completed on the server, but before the client
+	// sees the result. Only use this for statements that are safe to retry,
+	// such as read_feed; otherwise the retry will be a duplicate.
+	After
+)
+
+type Fault struct {
+	// Match is a substring of the statement text the fault applies to, e.g.
+	// "[read_feed"; the empty string matches all statements
+	Match string
+	Kind  Kind
+	// When is ignored for Cancel, which always happens while the statement runs
+	When When
+	// Probability that a matching statement is hit; 1 means every time
+	Probability float64
+	// Duration of the delay for Delay, and time until cancellation for Cancel
+	Duration time.Duration
+}
+
+// ErrInjected is matched by errors.Is for all errors caused by a fault.
+var ErrInjected = errors.New("chaos: injected fault")
+
+type InjectedError struct {
+	Fault Fault
+	Query string
+	// Err is the error from the driver, if any
+	Err error
+}
+
+func (e *InjectedError) Error() string {
+	msg := fmt.Sprintf("chaos: injected %s on %q", e.Fault.Kind, e.Fault.Match)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *InjectedError) Is(target error) bool {
+	return target == ErrInjected
+}
+
+func (e *InjectedError) Unwrap() error {
+	return e.Err
+}
+
+type Connector struct {
+	driver.Connector
+	Faults []Fault
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	disabled atomic.Bool
+	injected [3]atomic.Int64
+}
+
+var _ driver.Connector = &Connector{}
+
+// New wraps connector; faults are picked with a fixed seed so that runs are
+// comparable. Use Seed to vary it.
+func New(connector driver.Connector, faults ...Fault) *Connector {
+	return &Connector{
+		Connector: connector,
+		Faults:    faults,
+		rand:      rand.New(rand.NewSource(1)),
+	}
+}
+
+func (c *Connector) Seed(seed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetEnabled turns fault injection on or off; e.g. to let a test verify
+// the final state without interference.
+func (c *Connector) SetEnabled(enabled bool) {
+	c.disabled.Store(!enabled)
+}
+
+// Injected returns the number of faults of the given kind injected so far
+func (c *Connector) Injected(kind Kind) int {
+	return int(c.injected[kind].Load())
+}
+
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	cn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: cn, connector: c}, nil
+}
+
+// pick returns the faults to inject for the query, at most one of each kind
+func (c *Connector) pick(query string) (faults []Fault) {
+	if c.disabled.Load() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var picked [3]bool
+	for _, f := range c.Faults {
+		if picked[f.Kind] || !strings.Contains(query, f.Match) {
+			continue
+		}
+		if c.rand.Float64() < f.Probability {
+			picked[f.Kind] = true
+			faults = append(faults, f)
+		}
+	}
+	return
+}
+
+type conn struct {
+	driver.Conn
+	connector *Connector
+	bad       atomic.Bool
+}
+
+var (
+	_ driver.ConnBeginTx        = &conn{}
+	_ driver.ConnPrepareContext = &conn{}
+	_ driver.Pinger             = &conn{}
+	_ driver.SessionResetter    = &conn{}
+	_ driver.Validator          = &conn{}
+	_ driver.NamedValueChecker  = &conn{}
+	_ driver.StmtExecContext    = &stmt{}
+	_ driver.StmtQueryContext   = &stmt{}
+)
+
+func (cn *conn) drop() {
+	if !cn.bad.Swap(true) {
+		_ = cn.Conn.Close()
+	}
+}
+
+func (cn *conn) Close() error {
+	if cn.bad.Swap(true) {
+		// already closed by drop
+		return nil
+	}
+	return cn.Conn.Close()
+}
+
+func (cn *conn) Prepare(query string) (driver.Stmt, error) {
+	return cn.PrepareContext(context.Background(), query)
+}
+
+func (cn *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if cn.bad.Load() {
+		return nil, driver.ErrBadConn
+	}
+	var s driver.Stmt
+	var err error
+	if p, ok := cn.Conn.(driver.ConnPrepareContext); ok {
+		s, err = p.PrepareContext(ctx, query)
+	} else {
+		s, err = cn.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{Stmt: s, conn: cn, query: query}, nil
+}
+
+func (cn *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if cn.bad.Load() {
+		return nil, driver.ErrBadConn
+	}
+	if b, ok := cn.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return cn.Conn.Begin() //nolint:staticcheck
+}
+
+func (cn *conn) Ping(ctx context.Context) error {
+	if cn.bad.Load() {
+		return driver.ErrBadConn
+	}
+	if p, ok := cn.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (cn *conn) ResetSession(ctx context.Context) error {
+	if cn.bad.Load() {
+		return driver.ErrBadConn
+	}
+	if r, ok := cn.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (cn *conn) IsValid() bool {
+	if cn.bad.Load() {
+		return false
+	}
+	if v, ok := cn.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (cn *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := cn.Conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type stmt struct {
+	driver.Stmt
+	conn  *conn
+	query string
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return inject(ctx, s, func(ctx context.Context) (driver.Result, error) {
+		if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+			return e.ExecContext(ctx, args)
+		}
+		return nil, errors.New("chaos: driver does not support StmtExecContext")
+	})
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return inject(ctx, s, func(ctx context.Context) (driver.Rows, error) {
+		if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+			return q.QueryContext(ctx, args)
+		}
+		return nil, errors.New("chaos: driver does not support StmtQueryContext")
+	})
+}
+
+func inject[T any](ctx context.Context, s *stmt, run func(ctx context.Context) (T, error)) (result T, err error) {
+	var zero T
+	faults := s.conn.connector.pick(s.query)
+	injected := func(f Fault, err error) error {
+		s.conn.connector.injected[f.Kind].Add(1)
+		return &InjectedError{Fault: f, Query: s.query, Err: err}
+	}
+
+	for _, f := range faults {
+		switch {
+		case f.Kind == Delay && f.When == Before:
+			s.conn.connector.injected[f.Kind].Add(1)
+			select {
+			case <-ctx.Done():
+				return zero, ctx.Err()
+			case <-time.After(f.Duration):
+			}
+		case f.Kind == Drop && f.When == Before:
+			s.conn.drop()
+			return zero, injected(f, nil)
+		}
+	}
+
+	var cancelFault *Fault
+	for i := range faults {
+		if faults[i].Kind == Cancel {
+			cancelFault = &faults[i]
+		}
+	}
+	if cancelFault != nil {
+		// Not cancelled on return: rows returned by a query keep using ctx,
+		// so a cancel may also hit while the result is being read.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		time.AfterFunc(cancelFault.Duration, cancel)
+	}
+
+	result, err = run(ctx)
+	if cancelFault != nil && ctx.Err() != nil {
+		if err == nil {
+			// Statement completed before the cancel; the caller should still see it as cancelled
+			if closer, ok := any(result).(interface{ Close() error }); ok {
+				_ = closer.Close()
+			}
+		}
+		return zero, injected(*cancelFault, err)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	for _, f := range faults {
+		switch {
+		case f.Kind == Delay && f.When == After:
+			s.conn.connector.injected[f.Kind].Add(1)
+			time.Sleep(f.Duration)
+		case f.Kind == Drop && f.When == After:
+			if closer, ok := any(result).(interface{ Close() error }); ok {
+				_ = closer.Close()
+			}
+			s.conn.drop()
+			return zero, injected(f, nil)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,202 @@
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConnector records the statements executed, and blocks on statements
+// containing "waitfor" until the context is cancelled
+type fakeConnector struct {
+	mu       sync.Mutex
+	executed []string
+	connects int
+	closed   int
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connects++
+	return &fakeConn{connector: c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *fakeConnector) Executed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.executed...)
+}
+
+type fakeConn struct {
+	connector *fakeConnector
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.connector.mu.Lock()
+	defer c.connector.mu.Unlock()
+	c.connector.closed++
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, _ []driver.NamedValue) (driver.Result, error) {
+	if s.query == "waitfor" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	s.conn.connector.mu.Lock()
+	defer s.conn.connector.mu.Unlock()
+	s.conn.connector.executed = append(s.conn.connector.executed, s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if _, err := s.ExecContext(ctx, args); err != nil {
+		return nil, err
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	done bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"x"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+func TestDropBefore(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeConnector{}
+	connector := New(fake, Fault{Match: "insert", Kind: Drop, When: Before, Probability: 1})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err := db.ExecContext(ctx, "insert 1")
+	assert.ErrorIs(t, err, ErrInjected)
+	var injected *InjectedError
+	require.ErrorAs(t, err, &injected)
+	assert.Equal(t, "insert 1", injected.Query)
+
+	// never reached the server, and the connection is not reused
+	_, err = db.ExecContext(ctx, "select 1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"select 1"}, fake.Executed())
+	assert.Equal(t, 2, fake.connects)
+	assert.Equal(t, 1, fake.closed)
+	assert.Equal(t, 1, connector.Injected(Drop))
+}
+
+func TestDropAfter(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeConnector{}
+	connector := New(fake, Fault{Match: "read_feed", Kind: Drop, When: After, Probability: 1})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err := db.QueryContext(ctx, "exec read_feed")
+	assert.ErrorIs(t, err, ErrInjected)
+	// executed on the server, but the result was lost
+	assert.Equal(t, []string{"exec read_feed"}, fake.Executed())
+
+	connector.SetEnabled(false)
+	var x int
+	require.NoError(t, db.QueryRowContext(ctx, "exec read_feed").Scan(&x))
+	assert.Equal(t, 1, x)
+	assert.Equal(t, 1, connector.Injected(Drop))
+}
+
+func TestCancel(t *testing.T) {
+	fake := &fakeConnector{}
+	connector := New(fake, Fault{Kind: Cancel, Duration: 10 * time.Millisecond, Probability: 1})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err := db.ExecContext(context.Background(), "waitfor")
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, connector.Injected(Cancel))
+}
+
+func TestDelay(t *testing.T) {
+	fake := &fakeConnector{}
+	connector := New(fake, Fault{Kind: Delay, When: Before, Duration: 20 * time.Millisecond, Probability: 1})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	start := time.Now()
+	_, err := db.ExecContext(context.Background(), "select 1")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// the delay respects the context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	connector.Faults[0].Duration = time.Hour
+	_, err = db.ExecContext(ctx, "select 2")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []string{"select 1"}, fake.Executed())
+}
+
+func TestProbability(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeConnector{}
+	connector := New(fake, Fault{Kind: Drop, When: Before, Probability: 0.5})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	failed := 0
+	for i := 0; i != 1000; i++ {
+		if _, err := db.ExecContext(ctx, "select 1"); err != nil {
+			require.ErrorIs(t, err, ErrInjected)
+			failed++
+		}
+	}
+	assert.InDelta(t, 500, failed, 100)
+	assert.Equal(t, failed, connector.Injected(Drop))
+	assert.Equal(t, 1000-failed, len(fake.Executed()))
+}
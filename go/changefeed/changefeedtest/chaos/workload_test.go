@@ -0,0 +1,96 @@
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/changefeedtest"
+)
+
+func retryable(err error) bool {
+	return errors.Is(err, ErrInjected) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.Canceled)
+}
+
+// TestOutboxWorkload runs concurrent writers and readers against an outbox
+// feed, while connections are dropped and statements cancelled both in
+// read_feed and when publishing, and checks that every reader still sees
+// every event exactly once and in order.
+func TestOutboxWorkload(t *testing.T) {
+	dsn := os.Getenv("SQLSERVER_DSN")
+	if dsn == "" {
+		t.Skip("SQLSERVER_DSN not set")
+	}
+	ctx := context.Background()
+	db := changefeedtest.DatabaseOptions{
+		RoleMembers: []changefeedtest.RoleMember{
+			{Role: "changefeed.writers:myservice.MyEvent", Member: "writer"},
+			{Role: "changefeed.readers:myservice.MyEvent", Member: "reader"},
+		},
+	}.NewDatabase(t, dsn, "../../../../migrations/2001.changefeed-v2.sql", "../testdata/myevent.sql")
+
+	open := func(user string, faults ...Fault) (*Connector, *sql.DB) {
+		mssqlConnector, err := mssql.NewConnector(db.DSN(user))
+		require.NoError(t, err)
+		connector := New(mssqlConnector, faults...)
+		sqlDB := sql.OpenDB(connector)
+		t.Cleanup(func() { _ = sqlDB.Close() })
+		return connector, sqlDB
+	}
+
+	readConnector, readDB := open(db.ReaderUser,
+		// read_feed is safe to retry, so the result can be lost after it has completed
+		Fault{Match: "[read_feed", Kind: Drop, When: After, Probability: 0.05},
+		Fault{Match: "[read_feed", Kind: Drop, When: Before, Probability: 0.05},
+		Fault{Match: "[read_feed", Kind: Cancel, Duration: 2 * time.Millisecond, Probability: 0.05},
+		Fault{Match: "[read_feed", Kind: Delay, When: Before, Duration: 5 * time.Millisecond, Probability: 0.1},
+	)
+	writeConnector, writeDB := open(db.WriterUser,
+		// Publishing is not idempotent, so only fail before the statement is
+		// sent; the transaction is then rolled back and can be retried
+		Fault{Match: "[outbox:", Kind: Drop, When: Before, Probability: 0.05},
+		Fault{Match: "[outbox:", Kind: Delay, When: Before, Duration: 5 * time.Millisecond, Probability: 0.1},
+	)
+
+	writer := changefeed.NewOutboxWriter("myservice.MyEvent")
+	w := changefeedtest.Workload{
+		Writers:         5,
+		Readers:         5,
+		EventsPerWriter: 50,
+		Write: func(ctx context.Context, aggregateID, version int) error {
+			tx, err := writeDB.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = tx.Rollback() }()
+			if _, err := tx.ExecContext(ctx, `insert into myservice.MyEvent (AggregateID, Version) values (@p1, @p2)`, aggregateID, version); err != nil {
+				return err
+			}
+			if err := writer.Publish(ctx, tx, changefeed.OutboxRow{Key: map[string]interface{}{"AggregateID": aggregateID, "Version": version}}); err != nil {
+				return err
+			}
+			return tx.Commit()
+		},
+		Reader: changefeed.NewOutboxReader(readDB, "myservice.MyEvent"),
+		Observe: func(e changefeed.Event) (int, int, error) {
+			return int(e.Values["AggregateID"].(int64)), int(e.Values["Version"].(int64)), nil
+		},
+		StuckAfter: 100,
+		Retry:      retryable,
+	}
+	require.NoError(t, w.Run(ctx))
+
+	t.Logf("read_feed: %d drops, %d cancels, %d delays; publish: %d drops, %d delays",
+		readConnector.Injected(Drop), readConnector.Injected(Cancel), readConnector.Injected(Delay),
+		writeConnector.Injected(Drop), writeConnector.Injected(Delay))
+	assert.Greater(t, readConnector.Injected(Drop), 0)
+	assert.Greater(t, writeConnector.Injected(Drop), 0)
+}
@@ -0,0 +1,177 @@
+package changefeedtest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/oklog/ulid"
+)
+
+// Observation is a single event as seen by a consumer. Key identifies the
+// entity/aggregate the event belongs to, and Version is expected to increase
+// by exactly one for each event of the same Key.
+type Observation struct {
+	ULID    ulid.ULID
+	Key     string
+	Version int
+}
+
+type ProblemKind string
+
+const (
+	// Gap: a version was skipped for a key
+	Gap ProblemKind = "gap"
+	// Duplicate: the same ULID, or the same version of a key, was seen twice
+	Duplicate ProblemKind = "duplicate"
+	// OutOfOrder: a lower version was seen after a higher version of a key
+	OutOfOrder ProblemKind = "out-of-order"
+	// NonMonotonicULID: the ULID was not greater than the ULID of the previous observation
+	NonMonotonicULID ProblemKind = "non-monotonic-ulid"
+	// Missing: fewer versions were observed for a key than expected by CheckComplete
+	Missing ProblemKind = "missing"
+)
+
+type Problem struct {
+	Kind        ProblemKind
+	Observation Observation
+	// Previous is the last observation for the same key (or the previous
+	// observation overall, for NonMonotonicULID)
+	Previous Observation
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Kind, p.Message)
+}
+
+// OrderChecker consumes the stream of events seen by a single consumer of a
+// single shard, and reports any ordering or completeness problems. It is
+// safe for concurrent use, but observations must be passed in the order
+// they were consumed.
+type OrderChecker struct {
+	// FirstVersion is the version expected for the first event of each key
+	FirstVersion int
+
+	mu       sync.Mutex
+	count    int
+	last     Observation
+	lastKey  map[string]Observation
+	seen     map[ulid.ULID]struct{}
+	problems []Problem
+}
+
+func NewOrderChecker(firstVersion int) *OrderChecker {
+	return &OrderChecker{FirstVersion: firstVersion}
+}
+
+func (c *OrderChecker) Observe(observations ...Observation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastKey == nil {
+		c.lastKey = make(map[string]Observation)
+		c.seen = make(map[ulid.ULID]struct{})
+	}
+	for _, o := range observations {
+		c.observe(o)
+	}
+}
+
+func (c *OrderChecker) observe(o Observation) {
+	if _, ok := c.seen[o.ULID]; ok {
+		c.report(Duplicate, o, o, "ULID %s (key %s, version %d) seen twice", o.ULID, o.Key, o.Version)
+		c.count++
+		return
+	}
+	if c.count > 0 && o.ULID.Compare(c.last.ULID) <= 0 {
+		c.report(NonMonotonicULID, o, c.last, "ULID %s (key %s) after %s (key %s)", o.ULID, o.Key, c.last.ULID, c.last.Key)
+	}
+	c.seen[o.ULID] = struct{}{}
+	c.last = o
+	c.count++
+
+	previous, ok := c.lastKey[o.Key]
+	expected := c.FirstVersion
+	if ok {
+		expected = previous.Version + 1
+	}
+	switch {
+	case o.Version == expected:
+	case ok && o.Version == previous.Version:
+		c.report(Duplicate, o, previous, "key %s: version %d seen twice", o.Key, o.Version)
+	case ok && o.Version < previous.Version:
+		c.report(OutOfOrder, o, previous, "key %s: version %d after %d", o.Key, o.Version, previous.Version)
+	case o.Version > expected:
+		c.report(Gap, o, previous, "key %s: version %d when expecting %d", o.Key, o.Version, expected)
+	default:
+		c.report(OutOfOrder, o, previous, "key %s: version %d before first version %d", o.Key, o.Version, c.FirstVersion)
+	}
+	// Do not move backwards on problems, to avoid reporting the same problem many times
+	if !ok || o.Version > previous.Version {
+		c.lastKey[o.Key] = o
+	}
+}
+
+func (c *OrderChecker) report(kind ProblemKind, o, previous Observation, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Kind:        kind,
+		Observation: o,
+		Previous:    previous,
+		Message:     fmt.Sprintf(format, args...),
+	})
+}
+
+// Count returns the number of observations so far
+func (c *OrderChecker) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+// LastVersion returns the highest version observed for key, and whether any was observed
+func (c *OrderChecker) LastVersion(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok := c.lastKey[key]
+	return o.Version, ok
+}
+
+// CheckComplete reports a Missing problem for every key that has not been
+// observed up to and including the given last version.
+func (c *OrderChecker) CheckComplete(lastVersions map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(lastVersions))
+	for key := range lastVersions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		previous, ok := c.lastKey[key]
+		if !ok {
+			c.report(Missing, Observation{Key: key}, previous, "key %s: no events, expected up to version %d", key, lastVersions[key])
+		} else if previous.Version < lastVersions[key] {
+			c.report(Missing, Observation{Key: key}, previous, "key %s: last version %d, expected up to version %d", key, previous.Version, lastVersions[key])
+		}
+	}
+}
+
+func (c *OrderChecker) Problems() []Problem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Problem(nil), c.problems...)
+}
+
+// Err returns nil if no problems have been found, or an error listing them
+func (c *OrderChecker) Err() error {
+	problems := c.Problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	errs := make([]error, len(problems))
+	for i, p := range problems {
+		errs[i] = errors.New(p.String())
+	}
+	return errors.Join(errs...)
+}
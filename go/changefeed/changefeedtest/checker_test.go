@@ -0,0 +1,143 @@
+package changefeedtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+func observation(i int, key string, version int) Observation {
+	var u ulid.ULID
+	u[15] = byte(i)
+	return Observation{ULID: u, Key: key, Version: version}
+}
+
+func TestOrderChecker(t *testing.T) {
+	for _, tc := range []struct {
+		description  string
+		observations []Observation
+		expected     []ProblemKind
+	}{
+		{
+			description:  "in order",
+			observations: []Observation{observation(1, "a", 1), observation(2, "b", 1), observation(3, "a", 2)},
+			expected:     nil,
+		},
+		{
+			description:  "gap",
+			observations: []Observation{observation(1, "a", 1), observation(2, "a", 3)},
+			expected:     []ProblemKind{Gap},
+		},
+		{
+			description:  "gap at start",
+			observations: []Observation{observation(1, "a", 2)},
+			expected:     []ProblemKind{Gap},
+		},
+		{
+			description:  "duplicate version",
+			observations: []Observation{observation(1, "a", 1), observation(2, "a", 1)},
+			expected:     []ProblemKind{Duplicate},
+		},
+		{
+			description:  "duplicate ULID",
+			observations: []Observation{observation(1, "a", 1), observation(1, "a", 1)},
+			expected:     []ProblemKind{Duplicate},
+		},
+		{
+			description:  "out of order",
+			observations: []Observation{observation(1, "a", 1), observation(2, "a", 2), observation(3, "a", 3), observation(4, "a", 2)},
+			expected:     []ProblemKind{OutOfOrder},
+		},
+		{
+			description:  "non-monotonic ULID",
+			observations: []Observation{observation(2, "a", 1), observation(1, "b", 1)},
+			expected:     []ProblemKind{NonMonotonicULID},
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			checker := NewOrderChecker(1)
+			checker.Observe(tc.observations...)
+			var kinds []ProblemKind
+			for _, p := range checker.Problems() {
+				kinds = append(kinds, p.Kind)
+			}
+			assert.Equal(t, tc.expected, kinds)
+			assert.Equal(t, tc.expected == nil, checker.Err() == nil)
+		})
+	}
+}
+
+func TestOrderCheckerComplete(t *testing.T) {
+	checker := NewOrderChecker(0)
+	checker.Observe(observation(1, "a", 0), observation(2, "a", 1), observation(3, "b", 0))
+	checker.CheckComplete(map[string]int{"a": 1, "b": 1, "c": 0})
+	problems := checker.Problems()
+	require.Equal(t, 2, len(problems))
+	assert.Equal(t, Missing, problems[0].Kind)
+	assert.Equal(t, "b", problems[0].Observation.Key)
+	assert.Equal(t, Missing, problems[1].Kind)
+	assert.Equal(t, "c", problems[1].Observation.Key)
+}
+
+func outboxWorkload(feed *OutboxFeed) Workload {
+	return Workload{
+		Write: func(ctx context.Context, writer, version int) error {
+			return feed.Publish(ctx, nil, changefeed.OutboxRow{Key: map[string]interface{}{"Writer": writer, "Version": version}})
+		},
+		Reader: feed,
+		Observe: func(e changefeed.Event) (int, int, error) {
+			return e.Values["Writer"].(int), e.Values["Version"].(int), nil
+		},
+	}
+}
+
+func TestWorkloadOutboxFeed(t *testing.T) {
+	w := outboxWorkload(NewOutboxFeed())
+	w.Writers, w.Readers, w.EventsPerWriter = 10, 5, 100
+	require.NoError(t, w.Run(context.Background()))
+}
+
+// lossyReader drops one event, which the workload should detect
+type lossyReader struct {
+	changefeed.Reader
+	drop ulid.ULID
+}
+
+func (r *lossyReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]changefeed.Event, error) {
+	page, err := r.Reader.ReadPage(ctx, shardID, cursor, pageSize)
+	var result []changefeed.Event
+	for _, e := range page {
+		if e.ULID != r.drop {
+			result = append(result, e)
+		}
+	}
+	return result, err
+}
+
+func TestWorkloadDetectsLostEvent(t *testing.T) {
+	feed := NewOutboxFeed()
+	w := outboxWorkload(feed)
+	w.Writers, w.Readers, w.EventsPerWriter = 2, 1, 10
+	w.ReadAfterWrite = true
+
+	// Assign ULIDs up front so that we know which one to drop
+	for i := 0; i != 2; i++ {
+		for j := 0; j != 10; j++ {
+			require.NoError(t, w.Write(context.Background(), i, j))
+		}
+	}
+	page, err := feed.ReadPage(context.Background(), 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	w.Write = func(ctx context.Context, writer, version int) error { return nil }
+	w.Reader = &lossyReader{Reader: feed, drop: page[5].ULID}
+
+	err = w.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("key %d: version", page[5].Values["Writer"]))
+	assert.Contains(t, err.Error(), "stuck at end of feed")
+}
@@ -0,0 +1,28 @@
+package changefeedtest
+
+import (
+	"testing"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/testdb"
+)
+
+// Database is a temporary, contained database created by NewDatabase.
+type Database = testdb.Database
+
+// DatabaseOptions configures NewDatabase; the zero value gives the defaults.
+type DatabaseOptions = testdb.DatabaseOptions
+
+type RoleMember = testdb.RoleMember
+
+// NewDatabase creates a database using the default DatabaseOptions; see
+// DatabaseOptions.NewDatabase.
+func NewDatabase(t testing.TB, dsn string, migrations ...string) *Database {
+	t.Helper()
+	return testdb.NewDatabase(t, dsn, migrations...)
+}
+
+// SplitBatches splits a migration script on the "go" batch separator.
+func SplitBatches(script string) []string {
+	return sqlutil.SplitBatches(script)
+}
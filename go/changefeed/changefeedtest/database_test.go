@@ -0,0 +1,53 @@
+package changefeedtest
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+func testDSN(t *testing.T) string {
+	dsn := os.Getenv("SQLSERVER_DSN")
+	if dsn == "" {
+		t.Skip("SQLSERVER_DSN not set")
+	}
+	return dsn
+}
+
+func TestNewDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := DatabaseOptions{
+		ExtraUsers: []string{"auditor"},
+		RoleMembers: []RoleMember{
+			{Role: "changefeed.writers:myservice.MyEvent", Member: "writer"},
+			{Role: "changefeed.readers:myservice.MyEvent", Member: "reader"},
+			{Role: "changefeed.readers:myservice.MyEvent", Member: "auditor"},
+		},
+	}.NewDatabase(t, testDSN(t), "../../../migrations/2001.changefeed-v2.sql", "testdata/myevent.sql")
+
+	var isSnapshot bool
+	require.NoError(t, db.AdminDB.QueryRowContext(ctx, `select is_read_committed_snapshot_on from sys.databases where name = db_name()`).Scan(&isSnapshot))
+	assert.True(t, isSnapshot)
+
+	tx, err := db.WriterDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = tx.ExecContext(ctx, `insert into myservice.MyEvent (AggregateID, Version) values (1, 1)`)
+	require.NoError(t, err)
+	require.NoError(t, changefeed.NewOutboxWriter("myservice.MyEvent").Publish(ctx, tx,
+		changefeed.OutboxRow{Key: map[string]interface{}{"AggregateID": 1, "Version": 1}}))
+	require.NoError(t, tx.Commit())
+
+	for _, reader := range []*changefeed.OutboxReader{
+		changefeed.NewOutboxReader(db.ReaderDB, "myservice.MyEvent"),
+		changefeed.NewOutboxReader(db.Open(t, "auditor"), "myservice.MyEvent"),
+	} {
+		page, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(page))
+	}
+}
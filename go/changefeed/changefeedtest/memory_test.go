@@ -0,0 +1,213 @@
+package changefeedtest
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+func ulidTime(u ulid.ULID) string {
+	return time.UnixMilli(int64(u.Time())).UTC().Format(time.RFC3339)
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.DateTime, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func key(aggregateID, version int) map[string]interface{} {
+	return map[string]interface{}{"AggregateID": aggregateID, "Version": version}
+}
+
+// Same scenario as TestHappyDayOutbox, which runs against SQL Server
+func TestOutboxFeedHappyDay(t *testing.T) {
+	ctx := context.Background()
+	feed := NewOutboxFeed()
+
+	require.NoError(t, feed.Publish(ctx, nil,
+		changefeed.OutboxRow{TimeHint: parseTime("2023-05-31 12:00:00"), Key: key(1000, 1)},
+		changefeed.OutboxRow{TimeHint: parseTime("2023-05-31 12:03:00"), Key: key(1001, 1)},
+		changefeed.OutboxRow{TimeHint: parseTime("2023-05-31 12:02:00"), Key: key(1000, 2)},
+		changefeed.OutboxRow{TimeHint: parseTime("2023-05-31 12:01:00"), Key: key(1001, 2)},
+		changefeed.OutboxRow{TimeHint: parseTime("2023-05-31 12:10:00"), Key: key(1000, 3)},
+	))
+
+	page1, err := feed.ReadPage(ctx, 0, ulid.ULID{}, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(page1))
+	assert.Equal(t, "2023-05-31T12:00:00Z", ulidTime(page1[0].ULID))
+	assert.Equal(t, "2023-05-31T12:03:00Z", ulidTime(page1[1].ULID))
+	assert.Equal(t, "2023-05-31T12:03:00Z", ulidTime(page1[2].ULID))
+
+	// Not at the head, so only what is already in the feed is returned
+	page2, err := feed.ReadPage(ctx, 0, page1[1].ULID, 100)
+	require.NoError(t, err)
+	require.Equal(t, []changefeed.Event{page1[2]}, page2)
+
+	page3, err := feed.ReadPage(ctx, 0, page2[0].ULID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page3))
+	// the :03 is carried over through shard state, replacing the time_hint that was :01
+	assert.Equal(t, "2023-05-31T12:03:00Z", ulidTime(page3[0].ULID))
+	assert.Equal(t, "2023-05-31T12:10:00Z", ulidTime(page3[1].ULID))
+
+	assert.Equal(t, 0, feed.OutboxLen(0))
+	assert.Equal(t, 5, feed.FeedLen(0))
+
+	all, err := feed.ReadPage(ctx, 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	var keys []map[string]interface{}
+	for i, e := range all {
+		keys = append(keys, e.Values)
+		if i > 0 {
+			assert.Less(t, all[i-1].ULID.Compare(e.ULID), 0)
+		}
+	}
+	assert.Equal(t, []map[string]interface{}{key(1000, 1), key(1001, 1), key(1000, 2), key(1001, 2), key(1000, 3)}, keys)
+}
+
+func TestOutboxFeedTransactions(t *testing.T) {
+	ctx := context.Background()
+	feed := NewOutboxFeed()
+
+	tx1 := Begin()
+	tx2 := Begin()
+	require.NoError(t, feed.Publish(ctx, tx1, changefeed.OutboxRow{Key: key(1, 1)}))
+	require.NoError(t, feed.Publish(ctx, tx2, changefeed.OutboxRow{Key: key(2, 1)}))
+
+	page, err := feed.ReadPage(ctx, 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(page))
+
+	// tx2 commits first and is read first
+	require.NoError(t, tx2.Commit())
+	page, err = feed.ReadPage(ctx, 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, key(2, 1), page[0].Values)
+
+	require.NoError(t, tx1.Commit())
+	page, err = feed.ReadPage(ctx, 0, page[0].ULID, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, key(1, 1), page[0].Values)
+
+	// rolled back events are never seen
+	tx3 := Begin()
+	require.NoError(t, feed.Publish(ctx, tx3, changefeed.OutboxRow{Key: key(3, 1)}))
+	require.NoError(t, tx3.Rollback())
+	assert.Equal(t, 0, feed.OutboxLen(0))
+	assert.ErrorIs(t, tx3.Commit(), ErrTxDone)
+}
+
+// Same scenario as TestHappyDayBlocking, which runs against SQL Server
+func TestBlockingFeedHappyDay(t *testing.T) {
+	ctx := context.Background()
+	feed := NewBlockingFeed()
+	now := parseTime("2023-09-30 00:00:00")
+
+	_, err := feed.Lock(ctx, nil, 0, now)
+	assert.ErrorIs(t, err, ErrNotInTransaction)
+
+	tx := Begin()
+	var inserted []ulid.ULID
+	insert := func(u ulid.ULID) {
+		require.NoError(t, feed.Insert(ctx, tx, 0, u, nil))
+		inserted = append(inserted, u)
+	}
+	ulids, err := feed.Lock(ctx, tx, 0, now)
+	require.NoError(t, err)
+	insert(ulids.ULID(0))
+	insert(ulids.ULID(1))
+	ulids, err = feed.Lock(ctx, tx, 0, now)
+	require.NoError(t, err)
+	insert(ulids.ULID(0))
+	ulids, err = feed.Lock(ctx, tx, 0, now)
+	require.NoError(t, err)
+	insert(ulids.ULID(0))
+	ulids, err = feed.Lock(ctx, tx, 0, time.Time{})
+	require.NoError(t, err)
+	insert(ulids.ULID(0))
+	require.NoError(t, tx.Commit())
+
+	ints := []uint64{}
+	for _, u := range inserted {
+		ints = append(ints, binary.BigEndian.Uint64(u[8:16]))
+	}
+	assert.Equal(t, ints[0]+1, ints[1])
+	assert.Equal(t, ints[0]+100000000000, ints[2])
+	assert.Equal(t, ints[0]+200000000000, ints[3])
+	assert.Equal(t, inserted[0][:8], inserted[3][:8])
+	assert.Less(t, inserted[3].Compare(inserted[4]), 0)
+
+	page, err := feed.ReadPage(ctx, 0, ulid.ULID{}, 100)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(page))
+	for i := range page {
+		assert.Equal(t, inserted[i], page[i].ULID)
+	}
+}
+
+func TestBlockingFeedSerializesWriters(t *testing.T) {
+	ctx := context.Background()
+	feed := NewBlockingFeed()
+
+	const writers, eventsPerWriter = 10, 50
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for w := 0; w != writers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i != eventsPerWriter; i++ {
+				tx := Begin()
+				ulids, err := feed.Lock(ctx, tx, 0, time.Time{})
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.NoError(t, feed.Insert(ctx, tx, 0, ulids.ULID(0), map[string]interface{}{"Thread": w, "Number": i}))
+				assert.NoError(t, tx.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+
+	page, err := feed.ReadPage(ctx, 0, ulid.ULID{}, writers*eventsPerWriter)
+	require.NoError(t, err)
+	require.Equal(t, writers*eventsPerWriter, len(page))
+	next := make(map[int]int)
+	for _, e := range page {
+		thread := e.Values["Thread"].(int)
+		assert.Equal(t, next[thread], e.Values["Number"])
+		next[thread]++
+	}
+}
+
+func TestBlockingFeedLockContext(t *testing.T) {
+	feed := NewBlockingFeed()
+	tx1 := Begin()
+	_, err := feed.Lock(context.Background(), tx1, 0, time.Time{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = feed.Lock(ctx, Begin(), 0, time.Time{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// other shards are not blocked
+	_, err = feed.Lock(context.Background(), Begin(), 1, time.Time{})
+	assert.NoError(t, err)
+
+	require.NoError(t, tx1.Rollback())
+	_, err = feed.Lock(context.Background(), Begin(), 0, time.Time{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,165 @@
+package changefeedtest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+type outboxEntry struct {
+	orderSequence int64
+	timeHint      time.Time
+	key           map[string]interface{}
+}
+
+// OutboxFeed is an in-memory emulation of a feed set up with @outbox = 1.
+// Publish corresponds to inserting into [outbox:<table>], and ReadPage to
+// calling [read_feed:<table>].
+type OutboxFeed struct {
+	mu            sync.Mutex
+	orderSequence int64
+	states        map[int]*shardState
+	outbox        map[int][]outboxEntry
+	feed          map[int][]changefeed.Event
+}
+
+var (
+	_ changefeed.Reader          = &OutboxFeed{}
+	_ changefeed.OutboxPublisher = &OutboxFeed{}
+)
+
+func NewOutboxFeed() *OutboxFeed {
+	return &OutboxFeed{
+		states: make(map[int]*shardState),
+		outbox: make(map[int][]outboxEntry),
+		feed:   make(map[int][]changefeed.Event),
+	}
+}
+
+// Publish adds rows to the outbox. If tx is a *Tx the rows become visible
+// to readers on commit; otherwise right away. Like the default constraint on
+// [outbox:<table>], order_sequence is allocated at the time of the call and
+// not at commit.
+func (f *OutboxFeed) Publish(ctx context.Context, tx changefeed.Execer, rows ...changefeed.OutboxRow) error {
+	f.mu.Lock()
+	entries := make([]outboxEntry, len(rows))
+	for i, row := range rows {
+		f.orderSequence++
+		timeHint := row.TimeHint
+		if timeHint.IsZero() {
+			timeHint = time.Now()
+		}
+		entries[i] = outboxEntry{
+			orderSequence: f.orderSequence,
+			timeHint:      truncateTime(timeHint),
+			key:           copyValues(row.Key),
+		}
+	}
+	f.mu.Unlock()
+
+	return do(tx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, row := range rows {
+			shard := append(f.outbox[row.ShardID], entries[i])
+			sort.Slice(shard, func(i, j int) bool { return shard[i].orderSequence < shard[j].orderSequence })
+			f.outbox[row.ShardID] = shard
+		}
+	})
+}
+
+func (f *OutboxFeed) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]changefeed.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Read from the feed if we are not at the head
+	if page := pageAfter(f.feed[shardID], cursor, pageSize); len(page) > 0 {
+		return page, nil
+	}
+
+	// At the head; take a page from the outbox and assign ULIDs
+	outbox := f.outbox[shardID]
+	n := min(pageSize, len(outbox))
+	if n == 0 {
+		return nil, nil
+	}
+	taken := make([]outboxEntry, n)
+	copy(taken, outbox[:n])
+	f.outbox[shardID] = outbox[n:]
+
+	// Patch time_hint to be non-decreasing in order_sequence
+	maxTime := taken[0].timeHint
+	for i := range taken {
+		if taken[i].timeHint.After(maxTime) {
+			maxTime = taken[i].timeHint
+		}
+		taken[i].timeHint = maxTime
+	}
+
+	r := update(f.states, shardID, maxTime, int64(n))
+
+	page := make([]changefeed.Event, n)
+	for i, entry := range taken {
+		var high [8]byte
+		var low int64
+		if !r.hasPrevious || entry.timeHint.After(r.previousTime) {
+			// Embeds the time_hint itself, not the max time
+			ts := timeBytes(entry.timeHint)
+			copy(high[:], ts[:])
+			low = r.nextULIDLow
+		} else {
+			high = r.previousULIDHigh
+			low = r.previousULIDLow
+		}
+		page[i] = changefeed.Event{
+			ULID:   changefeed.ULIDs{High: high, Low: low}.ULID(int64(i)),
+			Values: copyValues(entry.key),
+		}
+	}
+	f.feed[shardID] = append(f.feed[shardID], page...)
+	return copyEvents(page), nil
+}
+
+// OutboxLen returns the number of entries in the outbox for the shard that
+// have not yet been moved to the feed.
+func (f *OutboxFeed) OutboxLen(shardID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.outbox[shardID])
+}
+
+// FeedLen returns the number of entries that have been assigned a ULID in the shard.
+func (f *OutboxFeed) FeedLen(shardID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.feed[shardID])
+}
+
+// pageAfter returns up to pageSize events with ULID > cursor from a slice sorted on ULID
+func pageAfter(events []changefeed.Event, cursor ulid.ULID, pageSize int) []changefeed.Event {
+	i := sort.Search(len(events), func(i int) bool { return events[i].ULID.Compare(cursor) > 0 })
+	return copyEvents(events[i:min(len(events), i+pageSize)])
+}
+
+func copyEvents(events []changefeed.Event) []changefeed.Event {
+	if len(events) == 0 {
+		return nil
+	}
+	result := make([]changefeed.Event, len(events))
+	for i, e := range events {
+		result[i] = changefeed.Event{ULID: e.ULID, Values: copyValues(e.Values)}
+	}
+	return result
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		result[k] = v
+	}
+	return result
+}
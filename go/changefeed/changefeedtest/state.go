@@ -0,0 +1,84 @@
+package changefeedtest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// shardState mirrors a row in [state:<table>]; see ULID-NOTES.md.
+type shardState struct {
+	time     time.Time
+	ulidHigh [8]byte
+	ulidLow  int64
+}
+
+// updateResult mirrors the output parameters of [update_state:<table>]
+type updateResult struct {
+	hasPrevious      bool
+	previousTime     time.Time
+	previousULIDHigh [8]byte
+	previousULIDLow  int64
+
+	nextTime     time.Time
+	nextULIDHigh [8]byte
+	nextULIDLow  int64
+}
+
+// datetime2(3) has millisecond precision
+func truncateTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// timeBytes returns the 6 byte millisecond timestamp used as ULID prefix
+func timeBytes(t time.Time) (result [6]byte) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(t.UnixMilli()))
+	copy(result[:], buf[2:])
+	return
+}
+
+// newHighLow returns a fresh ulid_high (timestamp + 2 random bytes) and a
+// random ulid_low, with the second-highest bit cleared so that callers can
+// add to it without overflowing.
+func newHighLow(t time.Time) (high [8]byte, low int64) {
+	var random [10]byte
+	_, _ = rand.Read(random[:])
+	ts := timeBytes(t)
+	copy(high[:6], ts[:])
+	copy(high[6:], random[:2])
+	low = int64(binary.BigEndian.Uint64(random[2:]) & 0xbfffffffffffffff)
+	return
+}
+
+// update emulates [update_state:<table>]: it reserves count ULIDs for the
+// shard, moving the time forward if timeHint is later than the shard time.
+func update(states map[int]*shardState, shardID int, timeHint time.Time, count int64) (r updateResult) {
+	timeHint = truncateTime(timeHint)
+	state, ok := states[shardID]
+	if !ok {
+		// First time for this shard; upsert behaviour
+		r.nextTime = timeHint
+		r.nextULIDHigh, r.nextULIDLow = newHighLow(timeHint)
+		states[shardID] = &shardState{time: r.nextTime, ulidHigh: r.nextULIDHigh, ulidLow: r.nextULIDLow + count}
+		return
+	}
+
+	r.hasPrevious = true
+	r.previousTime = state.time
+	r.previousULIDHigh = state.ulidHigh
+	r.previousULIDLow = state.ulidLow
+
+	if timeHint.After(state.time) {
+		r.nextTime = timeHint
+		r.nextULIDHigh, r.nextULIDLow = newHighLow(timeHint)
+	} else {
+		r.nextTime = state.time
+		r.nextULIDHigh = state.ulidHigh
+		r.nextULIDLow = state.ulidLow
+	}
+	state.time = r.nextTime
+	state.ulidHigh = r.nextULIDHigh
+	state.ulidLow = r.nextULIDLow + count
+	return
+}
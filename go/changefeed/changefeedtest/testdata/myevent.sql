@@ -0,0 +1,13 @@
+create schema myservice;
+
+go
+
+create table myservice.MyEvent (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+grant insert on myservice.MyEvent to writer;
+
+exec [changefeed].setup_feed 'myservice.MyEvent', @outbox = 1;
@@ -0,0 +1,97 @@
+// Package changefeedtest contains helpers for testing code that uses changefeed.
+//
+// OutboxFeed and BlockingFeed are in-memory stand-ins for feeds set up with
+// @outbox = 1 and @blocking = 1 respectively. They implement the same
+// interfaces as the SQL-backed types in package changefeed, and emulate the
+// semantics of the generated SQL (shard state, order_sequence, patching of
+// time_hint and ULID assignment), so that consumer and publisher logic can be
+// unit tested without a database.
+//
+// For tests that do need SQL Server, NewDatabase sets up a temporary
+// database with the migrations and users needed.
+package changefeedtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrTxDone           = errors.New("changefeedtest: transaction has already been committed or rolled back")
+	ErrNotInTransaction = errors.New("changefeedtest: please call inside a transaction")
+	ErrNoSQL            = errors.New("changefeedtest: Tx cannot execute SQL")
+)
+
+// Tx emulates a database transaction. Publishing to an in-memory feed through
+// a Tx is only visible to readers after Commit, and locks taken by
+// BlockingFeed.Lock are held until Commit or Rollback.
+//
+// Tx satisfies changefeed.Execer so it can be passed wherever a *sql.Tx is
+// expected; but ExecContext itself always fails.
+type Tx struct {
+	mu       sync.Mutex
+	done     bool
+	onCommit []func()
+	locks    []*sync.Mutex
+	unlock   []func()
+}
+
+func Begin() *Tx {
+	return &Tx{}
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrNoSQL
+}
+
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	for _, f := range tx.onCommit {
+		f()
+	}
+	tx.end()
+	return nil
+}
+
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.end()
+	return nil
+}
+
+func (tx *Tx) end() {
+	tx.done = true
+	// release in reverse order of acquisition
+	for i := len(tx.unlock) - 1; i >= 0; i-- {
+		tx.unlock[i]()
+	}
+	tx.onCommit = nil
+	tx.locks = nil
+	tx.unlock = nil
+}
+
+// do runs f at commit if tx is a *Tx, or right away otherwise (autocommit).
+func do(tx interface{}, f func()) error {
+	t, ok := tx.(*Tx)
+	if !ok || t == nil {
+		f()
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxDone
+	}
+	t.onCommit = append(t.onCommit, f)
+	return nil
+}
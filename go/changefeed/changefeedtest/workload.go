@@ -0,0 +1,213 @@
+package changefeedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+// Workload runs concurrent writers and readers against a single shard of a
+// feed, and checks that every reader sees every event exactly once and in
+// order. Each writer w publishes versions 0, 1, ... EventsPerWriter-1 of its
+// own key; each reader consumes the feed from the start with its own cursor
+// and OrderChecker.
+type Workload struct {
+	Writers, Readers, EventsPerWriter int
+
+	// By default writers and readers all run in parallel. ReadAfterWrite waits
+	// for all writers to finish before starting the readers.
+	SerialWrites, SerialReads, ReadAfterWrite bool
+
+	// Write publishes the given version for the given writer. It is called
+	// sequentially for each writer, with increasing versions.
+	Write func(ctx context.Context, writer, version int) error
+
+	Reader  changefeed.Reader
+	ShardID int
+	// Observe maps an event read back to the writer and version it was published with
+	Observe func(event changefeed.Event) (writer, version int, err error)
+
+	// PageSize passed to Reader.ReadPage; defaults to 10
+	PageSize int
+	// PollInterval is how long a reader waits after an empty page; defaults to not waiting
+	PollInterval time.Duration
+	// StuckAfter is how many empty pages a reader accepts after all writers
+	// are done, before it reports being stuck at the end of the feed; defaults to 10
+	StuckAfter int
+	// Logf, if set, is called with progress for each page read
+	Logf func(format string, args ...interface{})
+	// Retry, if set, is asked whether a failed Write or ReadPage should be
+	// retried instead of failing the workload; e.g. for injected faults.
+	// Write is retried with the same version.
+	Retry func(err error) bool
+}
+
+// Run runs the workload and returns all errors from writers, readers and
+// order checkers.
+func (w Workload) Run(ctx context.Context) error {
+	if w.PageSize == 0 {
+		w.PageSize = 10
+	}
+	if w.StuckAfter == 0 {
+		w.StuckAfter = 10
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu          sync.Mutex
+		errs        []error
+		writersDone atomic.Bool
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+		cancel()
+	}
+
+	var writers sync.WaitGroup
+	writers.Add(w.Writers)
+	writeThread := func(writer int) {
+		defer writers.Done()
+		for version := 0; version != w.EventsPerWriter; version++ {
+			if err := w.write(ctx, writer, version); err != nil {
+				fail(fmt.Errorf("writer %03d: %w", writer, err))
+				return
+			}
+		}
+	}
+	go func() {
+		for i := 0; i != w.Writers; i++ {
+			if w.SerialWrites {
+				writeThread(i)
+			} else {
+				go writeThread(i)
+			}
+		}
+		writers.Wait()
+		writersDone.Store(true)
+	}()
+
+	expected := make(map[string]int, w.Writers)
+	for i := 0; i != w.Writers; i++ {
+		expected[workloadKey(i)] = w.EventsPerWriter - 1
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(w.Readers)
+	readThread := func(reader int) {
+		defer readers.Done()
+		checker := NewOrderChecker(0)
+		if err := w.read(ctx, reader, checker, &writersDone); err != nil {
+			fail(fmt.Errorf("reader %03d: %w", reader, err))
+		} else if ctx.Err() == nil {
+			// Only check completeness if we were not interrupted
+			checker.CheckComplete(expected)
+		}
+		if err := checker.Err(); err != nil {
+			fail(fmt.Errorf("reader %03d: %w", reader, err))
+		}
+	}
+
+	if w.ReadAfterWrite {
+		writers.Wait()
+	}
+	for i := 0; i != w.Readers; i++ {
+		if w.SerialReads {
+			readThread(i)
+		} else {
+			go readThread(i)
+		}
+	}
+	readers.Wait()
+	writers.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return errors.Join(errs...)
+}
+
+func (w Workload) read(ctx context.Context, reader int, checker *OrderChecker, writersDone *atomic.Bool) error {
+	total := w.Writers * w.EventsPerWriter
+	var cursor ulid.ULID
+	emptyPages := 0
+	for checker.Count() < total {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Check before reading, so that the last page is always read after writers are done
+		done := writersDone.Load()
+
+		page, err := w.Reader.ReadPage(ctx, w.ShardID, cursor, w.PageSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if w.retry(err) {
+				continue
+			}
+			return err
+		}
+		for _, e := range page {
+			writer, version, err := w.Observe(e)
+			if err != nil {
+				return err
+			}
+			checker.Observe(Observation{ULID: e.ULID, Key: workloadKey(writer), Version: version})
+			cursor = e.ULID
+		}
+		if w.Logf != nil {
+			w.Logf("%03d: read %d/%d (cursor=%s)", reader, checker.Count(), total, cursor)
+		}
+
+		if len(page) > 0 {
+			emptyPages = 0
+			continue
+		}
+		if done {
+			emptyPages++
+			if emptyPages > w.StuckAfter {
+				return fmt.Errorf("stuck at end of feed without having consumed all events (%d of %d)", checker.Count(), total)
+			}
+		}
+		if w.PollInterval > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(w.PollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+func (w Workload) write(ctx context.Context, writer, version int) error {
+	for {
+		err := w.Write(ctx, writer, version)
+		if err == nil || ctx.Err() != nil || !w.retry(err) {
+			return err
+		}
+	}
+}
+
+func (w Workload) retry(err error) bool {
+	if w.Retry == nil || !w.Retry(err) {
+		return false
+	}
+	if w.Logf != nil {
+		w.Logf("retrying after: %s", err)
+	}
+	return true
+}
+
+func workloadKey(writer int) string {
+	return fmt.Sprint(writer)
+}
@@ -0,0 +1,85 @@
+// Command changefeed-server holds the SQL connections for a set of feeds and
+// serves them to consumers as server-sent events; see package server.
+//
+// Example:
+//
+//	changefeed-server -dsn 'sqlserver://...' \
+//	    -outbox myservice.MyEvent \
+//	    -blocking myservice.OtherEvent:ULID:Shard
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/microsoft/go-mssqldb"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/server"
+)
+
+func main() {
+	var (
+		dsn          = flag.String("dsn", os.Getenv("SQLSERVER_DSN"), "SQL Server connection string; defaults to $SQLSERVER_DSN")
+		listen       = flag.String("listen", ":8080", "address to listen on")
+		pageSize     = flag.Int("pagesize", server.DefaultPageSize, "page size used when reading feeds")
+		pollInterval = flag.Duration("poll-interval", server.DefaultPollInterval, "how long to wait between reads at the head of a feed")
+		schema       = flag.String("schema", changefeed.DefaultSchema, "schema the changefeed library is installed in")
+		outboxFeeds  []string
+		blockFeeds   []string
+	)
+	flag.Func("outbox", "serve a feed set up with @outbox = 1; `table` (repeatable)", func(s string) error {
+		outboxFeeds = append(outboxFeeds, s)
+		return nil
+	})
+	flag.Func("blocking", "serve a feed set up with @blocking = 1; `table:ulidcolumn[:shardcolumn]` (repeatable)", func(s string) error {
+		blockFeeds = append(blockFeeds, s)
+		return nil
+	})
+	flag.Parse()
+
+	if *dsn == "" {
+		log.Fatal("-dsn or SQLSERVER_DSN is required")
+	}
+	if len(outboxFeeds)+len(blockFeeds) == 0 {
+		log.Fatal("no feeds configured; use -outbox and/or -blocking")
+	}
+
+	db, err := sql.Open("sqlserver", *dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	feeds := make(map[string]changefeed.Reader)
+	for _, table := range outboxFeeds {
+		feeds[table] = changefeed.NewOutboxReader(db, table, changefeed.WithSchema(*schema))
+	}
+	for _, spec := range blockFeeds {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			log.Fatalf("invalid -blocking %q; expected table:ulidcolumn[:shardcolumn]", spec)
+		}
+		shardColumn := ""
+		if len(parts) == 3 {
+			shardColumn = parts[2]
+		}
+		feeds[parts[0]] = changefeed.NewBlockingReader(db, parts[0], parts[1], shardColumn)
+	}
+
+	srv := server.New(feeds)
+	srv.PageSize = *pageSize
+	srv.PollInterval = *pollInterval
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("serving %d feeds on %s", len(feeds), *listen)
+	log.Fatal(httpServer.ListenAndServe())
+}
@@ -0,0 +1,348 @@
+// Command changefeed administers feeds set up by the mssql-changefeed library.
+//
+// Usage:
+//
+//	changefeed [-dsn dsn] [-schema changefeed] <command> [arguments]
+//
+// Commands:
+//
+//	deadletter list table
+//	                  list the events consumers have given up on
+//	deadletter redrive table [ulid...]
+//	                  publish dead-lettered events of an outbox feed again; all
+//	                  of them if no ULIDs are given
+//	deadletter purge [-all] table [ulid...]
+//	                  delete dead-lettered events
+//	grants [table...] show who can publish to and consume each registered feed, and
+//	                  whether the read_feed signature is valid; exits with status 1
+//	                  if a signature is not
+//	setup [-mode outbox|blocking] [--dry-run] table
+//	                  run setup_feed for table, or print the script it would
+//	                  execute with --dry-run
+//	verify table...   compare the objects set up for each feed with what the
+//	                  installed library generates now; exits with status 1 on differences
+//	upgrade-all       run upgrade_feed for every registered feed generated by an
+//	                  older library version
+//	watchdog [-idle duration] [-kill]
+//	                  list sessions that are idle in a transaction holding a feed
+//	                  lock, and kill them with -kill
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error
+}
+
+var commands = map[string]command{
+	"deadletter":  {usage: "deadletter list|redrive|purge [-all] table [ulid...]", run: deadLetter},
+	"grants":      {usage: "grants [table...]", run: grants},
+	"setup":       {usage: "setup [-mode outbox|blocking] [--dry-run] table", run: setup},
+	"verify":      {usage: "verify table...", run: verify},
+	"upgrade-all": {usage: "upgrade-all", run: upgradeAll},
+	"watchdog":    {usage: "watchdog [-idle duration] [-kill]", run: watchdog},
+}
+
+// errFailed is returned by commands that have already reported what went wrong
+var errFailed = errors.New("failed")
+
+func main() {
+	dsn := flag.String("dsn", os.Getenv("SQLSERVER_DSN"), "SQL Server connection string; defaults to $SQLSERVER_DSN")
+	schema := flag.String("schema", changefeed.DefaultSchema, "schema the changefeed library is installed in")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: changefeed [flags] <command> [arguments]\n\ncommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *dsn == "" {
+		fmt.Fprintln(os.Stderr, "-dsn or SQLSERVER_DSN is required")
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("sqlserver", *dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	err = c.run(context.Background(), db, []changefeed.Option{changefeed.WithSchema(*schema)}, flag.Args()[1:])
+	if err != nil {
+		if !errors.Is(err, errFailed) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func grants(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	feeds, err := changefeed.ListFeeds(ctx, db, opts...)
+	if err != nil {
+		return err
+	}
+	only := make(map[string]bool)
+	for _, table := range args {
+		only[table] = true
+	}
+	failed := false
+	for _, f := range feeds {
+		if len(only) > 0 && !only[f.Table] {
+			continue
+		}
+		delete(only, f.Table)
+		members, err := changefeed.ListMembers(ctx, db, f.Table, opts...)
+		if err != nil {
+			return err
+		}
+		publish, consume := []string{}, []string{}
+		for _, m := range members {
+			if m.Access == changefeed.Publish {
+				publish = append(publish, m.Principal)
+			} else {
+				consume = append(consume, m.Principal)
+			}
+		}
+		fmt.Printf("%s (%s)\n", f.Table, f.Mode)
+		fmt.Printf("  publish: %s\n", strings.Join(publish, ", "))
+		if f.Mode != changefeed.Outbox {
+			continue
+		}
+		fmt.Printf("  consume: %s\n", strings.Join(consume, ", "))
+		signed, err := changefeed.ReadFeedSigned(ctx, db, f.Table, opts...)
+		if err != nil {
+			return err
+		}
+		if signed {
+			fmt.Printf("  read_feed signature: valid\n")
+		} else {
+			fmt.Printf("  read_feed signature: INVALID; consumers will not be able to read the feed\n")
+			failed = true
+		}
+	}
+	for table := range only {
+		fmt.Fprintf(os.Stderr, "%s: not a registered feed\n", table)
+		failed = true
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+// parseInterspersed parses flags that may come before, between or after the
+// positional arguments, e.g. "setup myservice.MyEvent --dry-run", and returns
+// the positional arguments. Everything after "--" is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func setup(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	flags := flag.NewFlagSet("setup", flag.ContinueOnError)
+	mode := flags.String("mode", string(changefeed.Outbox), "kind of feed; outbox or blocking")
+	dryRun := flags.Bool("dry-run", false, "print the script setup_feed would execute instead of running it")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return errFailed
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: changefeed setup [-mode outbox|blocking] [--dry-run] table")
+	}
+	table := positional[0]
+
+	if *dryRun {
+		script, err := changefeed.RenderSetup(ctx, db, table, changefeed.Mode(*mode), opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		return nil
+	}
+	return changefeed.SetupFeed(ctx, db, table, changefeed.Mode(*mode), opts...)
+}
+
+func verify(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: changefeed verify table...")
+	}
+	failed := false
+	for _, table := range args {
+		diffs, err := changefeed.Verify(ctx, db, table, opts...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", table, err)
+			failed = true
+			continue
+		}
+		for _, d := range diffs {
+			fmt.Printf("%s: %s\n", table, d)
+		}
+		if len(diffs) == 0 {
+			fmt.Printf("%s: ok\n", table)
+		}
+		failed = failed || len(diffs) > 0
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func upgradeAll(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: changefeed upgrade-all")
+	}
+	upgraded, err := changefeed.UpgradeAll(ctx, db, opts...)
+	for _, f := range upgraded {
+		fmt.Printf("%s: upgraded from version %d\n", f.Table, f.LibraryVersion)
+	}
+	if err == nil && len(upgraded) == 0 {
+		fmt.Println("all feeds are up to date")
+	}
+	return err
+}
+
+func deadLetter(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	const usage = "usage: changefeed deadletter list|redrive|purge [-all] table [ulid...]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	flags := flag.NewFlagSet("deadletter", flag.ContinueOnError)
+	all := flags.Bool("all", false, "purge every dead-lettered event of the feed")
+	positional, err := parseInterspersed(flags, args[1:])
+	if err != nil {
+		return errFailed
+	}
+	if len(positional) == 0 {
+		return errors.New(usage)
+	}
+	table := positional[0]
+	var ulids []ulid.ULID
+	for _, arg := range positional[1:] {
+		id, err := ulid.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		ulids = append(ulids, id)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(ulids) > 0 || *all {
+			return errors.New(usage)
+		}
+		deadLetters, err := changefeed.ListDeadLetters(ctx, db, table, opts...)
+		if err != nil {
+			return err
+		}
+		for _, d := range deadLetters {
+			keys := make([]string, 0, len(d.Values))
+			for column, value := range d.Values {
+				keys = append(keys, fmt.Sprintf("%s=%v", column, value))
+			}
+			sort.Strings(keys)
+			fmt.Printf("%d %s %s attempts=%d at %s: %s\n", d.ShardID, d.ULID, strings.Join(keys, " "),
+				d.Attempts, d.Time.Format(time.RFC3339), d.Error)
+		}
+		return nil
+	case "redrive":
+		if *all {
+			return errors.New(usage)
+		}
+		n, err := changefeed.RedriveDeadLetters(ctx, db, table, ulids, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: redrove %d events\n", table, n)
+		return nil
+	case "purge":
+		if len(ulids) == 0 && !*all {
+			return errors.New("purge needs the ULIDs to delete, or -all")
+		}
+		if len(ulids) > 0 && *all {
+			return errors.New(usage)
+		}
+		n, err := changefeed.PurgeDeadLetters(ctx, db, table, ulids, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: purged %d events\n", table, n)
+		return nil
+	}
+	return errors.New(usage)
+}
+
+func watchdog(ctx context.Context, db *sql.DB, opts []changefeed.Option, args []string) error {
+	flags := flag.NewFlagSet("watchdog", flag.ContinueOnError)
+	idle := flags.Duration("idle", changefeed.DefaultIdleAfter, "report sessions idle for longer than this while holding a feed lock")
+	kill := flags.Bool("kill", false, "kill the sessions found")
+	if err := flags.Parse(args); err != nil {
+		return errFailed
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: changefeed watchdog [-idle duration] [-kill]")
+	}
+	w := changefeed.NewWatchdog(db, opts...)
+	w.IdleAfter = *idle
+	w.Kill = *kill
+	sessions, err := w.Check(ctx)
+	for _, s := range sessions {
+		status := "idle"
+		if s.Killed {
+			status = "killed"
+		} else if s.KillError != nil {
+			status = "not killed: " + s.KillError.Error()
+		}
+		fmt.Printf("session %d (%s@%s, %s) idle for %s holding %s: %s\n", s.SessionID, s.Login, s.Host, s.Program,
+			s.Idle.Round(time.Second), strings.Join(s.Resources, ", "), status)
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// DeadLetter is an event a consumer gave up on, stored in [deadletter:<table>].
+type DeadLetter struct {
+	ShardID int
+	ULID    ulid.ULID
+	// Values holds the primary key columns of the source table
+	Values   map[string]interface{}
+	Error    string
+	Attempts int
+	Time     time.Time
+}
+
+// deadLetterColumns are the columns of [deadletter:<table>] that are not
+// primary key columns of the source table
+var deadLetterColumns = []string{"shard_id", "ulid", "error", "attempts", "dead_lettered_time"}
+
+// DeadLetterStore records events in [deadletter:<table>]. It can be used as
+// the Store of a relay.DeadLetterPolicy. Consumers of outbox feeds need to be
+// members of the readers role of the feed; for blocking feeds, permissions on
+// the table have to be granted separately.
+type DeadLetterStore struct {
+	DB    *sql.DB
+	Table string
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+
+	mu      sync.Mutex
+	columns []string
+}
+
+func NewDeadLetterStore(db *sql.DB, table string, opts ...Option) *DeadLetterStore {
+	return &DeadLetterStore{DB: db, Table: table, Schema: newOptions(opts).schema}
+}
+
+// primaryKeyColumns returns the columns of the source table's primary key,
+// as they are in [deadletter:<table>]
+func (s *DeadLetterStore) primaryKeyColumns(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.columns != nil {
+		return s.columns, nil
+	}
+	rows, err := s.DB.QueryContext(ctx, `
+select name from sys.columns
+where object_id = object_id(@p1, 'U') and name not in ('shard_id', 'ulid', 'error', 'attempts', 'dead_lettered_time')
+order by column_id`, feedObjectName(s.Schema, "deadletter", s.Table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%s not found; run upgrade_feed", feedObjectName(s.Schema, "deadletter", s.Table))
+	}
+	s.columns = columns
+	return columns, nil
+}
+
+// DeadLetter records that the consumer gave up on event after attempts
+// attempts, the last one failing with cause. Recording the same event again
+// updates the error and attempts; this is a single merge with holdlock, so
+// consumers recording the same event concurrently do not race.
+func (s *DeadLetterStore) DeadLetter(ctx context.Context, shardID int, event Event, cause error, attempts int) error {
+	columns, err := s.primaryKeyColumns(ctx)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{
+		sql.Named("shard_id", shardID),
+		sql.Named("ulid", event.ULID[:]),
+		sql.Named("error", cause.Error()),
+		sql.Named("attempts", attempts),
+	}
+	quoted := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		value, ok := lookupValue(event.Values, column)
+		if !ok {
+			return fmt.Errorf("dead-lettering %s: event has no value for primary key column %s", event.ULID, column)
+		}
+		quoted[i] = sqlutil.QuoteName(column)
+		params[i] = fmt.Sprintf("@pk%d", i)
+		args = append(args, sql.Named(fmt.Sprintf("pk%d", i), value))
+	}
+	table := feedObjectName(s.Schema, "deadletter", s.Table)
+	_, err = s.DB.ExecContext(ctx, fmt.Sprintf(`
+merge %[1]s with (holdlock) as d
+using (select @shard_id as shard_id, @ulid as ulid) as src
+on d.shard_id = src.shard_id and d.ulid = src.ulid
+when matched then
+    update set error = @error, attempts = @attempts, dead_lettered_time = sysutcdatetime()
+when not matched then
+    insert (shard_id, ulid, error, attempts, %[2]s)
+    values (@shard_id, @ulid, @error, @attempts, %[3]s);
+`, table, strings.Join(quoted, ", "), strings.Join(params, ", ")), args...)
+	if err != nil {
+		return fmt.Errorf("dead-lettering %s: %w", event.ULID, mapError(err))
+	}
+	return nil
+}
+
+// lookupValue finds a column in Event.Values; column names are case
+// insensitive, as they are in SQL Server with the usual collations
+func lookupValue(values map[string]interface{}, column string) (interface{}, bool) {
+	if value, ok := values[column]; ok {
+		return value, true
+	}
+	for name, value := range values {
+		if strings.EqualFold(name, column) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// ListDeadLetters returns the dead-lettered events of a feed, ordered by shard and ULID.
+func ListDeadLetters(ctx context.Context, db Querier, table string, opts ...Option) ([]DeadLetter, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`select * from %s order by shard_id, ulid`,
+		feedObjectName(newOptions(opts).schema, "deadletter", table)))
+	if err != nil {
+		return nil, fmt.Errorf("listing dead letters for %s: %w", table, mapError(err))
+	}
+	events, err := scanEvents(rows, "ulid")
+	if err != nil {
+		return nil, fmt.Errorf("listing dead letters for %s: %w", table, mapError(err))
+	}
+	result := make([]DeadLetter, len(events))
+	for i, e := range events {
+		d := DeadLetter{ULID: e.ULID, Values: e.Values}
+		shardID, _ := e.Values["shard_id"].(int64)
+		attempts, _ := e.Values["attempts"].(int64)
+		d.ShardID, d.Attempts = int(shardID), int(attempts)
+		d.Error, _ = e.Values["error"].(string)
+		d.Time, _ = e.Values["dead_lettered_time"].(time.Time)
+		for _, column := range deadLetterColumns {
+			delete(d.Values, column)
+		}
+		result[i] = d
+	}
+	return result, nil
+}
+
+// ulidList formats ULIDs for the @ulids parameter of deadLetterFilter; nil means all
+func ulidList(ulids []ulid.ULID) interface{} {
+	if len(ulids) == 0 {
+		return nil
+	}
+	hexes := make([]string, len(ulids))
+	for i, id := range ulids {
+		hexes[i] = hex.EncodeToString(id[:])
+	}
+	return strings.Join(hexes, ",")
+}
+
+const deadLetterFilter = `(@ulids is null or ulid in (select convert(binary(16), value, 2) from string_split(@ulids, ',')))`
+
+// RedriveDeadLetters publishes dead-lettered events of an outbox feed again,
+// by inserting their primary keys into [outbox:<table>], and removes them from
+// [deadletter:<table>]. The events get new ULIDs at the head of the feed.
+//
+// Redriving fans out: [deadletter:<table>] does not record which consumer gave
+// up on an event, so a redriven event is read again by every consumer of the
+// feed, including those that processed it successfully the first time, and
+// consumers must be able to handle an event more than once. If several
+// consumers dead-letter the same event, it is recorded once, with the error
+// of the last one.
+//
+// Pass no ULIDs to redrive every dead-lettered event. Returns the number of
+// events redriven, or ErrNotOutbox for a blocking feed.
+func RedriveDeadLetters(ctx context.Context, db *sql.DB, table string, ulids []ulid.ULID, opts ...Option) (int64, error) {
+	schema := newOptions(opts).schema
+	var count int64
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+set xact_abort on;
+declare @object_id int = object_id(@table_name, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+declare @unquoted nvarchar(max) = %[1]s.sql_unquoted_qualified_table_name(@object_id);
+declare @outbox nvarchar(max) = concat(quotename(@schema), '.', quotename(concat('outbox:', @unquoted)));
+if object_id(@outbox, 'U') is null throw 55001, 'Only events of outbox feeds can be redriven', 0;
+declare @deadletter nvarchar(max) = concat(quotename(@schema), '.', quotename(concat('deadletter:', @unquoted)));
+declare @columns nvarchar(max) = %[1]s.sql_primary_key_columns_joined_by_comma(@object_id, N'');
+declare @sql nvarchar(max) = concat('
+insert into ', @outbox, ' (shard_id, time_hint, ', @columns, ')
+select shard_id, sysutcdatetime(), ', @columns, '
+from ', @deadletter, '
+where %[2]s
+order by shard_id, ulid;
+delete from ', @deadletter, ' where %[2]s;
+set @count = @@rowcount;
+');
+declare @count bigint;
+begin transaction;
+exec sp_executesql @sql, N'@ulids nvarchar(max), @count bigint output', @ulids = @ulids, @count = @count output;
+commit;
+select @count;
+`, schemaName(schema), strings.ReplaceAll(deadLetterFilter, "'", "''")),
+		sql.Named("table_name", table),
+		sql.Named("schema", schema),
+		sql.Named("ulids", ulidList(ulids))).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("redriving dead letters for %s: %w", table, mapError(err))
+	}
+	return count, nil
+}
+
+// PurgeDeadLetters deletes dead-lettered events; pass no ULIDs to delete all
+// of them. Returns the number of events deleted.
+func PurgeDeadLetters(ctx context.Context, db Execer, table string, ulids []ulid.ULID, opts ...Option) (int64, error) {
+	result, err := db.ExecContext(ctx, fmt.Sprintf(`delete from %s where %s`,
+		feedObjectName(newOptions(opts).schema, "deadletter", table), deadLetterFilter),
+		sql.Named("ulids", ulidList(ulids)))
+	if err != nil {
+		return 0, fmt.Errorf("purging dead letters for %s: %w", table, mapError(err))
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,69 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestDeadLetter"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, table, Outbox))
+	require.NoError(t, GrantReader(ctx, fixture.AdminDB, table, "myreaduser"))
+
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+insert into [changefeed].[outbox:myservice.TestDeadLetter] (shard_id, time_hint, AggregateID, Version)
+values (0, '2023-05-31 12:00:00', 1, 1), (0, '2023-05-31 12:01:00', 1, 2), (0, '2023-05-31 12:02:00', 2, 1);`)
+	require.NoError(t, err)
+
+	reader := NewOutboxReader(fixture.ReadUserDB, table)
+	page, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(page))
+
+	// The consumer gives up on two of the events
+	store := NewDeadLetterStore(fixture.ReadUserDB, table)
+	require.NoError(t, store.DeadLetter(ctx, 0, page[1], errors.New("first"), 1))
+	require.NoError(t, store.DeadLetter(ctx, 0, page[1], errors.New("poison event"), 3))
+	require.NoError(t, store.DeadLetter(ctx, 0, page[2], errors.New("poison event"), 3))
+	assert.Error(t, store.DeadLetter(ctx, 0, Event{ULID: page[0].ULID, Values: map[string]interface{}{"AggregateID": 1}}, errors.New("x"), 1))
+
+	deadLetters, err := ListDeadLetters(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(deadLetters))
+	assert.Equal(t, page[1].ULID, deadLetters[0].ULID)
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(1), "Version": int64(2)}, deadLetters[0].Values)
+	assert.Equal(t, "poison event", deadLetters[0].Error)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Equal(t, 0, deadLetters[0].ShardID)
+	assert.False(t, deadLetters[0].Time.IsZero())
+
+	// Redriving publishes the event again at the head of the feed
+	n, err := RedriveDeadLetters(ctx, fixture.AdminDB, table, []ulid.ULID{page[1].ULID})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	redriven, err := reader.ReadPage(ctx, 0, page[2].ULID, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(redriven))
+	assert.Equal(t, int64(1), redriven[0].Values["AggregateID"])
+	assert.Equal(t, int64(2), redriven[0].Values["Version"])
+
+	deadLetters, err = ListDeadLetters(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, page[2].ULID, deadLetters[0].ULID)
+
+	n, err = PurgeDeadLetters(ctx, fixture.AdminDB, table, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	deadLetters, err = ListDeadLetters(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+}
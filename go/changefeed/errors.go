@@ -0,0 +1,134 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// Sentinel errors for the errors thrown by the SQL library, and for the SQL
+// Server errors that callers typically handle; test for them with errors.Is.
+// The original mssql.Error is still available through errors.As.
+var (
+	// ErrInTransaction is returned when a procedure that must run outside of
+	// any transaction, such as [read_feed:<table>], is called inside one
+	ErrInTransaction = errors.New("changefeed: must be called outside of a transaction")
+	// ErrNotInTransaction is returned when a procedure that must run inside a
+	// transaction, such as [lock:<table>], is called outside of one
+	ErrNotInTransaction = errors.New("changefeed: must be called inside a transaction")
+	// ErrLockFailed is returned when [read_feed:<table>] could not get the
+	// lock for moving events from the outbox to the feed
+	ErrLockFailed = errors.New("changefeed: could not get lock")
+	// ErrFeedNotFound is returned when the table, or the feed set up for it, does not exist
+	ErrFeedNotFound = errors.New("changefeed: feed not found")
+	// ErrInvalidMode is returned when a feed is not set up as exactly one of outbox or blocking
+	ErrInvalidMode = errors.New("changefeed: invalid mode")
+	// ErrNotOutbox is returned when an operation that needs an outbox feed,
+	// such as installing the outbox trigger, is done on a table without one
+	ErrNotOutbox = errors.New("changefeed: not an outbox feed")
+	// ErrDeadlock is SQL Server error 1205; the transaction was chosen as deadlock victim and rolled back
+	ErrDeadlock = errors.New("changefeed: deadlock")
+	// ErrLockTimeout is SQL Server error 1222; a lock was not granted within the session's lock_timeout
+	ErrLockTimeout = errors.New("changefeed: lock timeout")
+	// ErrShardBusy is returned by BlockingWriter.Lock when another transaction
+	// held the lock on the shard until the context deadline
+	ErrShardBusy = errors.New("changefeed: shard is busy")
+)
+
+// Error numbers thrown by the SQL library
+const (
+	errorNumberTransaction  = 77100
+	errorNumberNotFound     = 71000
+	errorNumberInvalidMode  = 55000
+	errorNumberNotOutbox    = 55001
+	errorNumberDeadlock     = 1205
+	errorNumberLockTimeout  = 1222
+	errorMessageLockFailure = "Error getting lock"
+)
+
+// sqlError is an mssql.Error, or an error wrapping one, matched to a sentinel error
+type sqlError struct {
+	sentinel error
+	err      error
+}
+
+func (e *sqlError) Error() string { return e.err.Error() }
+
+func (e *sqlError) Unwrap() []error { return []error{e.sentinel, e.err} }
+
+// sentinelFor returns the sentinel error for a single SQL Server error, or nil
+func sentinelFor(e mssql.Error) error {
+	switch e.Number {
+	case errorNumberTransaction:
+		switch {
+		case strings.Contains(e.Message, errorMessageLockFailure):
+			return ErrLockFailed
+		case strings.Contains(e.Message, "outside of any transaction"):
+			return ErrInTransaction
+		default:
+			return ErrNotInTransaction
+		}
+	case errorNumberNotFound:
+		return ErrFeedNotFound
+	case errorNumberInvalidMode:
+		return ErrInvalidMode
+	case errorNumberNotOutbox:
+		return ErrNotOutbox
+	case errorNumberDeadlock:
+		return ErrDeadlock
+	case errorNumberLockTimeout:
+		return ErrLockTimeout
+	}
+	return nil
+}
+
+// mapError makes errors.Is match err against the sentinel errors above. A
+// batch can raise several errors; the first one with a sentinel is used.
+func mapError(err error) error {
+	var sqlErr mssql.Error
+	if err == nil || !errors.As(err, &sqlErr) {
+		return err
+	}
+	all := sqlErr.All
+	if len(all) == 0 {
+		all = []mssql.Error{sqlErr}
+	}
+	for _, e := range all {
+		if sentinel := sentinelFor(e); sentinel != nil {
+			return &sqlError{sentinel: sentinel, err: err}
+		}
+	}
+	return err
+}
+
+const (
+	deadlockRetries = 3
+	deadlockBackoff = 50 * time.Millisecond
+)
+
+// retryDeadlocks runs f, retrying it with jittered backoff if it fails with
+// ErrDeadlock. SQL Server rolls back the whole transaction of the deadlock
+// victim, so this is only safe when f does not run in a transaction owned by
+// the caller; db is the handle f uses, and only a *sql.DB is retried, since
+// every call then gets its own connection and, for a single statement, its
+// own transaction. Errors are passed through mapError.
+func retryDeadlocks(ctx context.Context, db interface{}, f func() error) error {
+	_, retry := db.(*sql.DB)
+	for attempt := 0; ; attempt++ {
+		err := mapError(f())
+		if !retry || attempt == deadlockRetries || !errors.Is(err, ErrDeadlock) {
+			return err
+		}
+		backoff := time.Duration(rand.Int63n(int64(deadlockBackoff << attempt)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapError(t *testing.T) {
+	for _, tc := range []struct {
+		err      mssql.Error
+		expected error
+	}{
+		{mssql.Error{Number: 77100, Message: "Please call this procedure outside of any transaction"}, ErrInTransaction},
+		{mssql.Error{Number: 77100, Message: "Please call this procedure inside a transaction"}, ErrNotInTransaction},
+		{mssql.Error{Number: 77100, Message: "[changefeed].[lock:myservice.MyEvent]: please call inside a transaction"}, ErrNotInTransaction},
+		{mssql.Error{Number: 77100, Message: "Error getting lock"}, ErrLockFailed},
+		{mssql.Error{Number: 71000, Message: "Could not find @table_name"}, ErrFeedNotFound},
+		{mssql.Error{Number: 55000, Message: "please pass *either* @outbox=1 *or* @blocking=1"}, ErrInvalidMode},
+		{mssql.Error{Number: 55001, Message: "@table_name does not have an outbox feed"}, ErrNotOutbox},
+		{mssql.Error{Number: 1205, Message: "Transaction was deadlocked"}, ErrDeadlock},
+		{mssql.Error{Number: 1222, Message: "Lock request time out period exceeded."}, ErrLockTimeout},
+	} {
+		err := fmt.Errorf("reading: %w", mapError(tc.err))
+		assert.ErrorIs(t, err, tc.expected, tc.err.Message)
+		assert.Equal(t, "reading: "+tc.err.Error(), err.Error())
+		var sqlErr mssql.Error
+		require.ErrorAs(t, err, &sqlErr)
+		assert.Equal(t, tc.err.Number, sqlErr.Number)
+	}
+
+	// The error with a sentinel does not have to be the first one raised
+	err := mapError(mssql.Error{Number: 3621, All: []mssql.Error{{Number: 3621}, {Number: 1205}}})
+	assert.ErrorIs(t, err, ErrDeadlock)
+
+	other := mssql.Error{Number: 208, Message: "Invalid object name"}
+	assert.Equal(t, error(other), mapError(other))
+	assert.Nil(t, mapError(nil))
+}
+
+func TestRetryDeadlocks(t *testing.T) {
+	ctx := context.Background()
+	deadlock := mssql.Error{Number: 1205, Message: "Transaction was deadlocked"}
+	db, err := sql.Open("sqlserver", "sqlserver://localhost")
+	require.NoError(t, err)
+	defer db.Close()
+
+	calls := 0
+	err = retryDeadlocks(ctx, db, func() error {
+		calls++
+		if calls < 3 {
+			return deadlock
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retryDeadlocks(ctx, db, func() error {
+		calls++
+		return deadlock
+	})
+	assert.ErrorIs(t, err, ErrDeadlock)
+	assert.Equal(t, deadlockRetries+1, calls)
+
+	// Not safe to retry inside a transaction owned by the caller
+	var tx *sql.Tx
+	calls = 0
+	err = retryDeadlocks(ctx, tx, func() error {
+		calls++
+		return deadlock
+	})
+	assert.ErrorIs(t, err, ErrDeadlock)
+	assert.Equal(t, 1, calls)
+
+	// Other errors are not retried
+	calls = 0
+	err = retryDeadlocks(ctx, db, func() error {
+		calls++
+		return errors.New("other")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestErrors"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, table, Outbox))
+
+	err := SetupFeed(ctx, fixture.AdminDB, "myservice.DoesNotExist", Outbox)
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+	assert.ErrorIs(t, SetupFeed(ctx, fixture.AdminDB, table, "both"), ErrInvalidMode)
+
+	tx, err := fixture.AdminDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = NewOutboxReader(tx, table).ReadPage(ctx, 0, ulid.ULID{}, 10)
+	assert.ErrorIs(t, err, ErrInTransaction)
+	require.NoError(t, tx.Rollback())
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	assert.ErrorIs(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}), ErrFeedNotFound)
+}
@@ -0,0 +1,4 @@
+package changefeed
+
+// TestFixture gives tests in package changefeed_test access to the database set up by TestMain
+var TestFixture = &fixture
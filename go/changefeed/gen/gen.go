@@ -0,0 +1,909 @@
+// Package gen generates the SQL that setup_feed and upgrade_feed create for a
+// feed, without connecting to a database. It is a port of the sql_create_*
+// functions in migrations/2001.changefeed-v2.sql, so that the scripts for a
+// feed can be generated at build time and checked into an application
+// repository as plain .sql files.
+//
+// The output is the same as changefeed.RenderSetup gives for the same table,
+// as long as the Table passed describes the table exactly; see Column and
+// Table.ObjectID.
+package gen
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Column is a primary key column of the source table.
+type Column struct {
+	Name string
+	// Type is the type as declared, e.g. "bigint" or "varchar(10)"
+	Type string
+	// Collation is added as "collate <Collation>" if set. Inside SQL Server,
+	// character columns always get the collation of the source column, so set
+	// this for character columns to get identical output.
+	Collation string
+}
+
+// Table describes the source table of a feed.
+type Table struct {
+	Schema string
+	Name   string
+	// PrimaryKey lists the primary key columns. The order does not matter;
+	// like in SQL Server, the columns are always used in order of name.
+	PrimaryKey []Column
+	// ObjectID is the object_id of the table, which setup_feed embeds in the
+	// name of the application lock taken by [feed_write_lock:<table>]. If it is
+	// zero, the lock procedure looks up the object_id when it runs instead; the
+	// lock is the same, but changefeed.Verify reports the procedure as
+	// different from what the installed library generates.
+	ObjectID int
+}
+
+// Batch is one batch of a setup script.
+type Batch struct {
+	Description string
+	SQL         string
+}
+
+// Generator generates the scripts for feeds.
+type Generator struct {
+	// Schema is the changefeed schema; defaults to changefeed.DefaultSchema
+	Schema string
+}
+
+func (g Generator) schema() string {
+	if g.Schema == "" {
+		return changefeed.DefaultSchema
+	}
+	return g.Schema
+}
+
+// objectName returns the name of an object created for t, e.g. [changefeed].[state:myservice.MyEvent]
+func (g Generator) objectName(kind string, t Table) string {
+	return sqlutil.QuoteName(g.schema()) + "." + sqlutil.QuoteName(kind+":"+t.unquotedName())
+}
+
+// StateTable generates [state:<table>]; see sql_create_state_table.
+func (g Generator) StateTable(t Table) string {
+	table := g.objectName("state", t)
+	pk := sqlutil.QuoteName("pk:state:" + t.unquotedName())
+	return "create table " + table + `(
+    shard_id int not null,
+
+    time datetime2(3) not null,
+
+    -- See ULID-NOTES.md for description of ulid_high and ulid_low.
+    ulid_high binary(8) not null,
+    ulid_low bigint not null,
+
+    -- For convenience, the ulid is displayable directly. Also serves as documentation:
+    ulid as ulid_high + convert(binary(8), ulid_low),
+
+    constraint ` + pk + ` primary key (shard_id)
+);
+
+alter table ` + table + ` set (lock_escalation = disable);
+`
+}
+
+// FeedTable generates [feed:<table>]; see sql_create_feed_table.
+func (g Generator) FeedTable(t Table) string {
+	table := g.objectName("feed", t)
+	pk := sqlutil.QuoteName("pk:feed:" + t.unquotedName())
+	return "create table " + table + `(
+    shard_id int not null,
+    ulid binary(16) not null,
+` + t.columnDeclarations("    ") + `,
+    constraint ` + pk + ` primary key (shard_id, ulid)
+) with (data_compression = page)`
+}
+
+// OutboxTable generates [sequence:<table>] and [outbox:<table>]; see sql_create_outbox_table.
+func (g Generator) OutboxTable(t Table) string {
+	table := g.objectName("outbox", t)
+	sequence := g.objectName("sequence", t)
+	pk := sqlutil.QuoteName("pk:outbox:" + t.unquotedName())
+	seqConstraint := sqlutil.QuoteName("def:outbox.order_sequence:" + t.unquotedName())
+	shardConstraint := sqlutil.QuoteName("def:outbox.shard_id:" + t.unquotedName())
+	return `
+create sequence ` + sequence + ` as bigint start with 1 increment by 1 cache 100000;
+
+create table ` + table + `(
+    shard_id int not null constraint ` + shardConstraint + ` default 0,
+    order_sequence bigint constraint ` + seqConstraint + " default (next value for " + sequence + `),
+    time_hint datetime2(3) not null,
+` + t.columnDeclarations("    ") + `,
+    constraint ` + pk + ` primary key (shard_id, order_sequence)
+) with (data_compression = page);
+`
+}
+
+// ReadType generates [type:read:<table>]; see sql_create_read_type.
+func (g Generator) ReadType(t Table) string {
+	table := g.objectName("type:read", t)
+	return "create type " + table + ` as table (
+    ulid binary(16) not null,
+` + t.columnDeclarations("    ") + `
+)`
+}
+
+// outboxTypeName returns the name of [outbox_type:<table>], which has : instead
+// of . between schema and table; see sql_outbox_type_name.
+func (g Generator) outboxTypeName(t Table) string {
+	return sqlutil.QuoteName(g.schema()) + "." + sqlutil.QuoteName("outbox_type:"+strings.ReplaceAll(t.unquotedName(), ".", ":"))
+}
+
+// OutboxType generates the table type taken by [publish:<table>]; see sql_create_outbox_type.
+func (g Generator) OutboxType(t Table) string {
+	outboxType := g.outboxTypeName(t)
+	// Also created by upgrade_feed, since it did not exist in earlier versions
+	return "if type_id(N'" + quoteString(outboxType) + `') is null
+create type ` + outboxType + ` as table (
+    ordinal int not null primary key,
+    shard_id int not null,
+    time_hint datetime2(3) not null,
+` + t.columnDeclarations("    ") + `
+)`
+}
+
+// PublishProcedure generates [publish:<table>]; see sql_create_publish_procedure.
+func (g Generator) PublishProcedure(t Table) string {
+	pklist := t.columns("")
+	return "create or alter procedure " + g.objectName("publish", t) + `(
+    @rows ` + g.outboxTypeName(t) + ` readonly
+) as begin
+    set nocount on;
+
+    -- order_sequence is taken in the order of ordinal, so that the rows published in
+    -- one call are read from the feed in the order they were passed
+    insert into ` + g.objectName("outbox", t) + " (shard_id, order_sequence, time_hint, " + pklist + `)
+    select shard_id, next value for ` + g.objectName("sequence", t) + " over (order by ordinal), time_hint, " + pklist + `
+    from @rows;
+end
+`
+}
+
+// DeadLetterTable generates [deadletter:<table>]; see sql_create_deadletter_table.
+func (g Generator) DeadLetterTable(t Table) string {
+	table := g.objectName("deadletter", t)
+	pk := sqlutil.QuoteName("pk:deadletter:" + t.unquotedName())
+	timeConstraint := sqlutil.QuoteName("def:deadletter.dead_lettered_time:" + t.unquotedName())
+	// embedded in a string literal in the generated code, so quotes are escaped
+	tableLiteral := quoteString(table)
+	return "if object_id(N'" + tableLiteral + `', 'U') is null
+create table ` + table + `(
+    shard_id int not null,
+    ulid binary(16) not null,
+` + t.columnDeclarations("    ") + `,
+    error nvarchar(max) not null,
+    attempts int not null,
+    dead_lettered_time datetime2(3) not null constraint ` + timeConstraint + ` default sysutcdatetime(),
+    constraint ` + pk + ` primary key (shard_id, ulid)
+);
+`
+}
+
+// DeadLetterPermissions generates the grants on [deadletter:<table>] to the
+// readers role, if it exists; see sql_permissions_deadletter.
+func (g Generator) DeadLetterPermissions(t Table) string {
+	roleName := g.schema() + ".readers:" + t.unquotedName()
+	table := g.objectName("deadletter", t)
+	return "if database_principal_id(N'" + quoteString(roleName) + `') is not null
+    grant select, insert, update, delete on ` + table + " to " + sqlutil.QuoteName(roleName) + `;
+`
+}
+
+// OutboxTrigger generates the trigger of install_outbox_trigger; see
+// sql_create_outbox_trigger. It is not part of Batches, since setup_feed only
+// creates it when called with @with_trigger = 1.
+func (g Generator) OutboxTrigger(t Table, shardExpr, timeHintExpr string) string {
+	trigger := sqlutil.QuoteName(t.Schema) + "." + sqlutil.QuoteName(g.schema()+".outbox:"+t.unquotedName())
+	outboxTable := g.objectName("outbox", t)
+	columns := t.columns("")
+	return `
+-- Publishes every row inserted into the source table to the feed, so that
+-- publishers do not have to insert into ` + outboxTable + ` themselves.
+create or alter trigger ` + trigger + ` on ` + t.fullyQuotedName() + `
+after insert
+as begin
+    set nocount on;
+
+    insert into ` + outboxTable + ` (shard_id, time_hint, ` + columns + `)
+    select ` + shardExpr + `, ` + timeHintExpr + `, ` + columns + `
+    from inserted;
+end
+`
+}
+
+// FeedWriteLockProcedure generates [feed_write_lock:<table>]; see sql_create_feed_write_lock_procedure.
+func (g Generator) FeedWriteLockProcedure(t Table) string {
+	lockProc := g.objectName("feed_write_lock", t)
+	objectID := strconv.Itoa(t.ObjectID)
+	if t.ObjectID == 0 {
+		// ends the string literal around the object_id in the lock name
+		objectID = "', object_id(N'" + quoteString(t.fullyQuotedName()) + "'), '"
+	}
+	return `
+-- feed_write_lock:* takes a lock, owned by the Transaction, indicating that
+-- the feed will be written to. One should *also* do update_shard_state which
+-- takes its own lock implicitly, but read_feed:* needs to also have a pre-lock
+-- before updating the shard state (in order to know what timestamps are in the outbox)
+create or alter procedure ` + lockProc + `(
+    @shard_id int,
+    @lock_timeout int = -1,  -- passed straight to sp_getapplock
+    @lock_result int output
+) as begin
+    declare @lockname varchar(max) = concat('changefeed/` + objectID + `/', @shard_id)
+    exec @lock_result = sp_getapplock
+        @Resource = @lockname,
+        @LockMode = 'Exclusive',
+        @LockOwner = 'Transaction',
+        @LockTimeout = @lock_timeout;
+end;
+`
+}
+
+// UpdateStateProcedure generates [update_state:<table>]; see sql_create_update_state_procedure.
+func (g Generator) UpdateStateProcedure(t Table) string {
+	stateTable := g.objectName("state", t)
+	updateStateProc := g.objectName("update_state", t)
+	return `
+create or alter procedure ` + updateStateProc + `(
+    @shard_id int,
+    @time_hint datetime2(3),
+    @count bigint,
+
+    @previous_time datetime2(3) = null output,
+    @previous_ulid_high binary(8) = null output,
+    @previous_ulid_low bigint = null output,
+
+    @next_time datetime2(3) = null output,
+    @next_ulid_high binary(8) = null output,
+    @next_ulid_low bigint = null output
+)
+as begin
+    set xact_abort, nocount on;
+    begin try
+        if @@trancount = 0 throw 77100, 'Please call this procedure inside a transaction', 0;
+
+        declare @random_bytes binary(10) = crypt_gen_random(10);
+
+        update shard_state
+        set
+            @previous_time = shard_state.time,
+            @next_time = shard_state.time = let1.new_time,
+            @previous_ulid_high = shard_state.ulid_high,
+            @previous_ulid_low = shard_state.ulid_low,
+            @next_ulid_high = shard_state.ulid_high = let2.new_ulid_high,
+            @next_ulid_low = let2.ulid_low_range_start,
+            -- add @count to the value stored in ulid_low; the ulid_low stored is the *first* value to be used
+            -- by the next iteration
+            shard_state.ulid_low = let2.ulid_low_range_start + @count
+        from ` + stateTable + ` shard_state with (updlock, serializable, rowlock)
+        cross apply (select
+            new_time = iif(@time_hint > shard_state.time, @time_hint, shard_state.time)
+        ) let1
+        cross apply (select
+            new_ulid_high = (case
+                when @time_hint > shard_state.time then
+                    -- New timestamp, so generate new ulid_high (the timestamp + 2 random bytes).
+                    convert(binary(6), datediff_big(millisecond, '1970-01-01 00:00:00', new_time)) + substring(@random_bytes, 1, 2)
+                else
+                    shard_state.ulid_high
+                end)
+          , ulid_low_range_start = (case
+              when @time_hint > shard_state.time then
+                  -- Start ulid_low in new, random place.
+                  -- The mask 0xbfffffffffffffff will zero out second-highest bit, ensuring that overflows will not happen
+                  -- as the caller adds numbers to this
+                  convert(bigint, substring(@random_bytes, 3, 8)) & 0xbfffffffffffffff
+              else
+                  shard_state.ulid_low
+              end)
+        ) let2
+        where
+            shard_id = @shard_id;
+
+        if @@rowcount = 0
+        begin
+            -- First time we read from this shard; upsert behaviour.
+            --
+            -- Leave @previous_X to null since there wasn't anything previously
+            set @next_time = @time_hint;
+            set @next_ulid_high = convert(binary(6), datediff_big(millisecond, '1970-01-01 00:00:00', @time_hint)) + substring(@random_bytes, 1, 2);
+            set @next_ulid_low = convert(bigint, substring(@random_bytes, 3, 8)) & 0xbfffffffffffffff;;
+
+            insert into ` + stateTable + ` (shard_id, time, ulid_high, ulid_low)
+            values (@shard_id, @next_time, @next_ulid_high, @next_ulid_low + @count);
+        end
+
+    end try
+    begin catch
+        if @@trancount > 0 rollback;
+        throw;
+    end catch
+end
+`
+}
+
+// ReadProcedure generates [read_feed:<table>]; see sql_create_read_procedure.
+func (g Generator) ReadProcedure(t Table) string {
+	feedTable := g.objectName("feed", t)
+	outboxTable := g.objectName("outbox", t)
+	readFeedProc := g.objectName("read_feed", t)
+	feedWriteLockProc := g.objectName("feed_write_lock", t)
+	updateStateProc := g.objectName("update_state", t)
+	pklist := t.columns("")
+	return `
+create or alter procedure ` + readFeedProc + `(
+    @shard_id int,
+    @cursor binary(16),
+    @pagesize int = 1000
+)
+as begin
+    set xact_abort, nocount on;
+    begin try
+        if @@trancount > 0 throw 77100, 'Please call this procedure outside of any transaction', 0;
+
+        delete from #read;
+
+        -- Fast path if you are not on the head, do a 1st attempt without locks.
+        insert into #read(ulid, ` + pklist + `)
+        select top(@pagesize)
+            ulid,
+            ` + pklist + `
+        from ` + feedTable + `
+        where
+            shard_id = @shard_id
+            and ulid > @cursor
+        order by ulid;
+
+        if @@rowcount <> 0
+        begin
+            return;
+        end
+
+        -- Read to the current end of the feed; check the Outbox. If we read something
+        -- we put it into the log, so enter transaction and get a lock.
+        set transaction isolation level read committed;
+        begin transaction
+
+        -- Use an application lock to make sure only one session will
+        -- process the outbox at the time. However, the shard state itself
+        -- is really protected by the ` + "`" + "update" + "`" + ` statement in the update_state procedure, not
+        -- this lock. I.e. this lock *only* protects consumption of the outbox
+        -- and that those using read_feed sees a consistent picture.
+
+        declare @lock_result int;
+        exec ` + feedWriteLockProc + `
+            @shard_id = @shard_id,
+            @lock_timeout = -1,
+            @lock_result = @lock_result output;
+
+        if @lock_result < 0
+        begin
+            throw 77100, 'Error getting lock', 1;
+        end;
+
+        -- At this point it does not matter if we got the lock without waiting or not, in BOTH
+        -- cases it could be the case that new data is now available in the feed at some point
+        -- after our initila ` + "`" + "select" + "`" + ` above. So, we need to re-do the select while holding the
+        -- lock to ensure we really are at the head.
+
+        insert into #read(ulid, ` + pklist + `)
+        select top(@pagesize)
+            ulid,
+            ` + pklist + `
+        from ` + feedTable + `
+        where
+            shard_id = @shard_id
+            and ulid > @cursor
+        order by ulid;
+
+        if @@rowcount > 0
+        begin
+            -- OK we raced another process that processed the outbox, so return the page that process processed
+            rollback
+            return
+        end;
+
+        declare @takenFromOutbox as table (
+            order_sequence bigint not null primary key,
+            time_hint datetime2(3) not null,
+` + t.columnDeclarations("            ") + `
+
+            -- benchmarks with 1000 rows indicate that things are not faster with primary key
+            -- for some queries; but this can be re-visited more properly in the future
+        );
+
+        with totake as (
+            select top(@pagesize) * from ` + outboxTable + ` as outbox
+            where outbox.shard_id = @shard_id
+            order by outbox.order_sequence
+        )
+        delete top(@pagesize) from totake
+        output
+            deleted.order_sequence, deleted.time_hint, ` + t.columns("deleted.") + `
+        into @takenFromOutbox;
+
+        if @@rowcount = 0
+        begin
+            -- Nothing in Outbox either, simply return.
+            rollback
+            return
+        end;
+
+        -- order_sequence is what we use for main event ordering; this is a mechanism to ensure that
+        -- ordering can be deterministic in cases where it matters for the application (e.g., between events in
+        -- the same aggregate/for the same entity). See the experts guide for details.
+        --
+        -- So, we do not want to require the application to also keep track of time_hint, we want to
+        -- support that having a different order, and we simply fix it up here.
+        with patched_time as (
+            select
+                order_sequence,
+                time_hint = max(time_hint) over (order by order_sequence rows between unbounded preceding and current row)
+            from @takenFromOutbox
+        )
+        update t
+        set time_hint = patched_time.time_hint
+        from @takenFromOutbox as t
+        join patched_time on patched_time.order_sequence = t.order_sequence;
+
+        declare @max_time datetime2(3);
+        declare @count bigint;
+        declare @random_bytes binary(10) = crypt_gen_random(10);
+        select @max_time = max(time_hint), @count = count(*) from @takenFromOutbox;
+
+        -- To assign ULIDs to the events in @takenFromOutbox, we split into two cases:
+        -- 1) The ones where time is <= shard_state.time. For this, adjust up to the shard_state.time
+        --
+        -- 2) The ones where time is > shard_state.time.
+        --    For these, for efficency and simplicity, we use the *same* random component,
+        --    even if the time component varies within this set.
+        --
+        -- In the case that @max_time <= shard_state.time, we will only have the first case hitting;
+        -- in this case we set all values equal to the same.
+        declare @previous_time datetime2(3);
+        declare @previous_ulid_high binary(8);
+        declare @previous_ulid_low bigint;
+
+        declare @next_time datetime2(3);
+        declare @next_ulid_high binary(8);
+        declare @next_ulid_low bigint;
+
+        exec ` + updateStateProc + `
+            @shard_id = @shard_id,
+            @time_hint = @max_time,
+            @count = @count,
+            @previous_time = @previous_time output,
+            @previous_ulid_high = @previous_ulid_high output,
+            @previous_ulid_low = @previous_ulid_low output,
+            @next_ulid_high = @next_ulid_high output,
+            @next_ulid_low = @next_ulid_low output;
+
+        insert into ` + feedTable + "(shard_id, ulid, " + pklist + `)
+        output inserted.ulid, ` + t.columns("inserted.") + " into #read(ulid, " + pklist + `)
+        select
+            @shard_id,
+            let.ulid_high + convert(binary(8), let.ulid_low - 1 + row_number() over (order by taken.order_sequence)),
+            ` + t.columns("taken.") + `
+        from @takenFromOutbox as taken
+        cross apply (select
+            ulid_high = iif(
+                -- embed max(time_hint, @previous_time) in ulid_high
+                @previous_time is null or taken.time_hint > @previous_time,
+
+                -- We do not use @next_ulid_high; because that will be based on max(time_hint).
+                -- Instead we wish to use the actual time_hint; those are safe to use since:
+                -- a) We patch them above to be in the order of order_sequence.
+                -- b) We only do this if they are larger than @previous_time; otherwise we use the previous
+                --    counter values..
+                convert(binary(6), datediff_big(millisecond, '1970-01-01 00:00:00', taken.time_hint)),
+                @previous_ulid_high),
+            ulid_low = iif(
+                -- use ulid_low matching the cases above
+                @previous_time is null or taken.time_hint > @previous_time,
+                @next_ulid_low,
+                @previous_ulid_low)
+        ) let;
+
+        commit
+
+    end try
+    begin catch
+        if @@trancount > 0 rollback;
+        throw;
+    end catch
+
+end
+`
+}
+
+// ReadResultSetProcedure generates [read_feed_rs:<table>]; see sql_create_read_result_set_procedure.
+func (g Generator) ReadResultSetProcedure(t Table) string {
+	readFeedProc := g.objectName("read_feed", t)
+	readFeedRSProc := g.objectName("read_feed_rs", t)
+	return `
+-- read_feed_rs:* returns the page read by read_feed:* as a result set, so that the caller
+-- does not have to create #read in the same session first.
+create or alter procedure ` + readFeedRSProc + `(
+    @shard_id int,
+    @cursor binary(16),
+    @pagesize int = 1000
+)
+as begin
+    set nocount on;
+
+    create table #read (
+        ulid binary(16) not null,
+` + t.columnDeclarations("        ") + `
+    );
+
+    exec ` + readFeedProc + ` @shard_id = @shard_id, @cursor = @cursor, @pagesize = @pagesize;
+
+    select * from #read order by ulid;
+end
+`
+}
+
+// LockProcedure generates [lock:<table>]; see sql_create_lock_procedure.
+func (g Generator) LockProcedure(t Table) string {
+	lockProc := g.objectName("lock", t)
+	updateStateProc := g.objectName("update_state", t)
+	// these are embedded in string literals in the generated code, so quotes are escaped
+	sessionVarTransaction := quoteString("changefeed.transaction_id/" + t.unquotedName())
+	sessionVarHigh := quoteString("changefeed.ulid_high/" + t.unquotedName())
+	sessionVarLow := quoteString("changefeed.ulid_low/" + t.unquotedName())
+	lockProcLiteral := quoteString(lockProc)
+	return "create or alter procedure " + lockProc + `(
+    @shard_id int = 0,
+    @time_hint datetime2(3) = null,
+    @session_context bit = 1,
+    @ulid_high binary(8) = null output,
+    @ulid_low bigint = null output,
+    @ulid binary(16) = null output,
+    @lock_timeout_ms int = null
+) as begin
+    set xact_abort, nocount on;
+    begin try
+        if @@trancount = 0 throw 77100, '` + lockProcLiteral + `: please call inside a transaction', 0;
+
+        -- Fail with error 1222 instead of waiting for a writer that does not finish its
+        -- transaction; lock_timeout is restored when the procedure returns.
+        if @lock_timeout_ms is not null set lock_timeout @lock_timeout_ms;
+
+        if @time_hint is null set @time_hint = sysutcdatetime();
+
+        exec ` + updateStateProc + `
+            @shard_id = @shard_id,
+            @time_hint = @time_hint,
+            @count = 100000000000,  -- 10^11
+            @next_ulid_high = @ulid_high output,
+            @next_ulid_low = @ulid_low output;
+
+        declare @transaction_id bigint = current_transaction_id();
+
+        if @session_context = 1
+        begin
+            -- These are backwards-compatability for those using the ulid() convenience function available in some
+            -- earlier versions of mssql-changefeed. This might be removed at some point, but keeping it when
+            -- upgrading feeds now to get a smooth upgrade.
+            exec sp_set_session_context N'changefeed.transaction_id', @transaction_id;
+            exec sp_set_session_context N'changefeed.ulid_high', @ulid_high;
+            exec sp_set_session_context N'changefeed.ulid_low', @ulid_low;
+
+            -- For use of [ulid:tablename]()
+            exec sp_set_session_context N'` + sessionVarTransaction + `', @transaction_id;
+            exec sp_set_session_context N'` + sessionVarHigh + `', @ulid_high;
+            exec sp_set_session_context N'` + sessionVarLow + `', @ulid_low;
+        end
+
+        set @ulid = @ulid_high + convert(binary(8), @ulid_low)
+    end try
+    begin catch
+        if @@trancount > 0 rollback;
+        throw;
+    end catch
+end
+
+`
+}
+
+// UlidFunction generates [ulid:<table>]; see sql_create_ulid_function.
+func (g Generator) UlidFunction(t Table) string {
+	ulidFunc := g.objectName("ulid", t)
+	sessionVarTransaction := quoteString("changefeed.transaction_id/" + t.unquotedName())
+	sessionVarHigh := quoteString("changefeed.ulid_high/" + t.unquotedName())
+	sessionVarLow := quoteString("changefeed.ulid_low/" + t.unquotedName())
+	return "create or alter function " + ulidFunc + `(@i bigint) returns binary(16)
+as begin
+    return (case
+        -- protect against calling ulid(); it cannot raise error but make sure we return null
+        when isnull(try_convert(bigint, session_context(N'` + sessionVarTransaction + `')), 0) = current_transaction_id()
+            then convert(binary(8), session_context(N'` + sessionVarHigh + `')) +
+             convert(binary(8), convert(bigint, session_context(N'` + sessionVarLow + `')) + @i)
+        else convert(binary(16), convert(int, 'error: changefeed.ulid must be called in a transaction, and after having called changefeed.lock:*'))
+    end)
+end
+`
+}
+
+// ShardFunction generates [shard:<table>]; see sql_create_shard_function.
+func (g Generator) ShardFunction(t Table) string {
+	return g.shardFunction(t, false)
+}
+
+// ShardModuloFunction generates [shard_modulo:<table>]; see sql_create_shard_modulo_function.
+func (g Generator) ShardModuloFunction(t Table) string {
+	return g.shardFunction(t, true)
+}
+
+// shardFunction is a port of sql_shard_function
+func (g Generator) shardFunction(t Table, modulo bool) string {
+	kind, sharder := "shard", "JumpSharder"
+	if modulo {
+		kind, sharder = "shard_modulo", "ModuloSharder"
+	}
+	if !t.shardKeySupported() {
+		return "-- the primary key has a type changefeed.KeyHash does not support\ndrop function if exists " + g.objectName(kind, t) + ";\n"
+	}
+	var params, keys []string
+	for i, c := range t.sortedPrimaryKey() {
+		param := "@pk" + strconv.Itoa(i+1)
+		params = append(params, param+" "+c.Type)
+		style := ""
+		if strings.Contains(strings.ToLower(c.Type), "binary") {
+			style = ", 2"
+		}
+		keys = append(keys, "convert(nvarchar(max), "+param+style+")")
+	}
+	hash := sqlutil.QuoteName(g.schema()) + ".key_hash(" + strings.Join(keys, " + N'|' + ") + ")"
+	result := hash + " % @n"
+	if !modulo {
+		result = sqlutil.QuoteName(g.schema()) + ".jump_consistent_hash(" + hash + ", @n)"
+	}
+	return "create or alter function " + g.objectName(kind, t) + "(" + strings.Join(params, ", ") + `, @n int)
+returns int
+as begin
+    -- the primary key is ` + t.columns("") + "; see changefeed." + sharder + `
+    return ` + result + `;
+end
+`
+}
+
+// SignReadProcedure generates the batch that signs [read_feed:<table>] with a
+// new certificate, dropping the previous one; see sql_sign_read_procedure.
+func (g Generator) SignReadProcedure(t Table) string {
+	certName := g.schema() + ".cert.readers:" + t.unquotedName()
+	userName := g.schema() + ".user.readers:" + t.unquotedName()
+	cert := sqlutil.QuoteName(certName)
+	user := sqlutil.QuoteName(userName)
+	stateTable := g.objectName("state", t)
+	readFeedProc := g.objectName("read_feed", t)
+	// these are embedded in string literals in the generated code, so quotes are escaped
+	certNameLiteral := quoteString(certName)
+	userNameLiteral := quoteString(userName)
+	certLiteral := quoteString(cert)
+	userLiteral := quoteString(user)
+	stateTableLiteral := quoteString(stateTable)
+	readFeedProcLiteral := quoteString(readFeedProc)
+	return `
+-- Use a certificate to essentially grant the read_feed: procedure write permissions, as itself, to the state table.
+-- This disallows changing the state table directly but allows using read_feed to change it.
+--
+-- Altering read_feed drops the signature, and the private key of the certificate is removed after signing,
+-- so the certificate is re-created, with a new random password, every time read_feed is created.
+declare @read_feed_proc_id int = object_id(N'` + readFeedProcLiteral + `');
+declare @previous_thumbprint varbinary(32) = (select thumbprint from sys.certificates where name = N'` + certNameLiteral + `');
+if exists (select 1 from sys.crypt_properties where major_id = @read_feed_proc_id and thumbprint = @previous_thumbprint)
+    drop signature from ` + readFeedProc + " by certificate " + cert + `;
+if database_principal_id(N'` + userNameLiteral + "') is not null drop user " + user + `;
+if @previous_thumbprint is not null drop certificate ` + cert + `;
+
+declare @password nvarchar(max) = concat(convert(nvarchar(max), crypt_gen_random(32), 2), N'cf%a');
+declare @sql nvarchar(max) = concat(N'
+create certificate ` + certLiteral + ` encryption by password = ', quotename(@password, ''''), N' with subject = ''"changefeed"'';
+add signature to ` + readFeedProcLiteral + " by certificate " + certLiteral + ` with password = ', quotename(@password, ''''), N';
+create user ` + userLiteral + " from certificate " + certLiteral + `;
+grant select, insert, update on ` + stateTableLiteral + " to " + userLiteral + `;
+alter certificate ` + certLiteral + ` remove private key; -- password no longer usable after this
+');
+exec sp_executesql @sql;
+`
+}
+
+// OutboxReaderPermissions generates the role allowed to execute
+// [read_feed:<table>]; see sql_permissions_outbox_reader.
+func (g Generator) OutboxReaderPermissions(t Table) string {
+	role := sqlutil.QuoteName(g.schema() + ".readers:" + t.unquotedName())
+	readFeedProc := g.objectName("read_feed", t)
+	return `
+-- Create a role that can execute read_feed
+
+create role ` + role + `;
+grant execute on ` + readFeedProc + " to " + role + `;
+`
+}
+
+// WriterPermissions generates the role for writers; see sql_permissions_writer.
+func (g Generator) WriterPermissions(t Table, mode changefeed.Mode) string {
+	role := sqlutil.QuoteName(g.schema() + ".writers:" + t.unquotedName())
+	if mode == changefeed.Outbox {
+		outboxTable := g.objectName("outbox", t)
+		return `
+create role ` + role + `;
+grant insert on ` + outboxTable + " to " + role + `;
+`
+	}
+	stateTable := g.objectName("state", t)
+	lockProc := g.objectName("lock", t)
+	return `
+create role ` + role + `;
+grant select, insert, update on ` + stateTable + " to " + role + `;
+grant execute on ` + lockProc + " to " + role + `;
+`
+}
+
+// Batches returns the batches setup_feed executes for t, or those
+// upgrade_feed executes if upgrade is set; see sql_setup_feed_batches.
+func (g Generator) Batches(t Table, mode changefeed.Mode, upgrade bool) ([]Batch, error) {
+	if mode != changefeed.Outbox && mode != changefeed.Blocking {
+		return nil, fmt.Errorf("invalid mode %q; expected %q or %q", mode, changefeed.Outbox, changefeed.Blocking)
+	}
+	if t.Schema == "" || t.Name == "" {
+		return nil, fmt.Errorf("table schema and name are required")
+	}
+	if len(t.PrimaryKey) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key", t.fullyQuotedName())
+	}
+	outbox := mode == changefeed.Outbox
+
+	var batches []Batch
+	add := func(description, sql string) {
+		batches = append(batches, Batch{Description: description, SQL: sql})
+	}
+	if !upgrade {
+		add("create [state:<tablename>]", g.StateTable(t))
+		if outbox {
+			add("create [feed:<tablename>]", g.FeedTable(t))
+			add("create [outbox:<tablename>]", g.OutboxTable(t))
+			add("create [type:read:<tablename>]", g.ReadType(t))
+		}
+	}
+	add("create [deadletter:<tablename>]", g.DeadLetterTable(t))
+	add("create [feed_write_lock:<tablename>]", g.FeedWriteLockProcedure(t))
+	add("create [update_state:<tablename>]", g.UpdateStateProcedure(t))
+	if outbox {
+		// altering read_feed drops its signature, so it is always signed again
+		add("create [read_feed:<tablename>]", g.ReadProcedure(t))
+		add("sign [read_feed:<tablename>]", g.SignReadProcedure(t))
+		add("create [read_feed_rs:<tablename>]", g.ReadResultSetProcedure(t))
+		add("create [outbox_type:<tablename>]", g.OutboxType(t))
+		add("create [publish:<tablename>]", g.PublishProcedure(t))
+	} else {
+		add("create [lock:<tablename>]", g.LockProcedure(t))
+		add("create [ulid:<tablename>]", g.UlidFunction(t))
+		add("grant execute on [ulid:<tablename>]", "grant execute on "+g.objectName("ulid", t)+" to public;")
+	}
+	// Publishers and consumers both need to agree on the shard of an event, so the shard
+	// functions are available to everyone, like [ulid:<tablename>]
+	add("create [shard:<tablename>]", g.ShardFunction(t))
+	add("create [shard_modulo:<tablename>]", g.ShardModuloFunction(t))
+	if t.shardKeySupported() {
+		add("grant execute on [shard:<tablename>]", "grant execute on "+g.objectName("shard", t)+" to public;\n"+
+			"grant execute on "+g.objectName("shard_modulo", t)+" to public;")
+	}
+	if !upgrade {
+		if outbox {
+			add("permissions for [changefeed.readers:<tablename>]", g.OutboxReaderPermissions(t))
+		}
+		add("permissions for [changefeed.writers:<tablename>]", g.WriterPermissions(t, mode))
+	}
+	if outbox {
+		// also when upgrading, since read_feed_rs did not exist in earlier versions
+		add("grant execute on [read_feed_rs:<tablename>]", "grant execute on "+g.objectName("read_feed_rs", t)+
+			" to "+sqlutil.QuoteName(g.schema()+".readers:"+t.unquotedName())+";")
+		// also when upgrading, since publish did not exist in earlier versions
+		writers := sqlutil.QuoteName(g.schema() + ".writers:" + t.unquotedName())
+		add("grant execute on [publish:<tablename>]", "grant execute on "+g.objectName("publish", t)+" to "+writers+";\n"+
+			"grant execute on type::"+g.outboxTypeName(t)+" to "+writers+";")
+	}
+	add("permissions on [deadletter:<tablename>]", g.DeadLetterPermissions(t))
+	add("register in [changefeed].feeds", fmt.Sprintf("exec %s.register_feed N'%s', @outbox = %d, @blocking = %d;",
+		sqlutil.QuoteName(g.schema()), quoteString(t.fullyQuotedName()), bit(outbox), bit(!outbox)))
+	return batches, nil
+}
+
+// Script returns the batches setup_feed executes for t, separated by "go",
+// in the same format as changefeed.RenderSetup.
+func (g Generator) Script(t Table, mode changefeed.Mode) (string, error) {
+	batches, err := g.Batches(t, mode, false)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, batch := range batches {
+		fmt.Fprintf(&b, "-- %s\n%s\ngo\n", batch.Description, strings.TrimSpace(batch.SQL))
+	}
+	return b.String(), nil
+}
+
+func (t Table) unquotedName() string {
+	return t.Schema + "." + t.Name
+}
+
+func (t Table) fullyQuotedName() string {
+	return sqlutil.QuoteName(t.Schema) + "." + sqlutil.QuoteName(t.Name)
+}
+
+// sortedPrimaryKey returns the primary key columns ordered by name, like
+// sql_primary_key_columns_joined_by_comma does with a case insensitive collation
+func (t Table) sortedPrimaryKey() []Column {
+	columns := append([]Column(nil), t.PrimaryKey...)
+	sort.SliceStable(columns, func(i, j int) bool {
+		return strings.ToLower(columns[i].Name) < strings.ToLower(columns[j].Name)
+	})
+	return columns
+}
+
+// shardKeyTypes are the types changefeed.KeyHash supports; see sql_shard_key_supported
+var shardKeyTypes = map[string]bool{
+	"tinyint": true, "smallint": true, "int": true, "bigint": true, "bit": true,
+	"char": true, "varchar": true, "nchar": true, "nvarchar": true,
+	"binary": true, "varbinary": true, "uniqueidentifier": true,
+}
+
+// shardKeySupported is a port of sql_shard_key_supported; Column.Type has to
+// be a system type for it to give the same result
+func (t Table) shardKeySupported() bool {
+	for _, c := range t.PrimaryKey {
+		name := strings.ToLower(strings.TrimSpace(c.Type))
+		if i := strings.IndexByte(name, '('); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		if !shardKeyTypes[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// columns returns the primary key columns joined by comma, each prefixed by prefix
+func (t Table) columns(prefix string) string {
+	var names []string
+	for _, c := range t.sortedPrimaryKey() {
+		names = append(names, prefix+sqlutil.QuoteName(c.Name))
+	}
+	return strings.Join(names, ", ")
+}
+
+// columnDeclarations returns the declarations of the primary key columns, one per line
+func (t Table) columnDeclarations(prefix string) string {
+	var declarations []string
+	for _, c := range t.sortedPrimaryKey() {
+		d := prefix + sqlutil.QuoteName(c.Name) + " " + c.Type
+		if c.Collation != "" {
+			d += " collate " + c.Collation
+		}
+		declarations = append(declarations, d+" not null")
+	}
+	return strings.Join(declarations, ",\n")
+}
+
+func quoteString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
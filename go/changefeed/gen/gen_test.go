@@ -0,0 +1,187 @@
+package gen
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/changefeedtest"
+)
+
+var (
+	myEvent = Table{
+		Schema: "myservice",
+		Name:   "MyEvent",
+		PrimaryKey: []Column{
+			{Name: "AggregateID", Type: "bigint"},
+			{Name: "Version", Type: "int"},
+		},
+	}
+	otherEvent = Table{
+		Schema: "my'service",
+		Name:   "Other]Event",
+		PrimaryKey: []Column{
+			{Name: "version", Type: "int"},
+			{Name: "Tenant", Type: "varchar(10)", Collation: "Latin1_General_100_CI_AS"},
+			{Name: "Amount", Type: "decimal(10,2)"},
+		},
+	}
+	blockingEvent = Table{
+		Schema:     "myservice",
+		Name:       "BlockingEvent",
+		PrimaryKey: []Column{{Name: "ULID", Type: "binary(16)"}},
+	}
+)
+
+func TestColumns(t *testing.T) {
+	assert.Equal(t, "x.[Amount], x.[Tenant], x.[version]", otherEvent.columns("x."))
+	assert.Equal(t, "  [Amount] decimal(10,2) not null,\n  [Tenant] varchar(10) collate Latin1_General_100_CI_AS not null,\n  [version] int not null",
+		otherEvent.columnDeclarations("  "))
+}
+
+func TestScript(t *testing.T) {
+	script, err := Generator{}.Script(myEvent, changefeed.Outbox)
+	require.NoError(t, err)
+	assert.Contains(t, script, "create table [changefeed].[outbox:myservice.MyEvent](")
+	assert.Contains(t, script, "    [AggregateID] bigint not null,\n    [Version] int not null,\n    constraint [pk:feed:myservice.MyEvent]")
+	assert.Contains(t, script, "concat('changefeed/', object_id(N'[myservice].[MyEvent]'), '/', @shard_id)")
+	assert.Contains(t, script, "exec [changefeed].register_feed N'[myservice].[MyEvent]', @outbox = 1, @blocking = 0;")
+	assert.NotContains(t, script, "[lock:myservice.MyEvent]")
+	assert.Contains(t, script, "if type_id(N'[changefeed].[outbox_type:myservice:MyEvent]') is null\ncreate type [changefeed].[outbox_type:myservice:MyEvent] as table (")
+	assert.Contains(t, script, "    select shard_id, next value for [changefeed].[sequence:myservice.MyEvent] over (order by ordinal), time_hint, [AggregateID], [Version]\n")
+	assert.Contains(t, script, "grant execute on type::[changefeed].[outbox_type:myservice:MyEvent] to [changefeed.writers:myservice.MyEvent];")
+
+	withID := myEvent
+	withID.ObjectID = 1234
+	script, err = Generator{Schema: "cf"}.Script(withID, changefeed.Blocking)
+	require.NoError(t, err)
+	assert.Contains(t, script, "concat('changefeed/1234/', @shard_id)")
+	assert.Contains(t, script, "create or alter procedure [cf].[lock:myservice.MyEvent](")
+	assert.Contains(t, script, "grant execute on [cf].[ulid:myservice.MyEvent] to public;")
+	assert.NotContains(t, script, "[changefeed].[")
+	assert.NotContains(t, script, "[outbox:myservice.MyEvent]")
+
+	script, err = Generator{}.Script(otherEvent, changefeed.Blocking)
+	require.NoError(t, err)
+	assert.Contains(t, script, "throw 77100, '[changefeed].[lock:my''service.Other]]Event]: please call inside a transaction', 0;")
+	assert.Contains(t, script, "exec sp_set_session_context N'changefeed.ulid_high/my''service.Other]Event', @ulid_high;")
+
+	_, err = Generator{}.Script(Table{Schema: "myservice", Name: "NoKey"}, changefeed.Outbox)
+	assert.Error(t, err)
+	_, err = Generator{}.Script(myEvent, changefeed.Mode("both"))
+	assert.Error(t, err)
+}
+
+func TestBatchesUpgrade(t *testing.T) {
+	batches, err := Generator{}.Batches(myEvent, changefeed.Outbox, true)
+	require.NoError(t, err)
+	var descriptions []string
+	for _, b := range batches {
+		descriptions = append(descriptions, b.Description)
+	}
+	assert.Equal(t, []string{
+		"create [deadletter:<tablename>]",
+		"create [feed_write_lock:<tablename>]",
+		"create [update_state:<tablename>]",
+		"create [read_feed:<tablename>]",
+		"sign [read_feed:<tablename>]",
+		"create [read_feed_rs:<tablename>]",
+		"create [outbox_type:<tablename>]",
+		"create [publish:<tablename>]",
+		"create [shard:<tablename>]",
+		"create [shard_modulo:<tablename>]",
+		"grant execute on [shard:<tablename>]",
+		"grant execute on [read_feed_rs:<tablename>]",
+		"grant execute on [publish:<tablename>]",
+		"permissions on [deadletter:<tablename>]",
+		"register in [changefeed].feeds",
+	}, descriptions)
+}
+
+func TestOutboxTrigger(t *testing.T) {
+	trigger := Generator{Schema: "cf"}.OutboxTrigger(myEvent, "AggregateID % 4", "sysutcdatetime()")
+	assert.Contains(t, trigger, "create or alter trigger [myservice].[cf.outbox:myservice.MyEvent] on [myservice].[MyEvent]\nafter insert\n")
+	assert.Contains(t, trigger, `    insert into [cf].[outbox:myservice.MyEvent] (shard_id, time_hint, [AggregateID], [Version])
+    select AggregateID % 4, sysutcdatetime(), [AggregateID], [Version]
+    from inserted;`)
+}
+
+func TestShardFunction(t *testing.T) {
+	assert.Equal(t, `create or alter function [changefeed].[shard:myservice.MyEvent](@pk1 bigint, @pk2 int, @n int)
+returns int
+as begin
+    -- the primary key is [AggregateID], [Version]; see changefeed.JumpSharder
+    return [changefeed].jump_consistent_hash([changefeed].key_hash(convert(nvarchar(max), @pk1) + N'|' + convert(nvarchar(max), @pk2)), @n);
+end
+`, Generator{}.ShardFunction(myEvent))
+	assert.Contains(t, Generator{}.ShardModuloFunction(blockingEvent),
+		"    return [changefeed].key_hash(convert(nvarchar(max), @pk1, 2)) % @n;\n")
+
+	// KeyHash does not support decimal, so the functions are dropped instead of generated
+	assert.Equal(t, `-- the primary key has a type changefeed.KeyHash does not support
+drop function if exists [changefeed].[shard_modulo:my'service.Other]]Event];
+`, Generator{}.ShardModuloFunction(otherEvent))
+	script, err := Generator{}.Script(otherEvent, changefeed.Outbox)
+	require.NoError(t, err)
+	assert.NotContains(t, script, "grant execute on [changefeed].[shard:")
+}
+
+// TestSameAsSQL checks that the output is identical to what the
+// sql_create_* functions generate inside SQL Server, and that it works.
+func TestSameAsSQL(t *testing.T) {
+	dsn := os.Getenv("SQLSERVER_DSN")
+	if dsn == "" {
+		t.Skip("SQLSERVER_DSN not set")
+	}
+	ctx := context.Background()
+	db := changefeedtest.NewDatabase(t, dsn, "../../../migrations/2001.changefeed-v2.sql", "testdata/tables.sql")
+
+	for _, tc := range []struct {
+		table Table
+		mode  changefeed.Mode
+	}{
+		{myEvent, changefeed.Outbox},
+		{otherEvent, changefeed.Outbox},
+		{otherEvent, changefeed.Blocking},
+		{blockingEvent, changefeed.Blocking},
+	} {
+		t.Run(tc.table.Name+"/"+string(tc.mode), func(t *testing.T) {
+			name := tc.table.fullyQuotedName()
+			table := tc.table
+			require.NoError(t, db.AdminDB.QueryRowContext(ctx, `select object_id(@p1, 'U')`, name).Scan(&table.ObjectID))
+
+			expected, err := changefeed.RenderSetup(ctx, db.AdminDB, name, tc.mode)
+			require.NoError(t, err)
+			script, err := Generator{}.Script(table, tc.mode)
+			require.NoError(t, err)
+			assert.Equal(t, expected, script)
+		})
+	}
+
+	for _, table := range []Table{myEvent, otherEvent} {
+		var expected string
+		require.NoError(t, db.AdminDB.QueryRowContext(ctx, `select [changefeed].sql_create_outbox_trigger(object_id(@p1, 'U'), N'changefeed', N'[Version] % 4', N'sysutcdatetime()')`,
+			table.fullyQuotedName()).Scan(&expected))
+		assert.Equal(t, expected, Generator{}.OutboxTrigger(table, "[Version] % 4", "sysutcdatetime()"))
+	}
+
+	// The generated script sets up a working feed
+	table := myEvent
+	require.NoError(t, db.AdminDB.QueryRowContext(ctx, `select object_id('myservice.MyEvent', 'U')`).Scan(&table.ObjectID))
+	script, err := Generator{}.Script(table, changefeed.Outbox)
+	require.NoError(t, err)
+	for _, batch := range changefeedtest.SplitBatches(script) {
+		if strings.TrimSpace(batch) == "" {
+			continue
+		}
+		_, err := db.AdminDB.ExecContext(ctx, batch)
+		require.NoError(t, err, batch)
+	}
+	diffs, err := changefeed.Verify(ctx, db.AdminDB, "myservice.MyEvent")
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
@@ -0,0 +1,25 @@
+create schema myservice;
+
+go
+
+create schema [my'service];
+
+go
+
+create table myservice.MyEvent (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table [my'service].[Other]]Event] (
+    version int not null,
+    Tenant varchar(10) collate Latin1_General_100_CI_AS not null,
+    Amount decimal(10, 2) not null,
+    primary key (Tenant, version, Amount)
+);
+
+create table myservice.BlockingEvent (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
@@ -3,88 +3,306 @@ package changefeed
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
 )
 
-func TestCreateStateTable(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_state_table(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+// generatorTestCase is a source table shape that the sql_create_* generators
+// should handle; each case is set up in both outbox and blocking mode.
+type generatorTestCase struct {
+	description string
+	schema      string
+	table       string
+	// columns declares the primary key columns
+	columns    string
+	primaryKey []string
+	// key returns the primary key values of the i-th event
+	key func(i int) map[string]interface{}
 }
 
-func TestCreateFeedTable(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_feed_table(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+var generatorTestCases = []generatorTestCase{
+	{
+		description: "int",
+		schema:      "gentest",
+		table:       "IntPK",
+		columns:     "ID int not null",
+		primaryKey:  []string{"ID"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"ID": i}
+		},
+	},
+	{
+		description: "composite bigint and int",
+		schema:      "gentest",
+		table:       "Composite",
+		columns:     "AggregateID bigint not null, Version int not null",
+		primaryKey:  []string{"AggregateID", "Version"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"AggregateID": 1000 + i%2, "Version": i}
+		},
+	},
+	{
+		description: "uniqueidentifier",
+		schema:      "gentest",
+		table:       "Guid",
+		columns:     "ID uniqueidentifier not null",
+		primaryKey:  []string{"ID"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"ID": guid(fmt.Sprintf("0000000a-0000-0000-0000-%012d", i))}
+		},
+	},
+	{
+		description: "varchar",
+		schema:      "gentest",
+		table:       "Varchar",
+		columns:     "Code varchar(20) not null",
+		primaryKey:  []string{"Code"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"Code": fmt.Sprintf("code-%d", i)}
+		},
+	},
+	{
+		description: "nvarchar with collation",
+		schema:      "gentest",
+		table:       "Collated",
+		columns:     "Name nvarchar(50) collate Latin1_General_100_CS_AS not null",
+		primaryKey:  []string{"Name"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"Name": fmt.Sprintf("Ñame-%d", i)}
+		},
+	},
+	{
+		description: "composite int, uniqueidentifier and varchar",
+		schema:      "gentest",
+		table:       "MultiPK",
+		columns:     "x int not null, y uniqueidentifier not null, z varchar(10) not null",
+		primaryKey:  []string{"x", "y", "z"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"x": i, "y": guid("a0000000-0000-0000-0000-000000000001"), "z": "hello"}
+		},
+	},
+	{
+		description: "char and smallint",
+		schema:      "gentest",
+		table:       "Tenant",
+		columns:     "Tenant char(3) not null, Seq smallint not null",
+		primaryKey:  []string{"Tenant", "Seq"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"Tenant": "abc", "Seq": i}
+		},
+	},
+	{
+		description: "dots in schema and table name",
+		schema:      "gentest.v2",
+		table:       "Dotted.Table",
+		columns:     "ID int not null",
+		primaryKey:  []string{"ID"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"ID": i}
+		},
+	},
+	{
+		description: "keywords, spaces and brackets in names",
+		schema:      "gentest",
+		table:       "Odd Names",
+		columns:     "[order] int not null, [key column] varchar(10) not null, [x]]y] int not null",
+		primaryKey:  []string{"order", "key column", "x]y"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"order": i, "key column": "k", "x]y": -i}
+		},
+	},
+	{
+		description: "quotes in names",
+		schema:      "gentest",
+		table:       "O'Brien",
+		columns:     "[it's] int not null",
+		primaryKey:  []string{"it's"},
+		key: func(i int) map[string]interface{} {
+			return map[string]interface{}{"it's": i}
+		},
+	},
 }
 
-func TestCreateOutboxTable(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_outbox_table(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+// tableName returns the unquoted and quoted name of the table for the given mode
+func (tc generatorTestCase) tableName(mode string) (unquoted, quoted string) {
+	table := tc.table + "_" + mode
+	return tc.schema + "." + table, sqlutil.QuoteName(tc.schema) + "." + sqlutil.QuoteName(table)
 }
 
-func TestCreateReadType(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_read_type(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+func (tc generatorTestCase) createTable(t *testing.T, ctx context.Context, quoted string, extraColumns string) {
+	var schemaExists bool
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, `select iif(schema_id(@p1) is null, 0, 1)`, tc.schema).Scan(&schemaExists))
+	if !schemaExists {
+		_, err := fixture.AdminDB.ExecContext(ctx, fmt.Sprintf(`create schema %s`, sqlutil.QuoteName(tc.schema)))
+		require.NoError(t, err)
+	}
+	var pk []string
+	for _, column := range tc.primaryKey {
+		pk = append(pk, sqlutil.QuoteName(column))
+	}
+	_, err := fixture.AdminDB.ExecContext(ctx, fmt.Sprintf(`create table %s (%s, %s primary key (%s))`,
+		quoted, tc.columns, extraColumns, strings.Join(pk, ", ")))
+	require.NoError(t, err)
 }
 
-// This testcase is run manually to inspect the generated read: stored procedure
-func TestCreateReadProcedure(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_read_procedure(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+// requireObjects checks that setup_feed generated the given objects
+func requireObjects(t *testing.T, ctx context.Context, unquoted string, kinds ...string) {
+	for _, kind := range kinds {
+		var exists bool
+		qry := `select iif(object_id(@p1) is null, 0, 1)`
+		if strings.HasPrefix(kind, "type:") {
+			qry = `select iif(type_id(@p1) is null, 0, 1)`
+		}
+		require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, qry, feedObjectName("", kind, unquoted)).Scan(&exists))
+		assert.True(t, exists, "%s not generated", feedObjectName("", kind, unquoted))
+	}
 }
 
-func TestCreateFeedWriteLockProcedure(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_feed_write_lock_procedure(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+// guid parses a uniqueidentifier key value
+func guid(s string) mssql.UniqueIdentifier {
+	var u mssql.UniqueIdentifier
+	if err := u.Scan(s); err != nil {
+		panic(err)
+	}
+	return u
 }
 
-func TestCreateUpdateStateProcedure(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_update_state_procedure(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	//_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	//require.NoError(t, err)
+// normalizeValues makes values read back comparable to the keys published;
+// readers return uniqueidentifier columns as uppercase strings
+func normalizeValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		switch v := v.(type) {
+		case int:
+			result[k] = int64(v)
+		case []byte:
+			result[k] = string(v)
+		case mssql.UniqueIdentifier:
+			result[k] = v.String()
+		default:
+			result[k] = v
+		}
+	}
+	return result
 }
 
-func TestCreateLockProcedure(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_create_lock_procedure(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
-	// Simply check that generated SQL compiles
-	_, err := fixture.AdminDB.ExecContext(context.Background(), sql)
-	require.NoError(t, err)
+func TestGeneratedOutbox(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range generatorTestCases {
+		t.Run(tc.description, func(t *testing.T) {
+			unquoted, quoted := tc.tableName("outbox")
+			tc.createTable(t, ctx, quoted, "")
+
+			_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed @p1, @outbox = 1`, quoted)
+			require.NoError(t, err)
+			requireObjects(t, ctx, unquoted, "state", "feed", "outbox", "type:read", "read_feed", "update_state", "feed_write_lock")
+
+			_, err = fixture.AdminDB.ExecContext(ctx, fmt.Sprintf(`
+alter role %s add member myuser;
+alter role %s add member myreaduser;
+`, sqlutil.QuoteName("changefeed.writers:"+unquoted), sqlutil.QuoteName("changefeed.readers:"+unquoted)))
+			require.NoError(t, err)
+
+			const count = 5
+			var rows []OutboxRow
+			for i := 0; i != count; i++ {
+				rows = append(rows, OutboxRow{
+					TimeHint: time.Date(2023, 5, 31, 12, 0, i, 0, time.UTC),
+					Key:      tc.key(i),
+				})
+			}
+			tx, err := fixture.UserDB.BeginTx(ctx, nil)
+			require.NoError(t, err)
+			require.NoError(t, NewOutboxWriter(unquoted).Publish(ctx, tx, rows...))
+			require.NoError(t, tx.Commit())
+
+			// Read in two pages, so that both the outbox and the feed table is read from
+			reader := NewOutboxReader(fixture.ReadUserDB, unquoted)
+			page1, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 3)
+			require.NoError(t, err)
+			require.Equal(t, 3, len(page1))
+			page2, err := reader.ReadPage(ctx, 0, page1[2].ULID, 100)
+			require.NoError(t, err)
+			require.Equal(t, 2, len(page2))
+
+			all, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 100)
+			require.NoError(t, err)
+			require.Equal(t, append(page1, page2...), all)
+			for i, e := range all {
+				assert.Equal(t, normalizeValues(rows[i].Key), normalizeValues(e.Values))
+			}
+		})
+	}
 }
 
-func TestRoleOutboxReader(t *testing.T) {
-	var sql string
-	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].sql_permissions_outbox_reader(object_id('myservice.MultiPK'), 'changefeed')`).Scan(&sql))
-	fmt.Println(sql)
+func TestGeneratedBlocking(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range generatorTestCases {
+		t.Run(tc.description, func(t *testing.T) {
+			unquoted, quoted := tc.tableName("blocking")
+			tc.createTable(t, ctx, quoted, "Shard int not null, ULID binary(16) not null,")
+
+			_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed @p1, @blocking = 1`, quoted)
+			require.NoError(t, err)
+			requireObjects(t, ctx, unquoted, "state", "lock", "ulid", "update_state", "feed_write_lock")
+
+			_, err = fixture.AdminDB.ExecContext(ctx, fmt.Sprintf(`
+alter role %s add member myuser;
+grant select, insert on %s to myuser;
+grant select on %s to myreaduser;
+`, sqlutil.QuoteName("changefeed.writers:"+unquoted), quoted, quoted))
+			require.NoError(t, err)
+
+			const count = 5
+			var keys []map[string]interface{}
+			tx, err := fixture.UserDB.BeginTx(ctx, nil)
+			require.NoError(t, err)
+			defer func() { _ = tx.Rollback() }()
+			ulids, err := NewBlockingWriter(unquoted).Lock(ctx, tx, 0, time.Time{})
+			require.NoError(t, err)
+
+			var fromSQL []byte
+			require.NoError(t, tx.QueryRowContext(ctx, fmt.Sprintf(`select %s(0)`, feedObjectName("", "ulid", unquoted))).Scan(&fromSQL))
+			u0 := ulids.ULID(0)
+			assert.Equal(t, u0[:], fromSQL)
+
+			for i := 0; i != count; i++ {
+				key := tc.key(i)
+				keys = append(keys, key)
+				columns := []string{"Shard", "ULID"}
+				u := ulids.ULID(int64(i))
+				args := []interface{}{0, u[:]}
+				for column, value := range key {
+					columns = append(columns, sqlutil.QuoteName(column))
+					args = append(args, value)
+				}
+				params := make([]string, len(args))
+				for j := range args {
+					params[j] = fmt.Sprintf("@p%d", j+1)
+				}
+				_, err := tx.ExecContext(ctx, fmt.Sprintf(`insert into %s (%s) values (%s)`,
+					quoted, strings.Join(columns, ", "), strings.Join(params, ", ")), args...)
+				require.NoError(t, err)
+			}
+			require.NoError(t, tx.Commit())
+
+			page, err := NewBlockingReader(fixture.ReadUserDB, quoted, "ULID", "Shard").ReadPage(ctx, 0, ulid.ULID{}, 100)
+			require.NoError(t, err)
+			require.Equal(t, count, len(page))
+			for i, e := range page {
+				assert.Equal(t, ulids.ULID(int64(i)), e.ULID)
+				delete(e.Values, "Shard")
+				assert.Equal(t, normalizeValues(keys[i]), normalizeValues(e.Values))
+			}
+		})
+	}
 }
 
 func TestSetupFeedOutbox(t *testing.T) {
@@ -96,7 +314,7 @@ func TestSetupFeedOutbox(t *testing.T) {
 	var value string
 	err = fixture.AdminDB.QueryRowContext(context.Background(), `
 declare @y uniqueidentifier = newid();
-    
+
 insert into myservice.MultiPK (x, y, z, v)
 values (1, @y, 'hello', 'world');
 
@@ -107,7 +325,7 @@ declare @tmp as [changefeed].[type:read:myservice.MultiPK];
 select * into #read from @tmp;
 
 exec [changefeed].[read_feed:myservice.MultiPK] 0, 0x0, 100;
-    
+
 select v from myservice.MultiPK as t
 join #read as r on r.x = t.x and r.y = t.y and r.z = t.z;
 `).Scan(&value)
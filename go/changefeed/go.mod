@@ -4,7 +4,6 @@ go 1.24.3
 
 require (
 	github.com/alecthomas/repr v0.4.0
-	github.com/gofrs/uuid v4.4.0+incompatible
 	github.com/microsoft/go-mssqldb v1.8.0
 	github.com/oklog/ulid v1.3.1
 	github.com/stretchr/testify v1.10.0
@@ -0,0 +1,153 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Access is what a member of one of the roles set up for a feed may do.
+type Access string
+
+const (
+	// Publish is given by the [changefeed.writers:<table>] role
+	Publish Access = "publish"
+	// Consume is given by the [changefeed.readers:<table>] role, which
+	// only exists for outbox feeds
+	Consume Access = "consume"
+)
+
+// Member is a database principal that is a member of a role set up for a feed.
+type Member struct {
+	Principal string
+	Access    Access
+}
+
+// GrantWriter adds principal to [changefeed.writers:<table>], allowing it to
+// insert into the outbox of an outbox feed, or call [lock:<table>] of a
+// blocking feed.
+func GrantWriter(ctx context.Context, db Execer, table, principal string, opts ...Option) error {
+	return addRoleMember(ctx, db, table, principal, ".writers:", opts)
+}
+
+// GrantReader adds principal to [changefeed.readers:<table>], allowing it to
+// call [read_feed:<table>]. Only outbox feeds have a readers role; readers of
+// blocking feeds select from the source table directly.
+func GrantReader(ctx context.Context, db Execer, table, principal string, opts ...Option) error {
+	return addRoleMember(ctx, db, table, principal, ".readers:", opts)
+}
+
+func addRoleMember(ctx context.Context, db Execer, table, principal, kind string, opts []Option) error {
+	schema := newOptions(opts).schema
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@table_name, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+declare @role sysname = concat(@schema, @kind, %s.sql_unquoted_qualified_table_name(@object_id));
+if database_principal_id(@role) is null throw 71000, 'Could not find the role for @table_name; has setup_feed been called for it?', 0;
+declare @sql nvarchar(max) = concat('alter role ', quotename(@role), ' add member ', quotename(@principal));
+exec sp_executesql @sql;
+`, schemaName(schema)),
+		sql.Named("table_name", table),
+		sql.Named("schema", schema),
+		sql.Named("kind", kind),
+		sql.Named("principal", principal))
+	if err != nil {
+		return fmt.Errorf("granting %s on %s to %s: %w", kind[1:len(kind)-1], table, principal, mapError(err))
+	}
+	return nil
+}
+
+// Revoke removes principal from both the readers and writers roles of the feed.
+func Revoke(ctx context.Context, db Execer, table, principal string, opts ...Option) error {
+	schema := newOptions(opts).schema
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@table_name, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+declare @unquoted nvarchar(max) = %s.sql_unquoted_qualified_table_name(@object_id);
+declare @sql nvarchar(max) = (
+    select string_agg(concat('alter role ', quotename(r.name), ' drop member ', quotename(m.name), ';'), char(10))
+    from sys.database_role_members as rm
+    join sys.database_principals as r on r.principal_id = rm.role_principal_id
+    join sys.database_principals as m on m.principal_id = rm.member_principal_id
+    where r.name in (concat(@schema, '.readers:', @unquoted), concat(@schema, '.writers:', @unquoted))
+        and m.name = @principal);
+if @sql is not null exec sp_executesql @sql;
+`, schemaName(schema)),
+		sql.Named("table_name", table),
+		sql.Named("schema", schema),
+		sql.Named("principal", principal))
+	if err != nil {
+		return fmt.Errorf("revoking access to %s from %s: %w", table, principal, mapError(err))
+	}
+	return nil
+}
+
+// ListMembers returns the members of the readers and writers roles of the
+// feed, ordered by principal.
+func ListMembers(ctx context.Context, db Querier, table string, opts ...Option) ([]Member, error) {
+	schema := newOptions(opts).schema
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@table_name, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+declare @unquoted nvarchar(max) = %s.sql_unquoted_qualified_table_name(@object_id);
+select m.name, iif(r.name = concat(@schema, '.writers:', @unquoted), 'publish', 'consume')
+from sys.database_role_members as rm
+join sys.database_principals as r on r.principal_id = rm.role_principal_id
+join sys.database_principals as m on m.principal_id = rm.member_principal_id
+where r.name in (concat(@schema, '.readers:', @unquoted), concat(@schema, '.writers:', @unquoted))
+order by m.name, r.name desc;
+`, schemaName(schema)),
+		sql.Named("table_name", table),
+		sql.Named("schema", schema))
+	if err != nil {
+		return nil, fmt.Errorf("listing members for %s: %w", table, mapError(err))
+	}
+	defer rows.Close()
+	var result []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Principal, &m.Access); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// ReadFeedSigned reports whether [read_feed:<table>] of an outbox feed still
+// carries a valid signature by the certificate created by setup_feed. The
+// signature is what allows members of the readers role to update
+// [state:<table>] through read_feed; it is lost if the procedure is altered.
+func ReadFeedSigned(ctx context.Context, db Querier, table string, opts ...Option) (bool, error) {
+	schema := newOptions(opts).schema
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+declare @object_id int = object_id(@table_name, 'U');
+if @object_id is null throw 71000, 'Could not find @table_name', 0;
+declare @unquoted nvarchar(max) = %s.sql_unquoted_qualified_table_name(@object_id);
+declare @proc int = object_id(concat(quotename(@schema), '.', quotename(concat('read_feed:', @unquoted))));
+if @proc is null throw 71000, 'Could not find read_feed for @table_name; is it an outbox feed?', 0;
+select iif(exists(
+    select 1
+    from sys.certificates as c
+    cross apply sys.fn_check_object_signatures('certificate', c.thumbprint) as s
+    where c.name = concat(@schema, '.cert.readers:', @unquoted)
+        and s.entity_id = @proc and s.is_signed = 1 and s.is_signature_valid = 1
+), 1, 0);
+`, schemaName(schema)),
+		sql.Named("table_name", table),
+		sql.Named("schema", schema))
+	if err != nil {
+		return false, fmt.Errorf("checking signature of read_feed for %s: %w", table, mapError(err))
+	}
+	defer rows.Close()
+	var signed bool
+	for rows.Next() {
+		if err := rows.Scan(&signed); err != nil {
+			return false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("checking signature of read_feed for %s: %w", table, mapError(err))
+	}
+	return signed, nil
+}
@@ -0,0 +1,107 @@
+package changefeed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrants(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestGrants"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, table, Outbox))
+
+	members, err := ListMembers(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Empty(t, members)
+
+	// Not granted yet
+	_, err = NewOutboxReader(fixture.ReadUserDB, table).ReadPage(ctx, 0, ulid.ULID{}, 10)
+	assert.Error(t, err)
+
+	require.NoError(t, GrantWriter(ctx, fixture.AdminDB, table, "myuser"))
+	require.NoError(t, GrantReader(ctx, fixture.AdminDB, table, "myreaduser"))
+	require.NoError(t, GrantReader(ctx, fixture.AdminDB, table, "myuser"))
+	members, err = ListMembers(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Equal(t, []Member{
+		{Principal: "myreaduser", Access: Consume},
+		{Principal: "myuser", Access: Publish},
+		{Principal: "myuser", Access: Consume},
+	}, members)
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = tx.ExecContext(ctx, `insert into [changefeed].[outbox:myservice.TestGrants] (time_hint, AggregateID, Version) values (sysutcdatetime(), 1, 1)`)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	signed, err := ReadFeedSigned(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.True(t, signed)
+	page, err := NewOutboxReader(fixture.ReadUserDB, table).ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(page))
+
+	require.NoError(t, Revoke(ctx, fixture.AdminDB, table, "myuser"))
+	// Revoking a principal that is not a member is not an error
+	require.NoError(t, Revoke(ctx, fixture.AdminDB, table, "myuser"))
+	members, err = ListMembers(ctx, fixture.AdminDB, table)
+	require.NoError(t, err)
+	assert.Equal(t, []Member{{Principal: "myreaduser", Access: Consume}}, members)
+
+	assert.Error(t, GrantReader(ctx, fixture.AdminDB, "myservice.DoesNotExist", "myuser"))
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+	assert.Error(t, GrantWriter(ctx, fixture.AdminDB, table, "myuser"))
+	_, err = ReadFeedSigned(ctx, fixture.AdminDB, table)
+	assert.Error(t, err)
+}
+
+func TestUpgradeFeedKeepsSignature(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestUpgradeSignature"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, table, Outbox))
+	require.NoError(t, GrantReader(ctx, fixture.AdminDB, table, "myreaduser"))
+	reader := NewOutboxReader(fixture.ReadUserDB, table)
+
+	publish := func(version int) {
+		_, err := fixture.AdminDB.ExecContext(ctx, `insert into [changefeed].[outbox:myservice.TestUpgradeSignature] (time_hint, AggregateID, Version) values (sysutcdatetime(), 1, @p1)`, version)
+		require.NoError(t, err)
+	}
+
+	publish(1)
+	page, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	cursor := page[0].ULID
+
+	var thumbprint []byte
+	queryThumbprint := `select thumbprint from sys.certificates where name = 'changefeed.cert.readers:myservice.TestUpgradeSignature'`
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, queryThumbprint).Scan(&thumbprint))
+
+	// Upgrade twice; the second time the signature from the first upgrade has to be dropped
+	for i := 0; i < 2; i++ {
+		require.NoError(t, UpgradeFeed(ctx, fixture.AdminDB, table, Outbox))
+		signed, err := ReadFeedSigned(ctx, fixture.AdminDB, table)
+		require.NoError(t, err)
+		assert.True(t, signed)
+
+		var newThumbprint []byte
+		require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, queryThumbprint).Scan(&newThumbprint))
+		assert.NotEqual(t, thumbprint, newThumbprint)
+		thumbprint = newThumbprint
+
+		// Reading from the outbox requires read_feed to update [state:*] as itself
+		publish(2 + i)
+		page, err = reader.ReadPage(ctx, 0, cursor, 10)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(page))
+		assert.Equal(t, int64(2+i), page[0].Values["Version"])
+		cursor = page[0].ULID
+	}
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+}
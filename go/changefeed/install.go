@@ -0,0 +1,82 @@
+package changefeed
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Migration is a copy of migrations/2001.changefeed-v2.sql in the root of
+// the repository; `go generate` keeps it up to date.
+//
+//go:generate cp ../../migrations/2001.changefeed-v2.sql migrations/2001.changefeed-v2.sql
+//go:embed migrations/2001.changefeed-v2.sql
+var Migration string
+
+// Migration always says [changefeed], so that it can be search/replaced
+const migrationSchema = "[changefeed]"
+
+// LibraryVersion is the value returned by [changefeed].library_version() in
+// Migration. UpgradeAll upgrades feeds generated by an older version.
+var LibraryVersion = parseLibraryVersion(Migration)
+
+func parseLibraryVersion(migration string) int {
+	m := regexp.MustCompile(`(?s)library_version\(\)\s+returns int\s+as begin\s+return (\d+);`).FindStringSubmatch(migration)
+	if m == nil {
+		panic("library_version() not found in embedded migration")
+	}
+	version, err := strconv.Atoi(m[1])
+	if err != nil {
+		panic(err)
+	}
+	return version
+}
+
+// RenderMigration returns Migration rewritten to install into the schema
+// given by WithSchema.
+func RenderMigration(opts ...Option) (string, error) {
+	o := newOptions(opts)
+	// The quoted schema name ends up in string literals in the migration, and
+	// setup_feed strips the brackets by position; so keep it simple.
+	if o.schema == "" || strings.ContainsAny(o.schema, "[]'") {
+		return "", fmt.Errorf("invalid changefeed schema name: %q", o.schema)
+	}
+	return strings.ReplaceAll(Migration, migrationSchema, sqlutil.QuoteName(o.schema)), nil
+}
+
+// Install runs the migration in db, creating the changefeed schema if it does
+// not already exist. All other objects are created with "create or alter",
+// so Install can also be used to upgrade the library; use upgrade_feed to
+// upgrade the procedures generated for each feed.
+func Install(ctx context.Context, db Execer, opts ...Option) error {
+	migration, err := RenderMigration(opts...)
+	if err != nil {
+		return err
+	}
+	schema := newOptions(opts).schema
+
+	lineno := 1
+	for _, batch := range sqlutil.SplitBatches(migration) {
+		qry, args := batch, []interface{}(nil)
+		if strings.HasPrefix(strings.TrimSpace(batch), "create schema ") {
+			qry = `if schema_id(@p1) is null exec ('create schema ' + @p2);`
+			args = []interface{}{schema, sqlutil.QuoteName(schema)}
+		}
+		if _, err := db.ExecContext(ctx, qry, args...); err != nil {
+			var sqlErr mssql.Error
+			if errors.As(err, &sqlErr) {
+				return fmt.Errorf("installing changefeed, line %d: %w", lineno+int(sqlErr.LineNo)-1, err)
+			}
+			return fmt.Errorf("installing changefeed: %w", err)
+		}
+		lineno += strings.Count(batch, "\n") + 2
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package changefeed
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationUpToDate(t *testing.T) {
+	migration, err := os.ReadFile("../../migrations/2001.changefeed-v2.sql")
+	require.NoError(t, err)
+	assert.Equal(t, string(migration), Migration, "run go generate to update the embedded migration")
+}
+
+func TestRenderMigration(t *testing.T) {
+	rendered, err := RenderMigration(WithSchema("events_cf"))
+	require.NoError(t, err)
+	assert.NotContains(t, rendered, "[changefeed]")
+	assert.True(t, strings.HasPrefix(rendered, "create schema [events_cf];"))
+	assert.Contains(t, rendered, "@quoted_changefeed_schema nvarchar(max) = '[events_cf]'")
+
+	_, err = RenderMigration(WithSchema("evil]"))
+	assert.Error(t, err)
+}
+
+func TestInstall(t *testing.T) {
+	ctx := context.Background()
+	// A second copy of the library, next to the [changefeed] one installed by the fixture;
+	// installing twice should be fine
+	require.NoError(t, Install(ctx, fixture.AdminDB, WithSchema("events_cf")))
+	require.NoError(t, Install(ctx, fixture.AdminDB, WithSchema("events_cf")))
+
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [events_cf].setup_feed 'myservice.TestInstall', @outbox = 1;
+alter role [events_cf.writers:myservice.TestInstall] add member myuser;
+alter role [events_cf.readers:myservice.TestInstall] add member myreaduser;
+`)
+	require.NoError(t, err)
+
+	var inDefault bool
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx,
+		`select iif(object_id('[changefeed].[read_feed:myservice.TestInstall]') is null, 0, 1)`).Scan(&inDefault))
+	assert.False(t, inDefault)
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, NewOutboxWriter("myservice.TestInstall", WithSchema("events_cf")).Publish(ctx, tx,
+		OutboxRow{Key: map[string]interface{}{"AggregateID": 1, "Version": 1}}))
+	require.NoError(t, tx.Commit())
+
+	page, err := NewOutboxReader(fixture.ReadUserDB, "myservice.TestInstall", WithSchema("events_cf")).ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, int64(1), page[0].Values["AggregateID"])
+
+	// the default schema does not know about this feed
+	_, err = NewOutboxReader(fixture.ReadUserDB, "myservice.TestInstall").ReadPage(ctx, 0, ulid.ULID{}, 10)
+	assert.Error(t, err)
+}
+
+func TestLibraryVersion(t *testing.T) {
+	assert.Greater(t, LibraryVersion, 0)
+	var installed int
+	require.NoError(t, fixture.AdminDB.QueryRow(`select [changefeed].library_version()`).Scan(&installed))
+	assert.Equal(t, LibraryVersion, installed)
+}
@@ -0,0 +1,31 @@
+// Package sqlutil has the helpers for building T-SQL that are shared by the
+// changefeed packages.
+package sqlutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// QuoteName quotes an identifier like quotename() does.
+func QuoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// QuoteString returns s as a string literal.
+func QuoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// SplitBatches splits a migration script on the "go" batch separator.
+func SplitBatches(script string) []string {
+	return strings.Split(strings.ReplaceAll(script, "\r\n", "\n"), "\ngo\n")
+}
+
+// RandomHex returns n random bytes in hex, e.g. for the names of scratch schemas.
+func RandomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
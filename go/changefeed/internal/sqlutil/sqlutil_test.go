@@ -0,0 +1,21 @@
+package sqlutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, "[my]]table]", QuoteName("my]table"))
+	assert.Equal(t, "'it''s'", QuoteString("it's"))
+}
+
+func TestSplitBatches(t *testing.T) {
+	assert.Equal(t, []string{"select 1;", "select 2;\n"}, SplitBatches("select 1;\r\ngo\r\nselect 2;\r\n"))
+}
+
+func TestRandomHex(t *testing.T) {
+	assert.Len(t, RandomHex(8), 16)
+	assert.NotEqual(t, RandomHex(8), RandomHex(8))
+}
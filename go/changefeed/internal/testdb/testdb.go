@@ -0,0 +1,270 @@
+// Package testdb creates temporary databases for tests. It is exported to
+// users of the library by changefeedtest, and used directly by the tests of
+// package changefeed, which changefeedtest depends on.
+package testdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/microsoft/go-mssqldb/msdsn"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Database is a temporary, contained database created by NewDatabase.
+type Database struct {
+	Name string
+	// AdminDB is connected as the user of the DSN passed to NewDatabase
+	AdminDB *sql.DB
+	// WriterDB and ReaderDB are connected as the users WriterUser and ReaderUser
+	WriterDB *sql.DB
+	ReaderDB *sql.DB
+
+	WriterUser string
+	ReaderUser string
+
+	dsn       msdsn.Config
+	passwords map[string]string
+	serverDB  *sql.DB
+	opened    []*sql.DB
+}
+
+// DatabaseOptions configures NewDatabase; the zero value gives the defaults.
+type DatabaseOptions struct {
+	// By default both allow_snapshot_isolation and read_committed_snapshot are
+	// turned on, since that is the "worst case" for the locking done by changefeed.
+	DisableSnapshotIsolation     bool
+	DisableReadCommittedSnapshot bool
+
+	// WriterUser and ReaderUser are the names of the users of WriterDB and
+	// ReaderDB; they default to "writer" and "reader".
+	WriterUser, ReaderUser string
+
+	// ExtraUsers are created in addition to WriterUser and ReaderUser, and can be
+	// connected to using Database.Open.
+	ExtraUsers []string
+
+	// RoleMembers are added after the migrations have run, so that roles created by setup_feed can be used.
+	RoleMembers []RoleMember
+
+	// Timeout for setting up the database; defaults to 20 seconds
+	Timeout time.Duration
+}
+
+type RoleMember struct {
+	// Role is the unquoted role name, e.g. "changefeed.readers:myservice.MyEvent"
+	Role   string
+	Member string
+}
+
+// NewDatabase creates a database using the default DatabaseOptions.
+func NewDatabase(t testing.TB, dsn string, migrations ...string) *Database {
+	t.Helper()
+	return DatabaseOptions{}.NewDatabase(t, dsn, migrations...)
+}
+
+// NewDatabase creates a new contained database with a random name, creates
+// the writer, reader and any extra users in it, and then runs the migration
+// files in order. The database is dropped, and all connections closed, when
+// the test finishes.
+//
+// Migration files are split into batches on lines containing only "go".
+// The users are created before the migrations run so that the migrations can
+// grant permissions to them.
+func (o DatabaseOptions) NewDatabase(t testing.TB, dsn string, migrations ...string) *Database {
+	t.Helper()
+	d, err := o.Create(dsn, migrations...)
+	if d != nil {
+		t.Cleanup(func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Create is NewDatabase for when there is no testing.TB, such as in TestMain;
+// call Close when done. If Create fails after creating the database, it
+// returns the Database as well, so that it can be closed.
+func (o DatabaseOptions) Create(dsn string, migrations ...string) (*Database, error) {
+	if o.WriterUser == "" {
+		o.WriterUser = "writer"
+	}
+	if o.ReaderUser == "" {
+		o.ReaderUser = "reader"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 20 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	parsed, err := msdsn.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DSN: %w", err)
+	}
+
+	serverDB, err := sql.Open("sqlserver", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Database{
+		Name:       sqlutil.RandomHex(16),
+		WriterUser: o.WriterUser,
+		ReaderUser: o.ReaderUser,
+		dsn:        parsed,
+		passwords:  make(map[string]string),
+		serverDB:   serverDB,
+	}
+
+	for _, stmt := range []string{
+		`exec sp_configure 'contained database authentication', 1`,
+		`declare @sql nvarchar(max) = 'reconfigure'; exec sp_executesql @sql`,
+		fmt.Sprintf(`create database %s containment = partial`, sqlutil.QuoteName(d.Name)),
+	} {
+		if _, err := serverDB.ExecContext(ctx, stmt); err != nil {
+			_ = serverDB.Close()
+			return nil, fmt.Errorf("creating database: %w", err)
+		}
+	}
+
+	for setting, on := range map[string]bool{
+		"allow_snapshot_isolation": !o.DisableSnapshotIsolation,
+		"read_committed_snapshot":  !o.DisableReadCommittedSnapshot,
+	} {
+		value := "off"
+		if on {
+			value = "on"
+		}
+		if _, err := serverDB.ExecContext(ctx, fmt.Sprintf(`alter database %s set %s %s`, sqlutil.QuoteName(d.Name), setting, value)); err != nil {
+			return d, fmt.Errorf("setting %s: %w", setting, err)
+		}
+	}
+
+	if d.AdminDB, err = d.open(d.dsn.User, d.dsn.Password); err != nil {
+		return d, err
+	}
+
+	for _, user := range append([]string{o.WriterUser, o.ReaderUser}, o.ExtraUsers...) {
+		password := sqlutil.RandomHex(8) + "Aa1%"
+		if _, err := d.AdminDB.ExecContext(ctx, fmt.Sprintf(`create user %s with password = %s`, sqlutil.QuoteName(user), sqlutil.QuoteString(password))); err != nil {
+			return d, fmt.Errorf("creating user %s: %w", user, err)
+		}
+		d.passwords[user] = password
+	}
+
+	for _, filename := range migrations {
+		if err := d.runMigration(ctx, filename); err != nil {
+			return d, fmt.Errorf("running migration %s: %w", filename, err)
+		}
+	}
+
+	for _, rm := range o.RoleMembers {
+		if _, err := d.AdminDB.ExecContext(ctx, fmt.Sprintf(`alter role %s add member %s`, sqlutil.QuoteName(rm.Role), sqlutil.QuoteName(rm.Member))); err != nil {
+			return d, fmt.Errorf("adding %s to role %s: %w", rm.Member, rm.Role, err)
+		}
+	}
+
+	if d.WriterDB, err = d.OpenUser(o.WriterUser); err != nil {
+		return d, err
+	}
+	if d.ReaderDB, err = d.OpenUser(o.ReaderUser); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// Close closes all connections to the database and drops it.
+func (d *Database) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, db := range d.opened {
+		_ = db.Close()
+	}
+	defer func() { _ = d.serverDB.Close() }()
+	// kick out any sessions still connected, e.g. from a leaked *sql.Tx
+	_, _ = d.serverDB.ExecContext(ctx, fmt.Sprintf(`alter database %s set single_user with rollback immediate`, sqlutil.QuoteName(d.Name)))
+	if _, err := d.serverDB.ExecContext(ctx, fmt.Sprintf(`drop database %s`, sqlutil.QuoteName(d.Name))); err != nil {
+		return fmt.Errorf("dropping database %s: %w", d.Name, err)
+	}
+	return nil
+}
+
+// Open connects to the database as one of the users created by NewDatabase.
+func (d *Database) Open(t testing.TB, user string) *sql.DB {
+	t.Helper()
+	db, err := d.OpenUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// OpenUser is Open for when there is no testing.TB.
+func (d *Database) OpenUser(user string) (*sql.DB, error) {
+	password, ok := d.passwords[user]
+	if !ok {
+		return nil, fmt.Errorf("user %s was not created by NewDatabase", user)
+	}
+	return d.open(user, password)
+}
+
+// DSN returns the connection string for one of the users created by
+// NewDatabase, e.g. to wrap the connector. It returns "" for unknown users.
+func (d *Database) DSN(user string) string {
+	password, ok := d.passwords[user]
+	if !ok {
+		return ""
+	}
+	return d.dsnFor(user, password)
+}
+
+func (d *Database) dsnFor(user, password string) string {
+	config := d.dsn
+	config.Database = d.Name
+	config.User = user
+	config.Password = password
+	return config.URL().String()
+}
+
+// open connects as user; the connection is closed by Close
+func (d *Database) open(user, password string) (*sql.DB, error) {
+	db, err := sql.Open("sqlserver", d.dsnFor(user, password))
+	if err != nil {
+		return nil, err
+	}
+	d.opened = append(d.opened, db)
+	return db, nil
+}
+
+func (d *Database) runMigration(ctx context.Context, filename string) error {
+	migrationSql, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	lineno := 0
+	for _, batch := range sqlutil.SplitBatches(string(migrationSql)) {
+		if _, err := d.AdminDB.ExecContext(ctx, batch); err != nil {
+			var sqlErr mssql.Error
+			if errors.As(err, &sqlErr) {
+				return fmt.Errorf("line %d: %w", lineno+int(sqlErr.LineNo), err)
+			}
+			return err
+		}
+		lineno += strings.Count(batch, "\n") + 2
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package changefeed_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/changefeedtest"
+)
+
+// These tests live in package changefeed_test since changefeedtest imports changefeed
+
+type loadTest struct {
+	description                                     string
+	writerCount, readerCount, eventCountPerThread   int
+	writeInParallel, readInParallel, readAfterWrite bool
+}
+
+func (tc loadTest) workload() changefeedtest.Workload {
+	return changefeedtest.Workload{
+		Writers:         tc.writerCount,
+		Readers:         tc.readerCount,
+		EventsPerWriter: tc.eventCountPerThread,
+		SerialWrites:    !tc.writeInParallel,
+		SerialReads:     !tc.readInParallel,
+		ReadAfterWrite:  tc.readAfterWrite,
+		PageSize:        10,
+	}
+}
+
+func TestLoadOutbox(t *testing.T) {
+	fixture := changefeed.TestFixture
+	_, err := fixture.AdminDB.ExecContext(context.Background(), `
+exec [changefeed].setup_feed 'myservice.TestLoadOutbox', @outbox = 1;
+alter role [changefeed.writers:myservice.TestLoadOutbox] add member myuser;
+alter role [changefeed.readers:myservice.TestLoadOutbox] add member myreaduser;
+`)
+	require.NoError(t, err)
+
+	for _, tc := range []loadTest{
+		{
+			description:         "small fully parallel test",
+			writerCount:         10,
+			readerCount:         5,
+			eventCountPerThread: 100,
+			writeInParallel:     true,
+			readInParallel:      true,
+			readAfterWrite:      false,
+		},
+		{
+			description:         "read in parallel after single bit serial write is done (focus on readers)",
+			writerCount:         1,
+			readerCount:         20,
+			eventCountPerThread: 1000,
+			writeInParallel:     false,
+			readInParallel:      true,
+			readAfterWrite:      true,
+		},
+		{
+			description:         "heavy fully parallel test",
+			writerCount:         10,
+			readerCount:         10,
+			eventCountPerThread: 200,
+			writeInParallel:     true,
+			readInParallel:      true,
+			readAfterWrite:      false,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := fixture.AdminDB.ExecContext(context.Background(), `
+truncate table [changefeed].[feed:myservice.TestLoadOutbox];
+truncate table [changefeed].[outbox:myservice.TestLoadOutbox];
+truncate table [changefeed].[state:myservice.TestLoadOutbox];
+`)
+			require.NoError(t, err)
+
+			w := tc.workload()
+			w.Write = func(ctx context.Context, writer, version int) error {
+				_, err := fixture.UserDB.ExecContext(ctx, `
+insert into [changefeed].[outbox:myservice.TestLoadOutbox] (shard_id, time_hint, AggregateID, Version) 
+values (0, sysutcdatetime(), @p1, @p2);`, writer, version)
+				return err
+			}
+			w.Reader = changefeed.NewOutboxReader(fixture.ReadUserDB, "myservice.TestLoadOutbox")
+			w.Observe = func(e changefeed.Event) (int, int, error) {
+				return int(e.Values["AggregateID"].(int64)), int(e.Values["Version"].(int64)), nil
+			}
+			w.Logf = func(format string, args ...interface{}) {
+				fmt.Printf(format+"\n", args...)
+			}
+			require.NoError(t, w.Run(context.Background()))
+		})
+	}
+}
+
+func TestLoadBlocking(t *testing.T) {
+	fixture := changefeed.TestFixture
+	_, err := fixture.AdminDB.ExecContext(context.Background(), `
+exec [changefeed].setup_feed 'myservice.TestLoadBlocking', @blocking = 1;
+alter role [changefeed.writers:myservice.TestLoadBlocking] add member myuser;
+`)
+	require.NoError(t, err)
+
+	for _, tc := range []loadTest{
+		{
+			description:         "small fully parallel test",
+			writerCount:         10,
+			readerCount:         5,
+			eventCountPerThread: 100,
+			writeInParallel:     true,
+			readInParallel:      true,
+			readAfterWrite:      false,
+		},
+		{
+			description:         "heavy fully parallel test",
+			writerCount:         10,
+			readerCount:         10,
+			eventCountPerThread: 200,
+			writeInParallel:     true,
+			readInParallel:      true,
+			readAfterWrite:      false,
+		},
+	} {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := fixture.AdminDB.ExecContext(context.Background(), `
+truncate table myservice.TestLoadBlocking;
+truncate table [changefeed].[state:myservice.TestLoadBlocking];
+`)
+			require.NoError(t, err)
+
+			w := tc.workload()
+			w.Write = func(ctx context.Context, writer, version int) error {
+				_, err := fixture.UserDB.ExecContext(ctx, `
+begin try 
+	begin transaction
+		exec [changefeed].[lock:myservice.TestLoadBlocking] @shard_id = 0
+	
+		insert into myservice.TestLoadBlocking(ULID, Thread, Number)
+		values (changefeed.[ulid:myservice.TestLoadBlocking](0), @p1, @p2);
+	commit
+end try
+begin catch
+    if @@trancount > 0 rollback;
+end catch
+`, writer, version)
+				return err
+			}
+			w.Reader = changefeed.NewBlockingReader(fixture.ReadUserDB, "myservice.TestLoadBlocking", "ULID", "")
+			w.Observe = func(e changefeed.Event) (int, int, error) {
+				return int(e.Values["Thread"].(int64)), int(e.Values["Number"].(int64)), nil
+			}
+			require.NoError(t, w.Run(context.Background()))
+		})
+	}
+}
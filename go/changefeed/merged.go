@@ -0,0 +1,167 @@
+package changefeed
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oklog/ulid"
+)
+
+// MergedCursor is the position of a MergedReader: the ULID of the last event
+// consumed from each shard. Shards that are missing have not been read from.
+//
+// It serializes as text, e.g. "0:01H2ZJ7P000000000000000000,1:01H2ZJ7Q000000000000000000",
+// so it can be stored as a single value or embedded in JSON.
+type MergedCursor map[int]ulid.ULID
+
+func (c MergedCursor) String() string {
+	shards := make([]int, 0, len(c))
+	for shardID := range c {
+		shards = append(shards, shardID)
+	}
+	sort.Ints(shards)
+	parts := make([]string, len(shards))
+	for i, shardID := range shards {
+		parts[i] = strconv.Itoa(shardID) + ":" + c[shardID].String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseMergedCursor parses the format returned by MergedCursor.String.
+func ParseMergedCursor(s string) (MergedCursor, error) {
+	c := make(MergedCursor)
+	if s == "" {
+		return c, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		shard, id, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid merged cursor %q: expected shard:ulid", part)
+		}
+		shardID, err := strconv.Atoi(shard)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merged cursor %q: %w", part, err)
+		}
+		cursor, err := ulid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merged cursor %q: %w", part, err)
+		}
+		if _, ok := c[shardID]; ok {
+			return nil, fmt.Errorf("invalid merged cursor: shard %d given twice", shardID)
+		}
+		c[shardID] = cursor
+	}
+	return c, nil
+}
+
+func (c MergedCursor) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *MergedCursor) UnmarshalText(text []byte) error {
+	parsed, err := ParseMergedCursor(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// MergedEvent is an event read by a MergedReader, with the shard it came from.
+type MergedEvent struct {
+	ShardID int
+	Event
+}
+
+// MergedReader reads all shards of a feed as one stream in approximate global
+// ULID order, for consumers such as audit exports that do not care about shards.
+//
+// Each call to ReadPage reads a page of the same size from every shard, merges
+// them by ULID and returns the first page of the result. Since a shard that
+// returns a full page has pageSize events that are all before the ones it has
+// not returned yet, no unread event can come before the returned ones. Shards
+// that return less than a full page are at their head, and do not hold back
+// the others; so idle shards never block the merged stream. The price is that
+// an event written later to an idle shard can have a lower ULID than events
+// already returned from other shards, which is why the order is only
+// approximate. Within a shard the order is always that of the feed, and every
+// event is returned exactly once.
+type MergedReader struct {
+	Reader Reader
+	Shards []int
+}
+
+func NewMergedReader(reader Reader, shards ...int) *MergedReader {
+	return &MergedReader{Reader: reader, Shards: shards}
+}
+
+// ReadPage returns up to pageSize events after cursor, and the cursor to pass
+// to the next call. The cursor passed in is not modified. An empty page means
+// that every shard is at its head.
+func (r *MergedReader) ReadPage(ctx context.Context, cursor MergedCursor, pageSize int) ([]MergedEvent, MergedCursor, error) {
+	next := make(MergedCursor, len(r.Shards))
+	for shardID, c := range cursor {
+		next[shardID] = c
+	}
+
+	var pages mergeHeap
+	for _, shardID := range r.Shards {
+		events, err := r.Reader.ReadPage(ctx, shardID, cursor[shardID], pageSize)
+		if err != nil {
+			return nil, cursor, fmt.Errorf("reading shard %d: %w", shardID, err)
+		}
+		if len(events) == 0 {
+			continue
+		}
+		pages = append(pages, &shardPage{shardID: shardID, events: events})
+	}
+	heap.Init(&pages)
+
+	var result []MergedEvent
+	for len(pages) > 0 && len(result) < pageSize {
+		page := pages[0]
+		event := page.events[0]
+		result = append(result, MergedEvent{ShardID: page.shardID, Event: event})
+		next[page.shardID] = event.ULID
+		page.events = page.events[1:]
+		if len(page.events) == 0 {
+			heap.Pop(&pages)
+		} else {
+			heap.Fix(&pages, 0)
+		}
+	}
+	return result, next, nil
+}
+
+type shardPage struct {
+	shardID int
+	events  []Event
+}
+
+// mergeHeap orders the pages by their first event; ties are broken by shard
+// so that the merged order is deterministic
+type mergeHeap []*shardPage
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if c := h[i].events[0].ULID.Compare(h[j].events[0].ULID); c != 0 {
+		return c < 0
+	}
+	return h[i].shardID < h[j].shardID
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*shardPage)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
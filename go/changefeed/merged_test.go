@@ -0,0 +1,133 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shardsReader serves pages from events kept in memory
+type shardsReader map[int][]Event
+
+func (s shardsReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]Event, error) {
+	var page []Event
+	for _, e := range s[shardID] {
+		if e.ULID.Compare(cursor) > 0 && len(page) < pageSize {
+			page = append(page, e)
+		}
+	}
+	return page, nil
+}
+
+func eventAt(ms uint64) Event {
+	var id ulid.ULID
+	if err := id.SetTime(ms); err != nil {
+		panic(err)
+	}
+	return Event{ULID: id}
+}
+
+func mergedTimes(events []MergedEvent) (times []uint64) {
+	for _, e := range events {
+		times = append(times, e.ULID.Time())
+	}
+	return times
+}
+
+func TestMergedReader(t *testing.T) {
+	ctx := context.Background()
+	shards := shardsReader{
+		0: {eventAt(1), eventAt(4), eventAt(5), eventAt(6), eventAt(9)},
+		1: {eventAt(2), eventAt(3), eventAt(7), eventAt(8)},
+		// 2 is idle
+	}
+	reader := NewMergedReader(shards, 0, 1, 2)
+
+	page, cursor, err := reader.ReadPage(ctx, nil, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, mergedTimes(page))
+	assert.Equal(t, []int{0, 1, 1}, []int{page[0].ShardID, page[1].ShardID, page[2].ShardID})
+	assert.Equal(t, MergedCursor{0: shards[0][0].ULID, 1: shards[1][1].ULID}, cursor)
+
+	// Shard 0 returns a full page (4, 5, 6) and 7 and 8 from shard 1 wait
+	// for the next page, since shard 0 may have more events before them
+	page, cursor, err = reader.ReadPage(ctx, cursor, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{4, 5, 6}, mergedTimes(page))
+
+	// The idle shard 2 does not block anything
+	page, cursor, err = reader.ReadPage(ctx, cursor, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{7, 8, 9}, mergedTimes(page))
+
+	page, cursor2, err := reader.ReadPage(ctx, cursor, 10)
+	require.NoError(t, err)
+	assert.Empty(t, page)
+	assert.Equal(t, cursor, cursor2)
+
+	// An event written later to the idle shard is returned, even though it
+	// is older than events already returned from the other shards
+	shards[2] = []Event{eventAt(5)}
+	page, _, err = reader.ReadPage(ctx, cursor, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, 2, page[0].ShardID)
+}
+
+func TestMergedReaderResume(t *testing.T) {
+	ctx := context.Background()
+	shards := shardsReader{}
+	for i := uint64(0); i < 100; i++ {
+		shardID := int(i % 3)
+		if i%7 == 0 {
+			shardID = 3
+		}
+		shards[shardID] = append(shards[shardID], eventAt(1000+i))
+	}
+	reader := NewMergedReader(shards, 0, 1, 2, 3, 4)
+
+	var cursor MergedCursor
+	var times []uint64
+	for {
+		page, next, err := reader.ReadPage(ctx, cursor, 8)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		times = append(times, mergedTimes(page)...)
+
+		// Resume from a serialized cursor every time
+		text, err := json.Marshal(struct{ Cursor MergedCursor }{next})
+		require.NoError(t, err)
+		var decoded struct{ Cursor MergedCursor }
+		require.NoError(t, json.Unmarshal(text, &decoded))
+		require.Equal(t, next, decoded.Cursor)
+		cursor = decoded.Cursor
+	}
+	require.Equal(t, 100, len(times))
+	for i, ms := range times {
+		assert.Equal(t, uint64(1000+i), ms)
+	}
+}
+
+func TestParseMergedCursor(t *testing.T) {
+	c := MergedCursor{10: eventAt(2).ULID, 2: eventAt(1).ULID}
+	s := c.String()
+	assert.Equal(t, "2:"+eventAt(1).ULID.String()+",10:"+eventAt(2).ULID.String(), s)
+	parsed, err := ParseMergedCursor(s)
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	parsed, err = ParseMergedCursor("")
+	require.NoError(t, err)
+	assert.Empty(t, parsed)
+
+	for _, invalid := range []string{"1", "x:" + eventAt(1).ULID.String(), "1:nope", "1:" + eventAt(1).ULID.String() + ",1:" + eventAt(2).ULID.String()} {
+		_, err := ParseMergedCursor(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,330 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Execer is satisfied by *sql.DB, *sql.Conn and *sql.Tx. Publishing should
+// happen in the same transaction as the write to the source table, so
+// pass the *sql.Tx. Deadlocks are only retried when passed a *sql.DB, since
+// SQL Server rolls back the whole transaction of the deadlock victim.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// OutboxRow is an entry to insert into [outbox:<table>].
+type OutboxRow struct {
+	ShardID int
+	// TimeHint is the timestamp that should ideally be embedded in the ULID; if
+	// zero, the current time is used.
+	TimeHint time.Time
+	// Key holds the primary key columns of the row in the source table
+	Key map[string]interface{}
+}
+
+// OutboxPublisher publishes events to a feed set up with @outbox = 1.
+type OutboxPublisher interface {
+	Publish(ctx context.Context, tx Execer, rows ...OutboxRow) error
+}
+
+// ULIDs is a range of ULIDs reserved by BlockingPublisher.Lock.
+type ULIDs struct {
+	High [8]byte
+	Low  int64
+}
+
+// ULID returns the i'th ULID in the range; this is the Go equivalent of
+// calling [ulid:<table>](i) after [lock:<table>]. i should stay below 10^11.
+func (u ULIDs) ULID(i int64) (result ulid.ULID) {
+	copy(result[:8], u.High[:])
+	binary.BigEndian.PutUint64(result[8:], uint64(u.Low+i))
+	return
+}
+
+// BlockingPublisher publishes events to a feed set up with @blocking = 1.
+type BlockingPublisher interface {
+	// Lock serializes writers to the shard until the transaction ends, and
+	// reserves a range of ULIDs to use for the events written in the transaction.
+	// If ctx has a deadline, Lock waits for other writers to the shard until
+	// shortly before it, and then returns ErrShardBusy.
+	Lock(ctx context.Context, tx Execer, shardID int, timeHint time.Time) (ULIDs, error)
+}
+
+// OutboxWriter inserts into [outbox:<table>].
+type OutboxWriter struct {
+	Table string
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+
+	mu sync.Mutex
+	// typeColumns are the key columns of [outbox_type:<table>], in order
+	typeColumns []string
+}
+
+var _ OutboxPublisher = &OutboxWriter{}
+
+func NewOutboxWriter(table string, opts ...Option) *OutboxWriter {
+	return &OutboxWriter{Table: table, Schema: newOptions(opts).schema}
+}
+
+func (w *OutboxWriter) Publish(ctx context.Context, tx Execer, rows ...OutboxRow) error {
+	for _, row := range rows {
+		// the columns are named in the insert, so the order only keeps the statement text stable
+		columns := make([]string, 0, len(row.Key))
+		for column := range row.Key {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		timeHint := row.TimeHint
+		if timeHint.IsZero() {
+			timeHint = time.Now()
+		}
+		args := []interface{}{row.ShardID, timeHint.UTC()}
+		quoted := []string{"shard_id", "time_hint"}
+		params := []string{"@p1", "@p2"}
+		for _, column := range columns {
+			args = append(args, row.Key[column])
+			quoted = append(quoted, sqlutil.QuoteName(column))
+			params = append(params, fmt.Sprintf("@p%d", len(args)))
+		}
+
+		qry := fmt.Sprintf(`insert into %s (%s) values (%s);`,
+			feedObjectName(w.Schema, "outbox", w.Table),
+			strings.Join(quoted, ", "),
+			strings.Join(params, ", "))
+		err := retryDeadlocks(ctx, tx, func() error {
+			_, err := tx.ExecContext(ctx, qry, args...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboxTypeName returns the name of [outbox_type:<table>], the table type
+// taken by [publish:<table>]; see sql_outbox_type_name.
+func outboxTypeName(schema, table string) string {
+	return feedObjectName(schema, "outbox_type", strings.ReplaceAll(table, ".", ":"))
+}
+
+// PublishMany inserts all the rows into [outbox:<table>] in a single call to
+// [publish:<table>], passing them as a table-valued parameter; this is much
+// faster than Publish for many rows. The rows get their order_sequence, and
+// so their ULIDs, in the order they are passed. All rows must have the same
+// key columns, with values of the same types.
+//
+// A table-valued parameter is passed by column position, so the first call
+// reads the columns of [outbox_type:<table>] from SQL Server; tx must then
+// also be a Querier, as *sql.DB, *sql.Conn and *sql.Tx are.
+func (w *OutboxWriter) PublishMany(ctx context.Context, tx Execer, rows []OutboxRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	columns, err := w.outboxTypeColumns(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", w.Table, err)
+	}
+	tvp, err := w.outboxTVP(columns, rows)
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", w.Table, err)
+	}
+	// Called as an RPC, since go-mssqldb can not declare a parameter of a type named like ours
+	err = retryDeadlocks(ctx, tx, func() error {
+		_, err := tx.ExecContext(ctx, feedObjectName(w.Schema, "publish", w.Table), sql.Named("rows", tvp))
+		return err
+	})
+	if err != nil {
+		// the type may have changed, e.g. by MigratePrimaryKey; read it again on the next call
+		w.mu.Lock()
+		w.typeColumns = nil
+		w.mu.Unlock()
+	}
+	return err
+}
+
+// outboxTypeColumns returns the key columns of [outbox_type:<table>] in the
+// order they are declared, after ordinal, shard_id and time_hint
+func (w *OutboxWriter) outboxTypeColumns(ctx context.Context, tx Execer) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.typeColumns != nil {
+		return w.typeColumns, nil
+	}
+	querier, ok := tx.(Querier)
+	if !ok {
+		return nil, fmt.Errorf("%T can not query the columns of %s", tx, outboxTypeName(w.Schema, w.Table))
+	}
+	rows, err := querier.QueryContext(ctx, `
+select c.name
+from sys.table_types as tt
+join sys.columns as c on c.object_id = tt.type_table_object_id
+where tt.user_type_id = type_id(@p1) and c.name not in ('ordinal', 'shard_id', 'time_hint')
+order by c.column_id`, outboxTypeName(w.Schema, w.Table))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%w: %s not found; run upgrade_feed", ErrFeedNotFound, outboxTypeName(w.Schema, w.Table))
+	}
+	w.typeColumns = columns
+	return columns, nil
+}
+
+// outboxTVP returns the rows as [outbox_type:<table>], which has the key
+// columns in the order of columns. mssql.TVP takes a slice of structs with a
+// field for each column, so the struct type is made for the key columns.
+func (w *OutboxWriter) outboxTVP(columns []string, rows []OutboxRow) (mssql.TVP, error) {
+	fields := []reflect.StructField{
+		{Name: "Ordinal", Type: reflect.TypeOf(int32(0))},
+		{Name: "ShardID", Type: reflect.TypeOf(int32(0))},
+		{Name: "TimeHint", Type: reflect.TypeOf(time.Time{})},
+	}
+	for i, column := range columns {
+		v, ok := lookupValue(rows[0].Key, column)
+		if !ok {
+			return mssql.TVP{}, fmt.Errorf("row 0: missing key column %s", column)
+		}
+		v = tvpValue(v)
+		if v == nil {
+			return mssql.TVP{}, fmt.Errorf("row 0: %s is nil", column)
+		}
+		fields = append(fields, reflect.StructField{Name: fmt.Sprintf("Key%d", i), Type: reflect.TypeOf(v)})
+	}
+	const keyField = 3
+
+	now := time.Now()
+	value := reflect.MakeSlice(reflect.SliceOf(reflect.StructOf(fields)), len(rows), len(rows))
+	for i, row := range rows {
+		if len(row.Key) != len(columns) {
+			return mssql.TVP{}, fmt.Errorf("row %d: has %d key columns, expected %d", i, len(row.Key), len(columns))
+		}
+		timeHint := row.TimeHint
+		if timeHint.IsZero() {
+			timeHint = now
+		}
+		r := value.Index(i)
+		r.Field(0).SetInt(int64(i))
+		r.Field(1).SetInt(int64(row.ShardID))
+		r.Field(2).Set(reflect.ValueOf(timeHint.UTC()))
+		for j, column := range columns {
+			v, ok := lookupValue(row.Key, column)
+			if !ok {
+				return mssql.TVP{}, fmt.Errorf("row %d: missing key column %s", i, column)
+			}
+			field := r.Field(keyField + j)
+			rv := reflect.ValueOf(tvpValue(v))
+			if !rv.IsValid() || rv.Type() != field.Type() {
+				return mssql.TVP{}, fmt.Errorf("row %d: %s is %T, expected %s like in row 0", i, column, v, field.Type())
+			}
+			field.Set(rv)
+		}
+	}
+	return mssql.TVP{TypeName: outboxTypeName(w.Schema, w.Table), Value: value.Interface()}, nil
+}
+
+// tvpValue converts the values that mssql.TVP does not handle itself
+func tvpValue(v interface{}) interface{} {
+	if u, ok := v.(ulid.ULID); ok {
+		return u[:]
+	}
+	return v
+}
+
+// lockTimeoutMargin is how long before the context deadline Lock gives up
+// waiting, so that the lock timeout fires in SQL before the driver cancels
+// the call on the deadline
+const lockTimeoutMargin = 50 * time.Millisecond
+
+// lockTimeoutMs returns @lock_timeout_ms for the time left until the deadline;
+// it is an int, so deadlines further away than about 24 days are capped
+func lockTimeoutMs(remaining time.Duration) int64 {
+	margin := lockTimeoutMargin
+	if remaining < 10*margin {
+		margin = remaining / 10
+	}
+	ms := (remaining - margin).Milliseconds()
+	if ms > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return ms
+}
+
+// BlockingWriter calls [lock:<table>]. Since SQL Server rolls back the
+// transaction when the lock times out, a caller that gets ErrShardBusy has
+// to start over in a new transaction, e.g. on another shard.
+type BlockingWriter struct {
+	Table string
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+}
+
+var _ BlockingPublisher = &BlockingWriter{}
+
+func NewBlockingWriter(table string, opts ...Option) *BlockingWriter {
+	return &BlockingWriter{Table: table, Schema: newOptions(opts).schema}
+}
+
+func (w *BlockingWriter) Lock(ctx context.Context, tx Execer, shardID int, timeHint time.Time) (ULIDs, error) {
+	var timeHintArg interface{}
+	if !timeHint.IsZero() {
+		timeHintArg = timeHint.UTC()
+	}
+	var lockTimeout interface{}
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := lockTimeoutMs(time.Until(deadline))
+		if ms <= 0 {
+			return ULIDs{}, fmt.Errorf("%w: shard %d of %s: %w", ErrShardBusy, shardID, w.Table, context.DeadlineExceeded)
+		}
+		lockTimeout = ms
+	}
+	var high []byte
+	var low int64
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`exec %s @shard_id = @shard_id, @time_hint = @time_hint, @ulid_high = @ulid_high output, @ulid_low = @ulid_low output, @lock_timeout_ms = @lock_timeout_ms`,
+		feedObjectName(w.Schema, "lock", w.Table)),
+		sql.Named("shard_id", shardID),
+		sql.Named("time_hint", timeHintArg),
+		sql.Named("ulid_high", sql.Out{Dest: &high}),
+		sql.Named("ulid_low", sql.Out{Dest: &low}),
+		sql.Named("lock_timeout_ms", lockTimeout))
+	if err := mapError(err); errors.Is(err, ErrLockTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return ULIDs{}, fmt.Errorf("%w: shard %d of %s: %w", ErrShardBusy, shardID, w.Table, err)
+	} else if err != nil {
+		return ULIDs{}, err
+	}
+	var result ULIDs
+	if len(high) != len(result.High) {
+		return ULIDs{}, fmt.Errorf("unexpected length of @ulid_high: %d", len(high))
+	}
+	copy(result.High[:], high)
+	result.Low = low
+	return result, nil
+}
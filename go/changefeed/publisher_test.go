@@ -0,0 +1,242 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxWriter(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestOutboxWriter', @outbox = 1;
+alter role [changefeed.writers:myservice.TestOutboxWriter] add member myuser;
+alter role [changefeed.readers:myservice.TestOutboxWriter] add member myreaduser;
+`)
+	require.NoError(t, err)
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	_, err = tx.ExecContext(ctx, `insert into myservice.TestOutboxWriter (AggregateID, Version, Data) values (1, 1, 'a'), (1, 2, 'b')`)
+	require.NoError(t, err)
+	err = NewOutboxWriter("myservice.TestOutboxWriter").Publish(ctx, tx,
+		OutboxRow{ShardID: 0, TimeHint: time.Date(2023, 5, 31, 12, 0, 0, 0, time.UTC), Key: map[string]interface{}{"AggregateID": 1, "Version": 1}},
+		OutboxRow{ShardID: 0, Key: map[string]interface{}{"AggregateID": 1, "Version": 2}},
+	)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	page, err := NewOutboxReader(fixture.ReadUserDB, "myservice.TestOutboxWriter").ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page))
+	assert.Equal(t, int64(1), page[0].Values["Version"])
+	assert.Equal(t, int64(2), page[1].Values["Version"])
+	assert.Equal(t, "2023-05-31T12:00:00Z", time.UnixMilli(int64(page[0].ULID.Time())).UTC().Format(time.RFC3339))
+}
+
+func TestBlockingWriter(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestBlockingWriter', @blocking = 1;
+alter role [changefeed.writers:myservice.TestBlockingWriter] add member myuser;
+`)
+	require.NoError(t, err)
+
+	writer := NewBlockingWriter("myservice.TestBlockingWriter")
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	ulids, err := writer.Lock(ctx, tx, 0, time.Time{})
+	require.NoError(t, err)
+	// ULIDs.ULID is the same as the [ulid:*] function in SQL
+	var fromSQL []byte
+	require.NoError(t, tx.QueryRowContext(ctx, `select [changefeed].[ulid:myservice.TestBlockingWriter](1)`).Scan(&fromSQL))
+	u1 := ulids.ULID(1)
+	assert.Equal(t, u1[:], fromSQL)
+	u0 := ulids.ULID(0)
+	_, err = tx.ExecContext(ctx, `insert into myservice.TestBlockingWriter (ULID, Data) values (@p1, 'a'), (@p2, 'b')`,
+		u0[:], u1[:])
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	page, err := NewBlockingReader(fixture.ReadUserDB, "myservice.TestBlockingWriter", "ULID", "").ReadPage(ctx, 0, ulid.ULID{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page))
+	assert.Equal(t, ulids.ULID(0), page[0].ULID)
+	assert.Equal(t, "b", page[1].Values["Data"])
+}
+
+func TestBlockingWriterShardBusy(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestShardBusy', @blocking = 1;
+alter role [changefeed.writers:myservice.TestShardBusy] add member myuser;
+`)
+	require.NoError(t, err)
+	writer := NewBlockingWriter("myservice.TestShardBusy")
+
+	// A transaction that holds on to the lock of shard 0
+	stuck, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer stuck.Rollback()
+	_, err = writer.Lock(ctx, stuck, 0, time.Time{})
+	require.NoError(t, err)
+
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	lockCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err = writer.Lock(lockCtx, tx, 0, time.Time{})
+	assert.ErrorIs(t, err, ErrShardBusy)
+	assert.Less(t, time.Since(started), 2*time.Second)
+	_ = tx.Rollback()
+
+	// Other shards are not affected
+	tx, err = fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	lockCtx, cancel = context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	_, err = writer.Lock(lockCtx, tx, 1, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, stuck.Commit())
+}
+
+func TestLockTimeoutMs(t *testing.T) {
+	assert.Equal(t, int64(950), lockTimeoutMs(time.Second))
+	assert.Equal(t, int64(90), lockTimeoutMs(100*time.Millisecond))
+	assert.Equal(t, int64(0), lockTimeoutMs(0))
+	// @lock_timeout_ms is an int
+	assert.Equal(t, int64(math.MaxInt32), lockTimeoutMs(30*24*time.Hour))
+	assert.Equal(t, int64(math.MaxInt32), lockTimeoutMs(time.Duration(math.MaxInt64)))
+}
+
+func TestOutboxTVP(t *testing.T) {
+	w := NewOutboxWriter("myservice.MyEvent", WithSchema("cf"))
+	timeHint := time.Date(2023, 5, 31, 12, 0, 0, 0, time.UTC)
+	// The key columns follow ordinal, shard_id and time_hint in the order of the
+	// type, whatever order Go would sort them in; keys are matched ignoring case
+	tvp, err := w.outboxTVP([]string{"Version", "AggregateID"}, []OutboxRow{
+		{ShardID: 1, TimeHint: timeHint, Key: map[string]interface{}{"version": 2, "AggregateID": int64(10)}},
+		{ShardID: 2, TimeHint: timeHint, Key: map[string]interface{}{"version": 1, "AggregateID": int64(20)}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "[cf].[outbox_type:myservice:MyEvent]", tvp.TypeName)
+	rows := reflect.ValueOf(tvp.Value)
+	require.Equal(t, 2, rows.Len())
+	for i, expected := range [][]interface{}{
+		{int32(0), int32(1), timeHint, 2, int64(10)},
+		{int32(1), int32(2), timeHint, 1, int64(20)},
+	} {
+		var fields []interface{}
+		for j := 0; j != rows.Index(i).NumField(); j++ {
+			fields = append(fields, rows.Index(i).Field(j).Interface())
+		}
+		assert.Equal(t, expected, fields)
+	}
+
+	u := ulid.MustParse("01H1MTB1M8ZPX7ZNRBMJ2K9Q4W")
+	tvp, err = w.outboxTVP([]string{"ULID"}, []OutboxRow{{Key: map[string]interface{}{"ULID": u}}})
+	require.NoError(t, err)
+	assert.Equal(t, u[:], reflect.ValueOf(tvp.Value).Index(0).Field(3).Interface())
+
+	columns := []string{"AggregateID", "Version"}
+	_, err = w.outboxTVP(columns, []OutboxRow{
+		{Key: map[string]interface{}{"AggregateID": int64(1), "Version": 1}},
+		{Key: map[string]interface{}{"AggregateID": 1, "Version": 2}},
+	})
+	assert.ErrorContains(t, err, "row 1: AggregateID is int, expected int64")
+	_, err = w.outboxTVP(columns, []OutboxRow{
+		{Key: map[string]interface{}{"AggregateID": 1, "Version": 1}},
+		{Key: map[string]interface{}{"AggregateID": 1, "Tenant": 2}},
+	})
+	assert.ErrorContains(t, err, "row 1: missing key column Version")
+	_, err = w.outboxTVP(columns, []OutboxRow{{Key: map[string]interface{}{"AggregateID": 1, "Tenant": 2}}})
+	assert.ErrorContains(t, err, "row 0: missing key column Version")
+	_, err = w.outboxTVP([]string{"AggregateID"}, []OutboxRow{{Key: map[string]interface{}{"AggregateID": nil}}})
+	assert.Error(t, err)
+}
+
+func TestPublishMany(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestPublishMany', @outbox = 1;
+alter role [changefeed.writers:myservice.TestPublishMany] add member myuser;
+alter role [changefeed.readers:myservice.TestPublishMany] add member myreaduser;
+`)
+	require.NoError(t, err)
+
+	// Versions in descending order, so that neither the primary key nor the
+	// order of the values hide that the order of the rows is kept
+	var rows []OutboxRow
+	for i := 0; i != 100; i++ {
+		rows = append(rows, OutboxRow{ShardID: i % 2, Key: map[string]interface{}{"AggregateID": 1, "Version": 1000 - i}})
+	}
+	tx, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	writer := NewOutboxWriter("myservice.TestPublishMany")
+	require.NoError(t, writer.PublishMany(ctx, tx, rows))
+	require.NoError(t, writer.PublishMany(ctx, tx, nil))
+	assert.Equal(t, []string{"AggregateID", "Version"}, writer.typeColumns)
+	require.NoError(t, tx.Commit())
+
+	reader := NewOutboxReader(fixture.ReadUserDB, "myservice.TestPublishMany")
+	for shard := 0; shard != 2; shard++ {
+		page, err := reader.ReadPage(ctx, shard, ulid.ULID{}, 100)
+		require.NoError(t, err)
+		require.Equal(t, 50, len(page))
+		for i, e := range page {
+			assert.Equal(t, int64(1000-shard-2*i), e.Values["Version"])
+		}
+	}
+}
+
+// BenchmarkPublish compares publishing 1000 rows in a transaction with
+// Publish, which inserts one row at a time, and with PublishMany.
+func BenchmarkPublish(b *testing.B) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.BenchmarkPublish', @outbox = 1;
+alter role [changefeed.writers:myservice.BenchmarkPublish] add member myuser;
+`)
+	require.NoError(b, err)
+	writer := NewOutboxWriter("myservice.BenchmarkPublish")
+
+	const rowsPerTransaction = 1000
+	aggregateID := 0
+	makeRows := func() []OutboxRow {
+		aggregateID++
+		rows := make([]OutboxRow, rowsPerTransaction)
+		for i := range rows {
+			rows[i] = OutboxRow{Key: map[string]interface{}{"AggregateID": aggregateID, "Version": i}}
+		}
+		return rows
+	}
+
+	for _, bc := range []struct {
+		name    string
+		publish func(tx *sql.Tx, rows []OutboxRow) error
+	}{
+		{"Publish", func(tx *sql.Tx, rows []OutboxRow) error { return writer.Publish(ctx, tx, rows...) }},
+		{"PublishMany", func(tx *sql.Tx, rows []OutboxRow) error { return writer.PublishMany(ctx, tx, rows) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rows := makeRows()
+				tx, err := fixture.UserDB.BeginTx(ctx, nil)
+				require.NoError(b, err)
+				require.NoError(b, bc.publish(tx, rows))
+				require.NoError(b, tx.Commit())
+			}
+			b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*rowsPerTransaction), "µs/row")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Querier is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Event is a single entry in a feed.
+type Event struct {
+	ULID ulid.ULID
+	// Values holds the remaining columns of the page, keyed by column name. For
+	// the outbox mode these are the primary key columns of the source table; for
+	// the blocking mode it is the full row of the source table.
+	Values map[string]interface{}
+}
+
+// Reader reads pages of events from a single shard of a feed. The cursor is the
+// ULID of the last event consumed; pass the zero ULID to read from the start.
+//
+// The readers in this package retry a page that fails with ErrDeadlock when
+// they are given a *sql.DB, and return errors that match the sentinel errors
+// of this package.
+type Reader interface {
+	ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]Event, error)
+}
+
+// OutboxReader reads a feed set up with @outbox = 1 by calling [read_feed_rs:<table>].
+// This will also move events from the outbox to the feed when at the head of the feed.
+type OutboxReader struct {
+	DB    Querier
+	Table string
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+	// TempTable calls [read_feed:<table>] with a #read table created in the
+	// same batch instead, for feeds that have not been upgraded to a library
+	// version with [read_feed_rs:<table>]
+	TempTable bool
+}
+
+var _ Reader = &OutboxReader{}
+
+func NewOutboxReader(db Querier, table string, opts ...Option) *OutboxReader {
+	return &OutboxReader{DB: db, Table: table, Schema: newOptions(opts).schema}
+}
+
+func (r *OutboxReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]Event, error) {
+	qry := fmt.Sprintf(`exec %s @shard_id = @shard_id, @cursor = @cursor, @pagesize = @pagesize`,
+		feedObjectName(r.Schema, "read_feed_rs", r.Table))
+	if r.TempTable {
+		qry = r.tempTableQuery()
+	}
+	var events []Event
+	err := retryDeadlocks(ctx, r.DB, func() error {
+		rows, err := r.DB.QueryContext(ctx, qry,
+			sql.Named("shard_id", shardID),
+			sql.Named("cursor", cursor[:]),
+			sql.Named("pagesize", pageSize))
+		if err != nil {
+			return err
+		}
+		events, err = scanEvents(rows, "ulid")
+		return err
+	})
+	return events, err
+}
+
+func (r *OutboxReader) tempTableQuery() string {
+	// #read is created in the same batch as it is consumed, since connection pooling
+	// will reset the session (and drop temporary tables) between batches.
+	return fmt.Sprintf(`
+if object_id('tempdb..#read') is not null drop table #read;
+declare @tmp as %s;
+select * into #read from @tmp;
+exec %s @shard_id = @shard_id, @cursor = @cursor, @pagesize = @pagesize;
+select * from #read order by ulid;
+`, feedObjectName(r.Schema, "type:read", r.Table), feedObjectName(r.Schema, "read_feed", r.Table))
+}
+
+// BlockingReader reads a feed set up with @blocking = 1. In blocking mode the
+// publisher stores the ULID in the source table itself, so paging is done
+// directly on the source table; it should have an index on (ShardColumn, ULIDColumn).
+type BlockingReader struct {
+	DB Querier
+	// Table is the source table; pass it quoted, e.g. "[my.schema].[MyTable]",
+	// if the schema name contains a dot
+	Table string
+	// ULIDColumn is the binary(16) column holding the ULID; defaults to "ULID"
+	ULIDColumn string
+	// ShardColumn is the column holding the shard ID. If empty the table is
+	// assumed to only hold a single shard, and shardID passed to ReadPage is ignored.
+	ShardColumn string
+}
+
+var _ Reader = &BlockingReader{}
+
+func NewBlockingReader(db Querier, table, ulidColumn, shardColumn string) *BlockingReader {
+	return &BlockingReader{DB: db, Table: table, ULIDColumn: ulidColumn, ShardColumn: shardColumn}
+}
+
+func (r *BlockingReader) ulidColumn() string {
+	if r.ULIDColumn == "" {
+		return "ULID"
+	}
+	return r.ULIDColumn
+}
+
+func (r *BlockingReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]Event, error) {
+	ulidColumn := sqlutil.QuoteName(r.ulidColumn())
+	where := ulidColumn + " > @cursor"
+	if r.ShardColumn != "" {
+		where = sqlutil.QuoteName(r.ShardColumn) + " = @shard_id and " + where
+	}
+	qry := fmt.Sprintf(`select top(@pagesize) * from %s where %s order by %s`,
+		fullyQuotedName(r.Table), where, ulidColumn)
+
+	var events []Event
+	err := retryDeadlocks(ctx, r.DB, func() error {
+		rows, err := r.DB.QueryContext(ctx, qry,
+			sql.Named("shard_id", shardID),
+			sql.Named("cursor", cursor[:]),
+			sql.Named("pagesize", pageSize))
+		if err != nil {
+			return err
+		}
+		events, err = scanEvents(rows, r.ulidColumn())
+		return err
+	})
+	return events, err
+}
+
+// scanEvents reads all rows into events; the column named ulidColumn becomes
+// Event.ULID and the other columns go into Event.Values.
+func scanEvents(rows *sql.Rows, ulidColumn string) (result []Event, err error) {
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	ulidIndex := -1
+	for i, t := range types {
+		if strings.EqualFold(t.Name(), ulidColumn) {
+			ulidIndex = i
+		}
+	}
+	if ulidIndex == -1 {
+		return nil, fmt.Errorf("column %s not found in result", ulidColumn)
+	}
+
+	values := make([]interface{}, len(types))
+	pointers := make([]interface{}, len(types))
+	for i, t := range types {
+		if t.DatabaseTypeName() == "UNIQUEIDENTIFIER" {
+			pointers[i] = &mssql.NullUniqueIdentifier{}
+		} else {
+			pointers[i] = &values[i]
+		}
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		event := Event{Values: make(map[string]interface{}, len(types)-1)}
+		for i, t := range types {
+			value := values[i]
+			if u, ok := pointers[i].(*mssql.NullUniqueIdentifier); ok {
+				if u.Valid {
+					value = u.UUID.String()
+				} else {
+					value = nil
+				}
+			}
+			if i == ulidIndex {
+				b, ok := value.([]byte)
+				if !ok || len(b) != 16 {
+					return nil, fmt.Errorf("column %s is not a binary(16)", ulidColumn)
+				}
+				copy(event.ULID[:], b)
+				continue
+			}
+			// the driver may reuse the buffer on the next call to Scan
+			if b, ok := value.([]byte); ok {
+				value = append([]byte(nil), b...)
+			}
+			event.Values[t.Name()] = value
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,103 @@
+package changefeed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxReader(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestOutboxReader', @outbox = 1;
+alter role [changefeed.writers:myservice.TestOutboxReader] add member myuser;
+alter role [changefeed.readers:myservice.TestOutboxReader] add member myreaduser;
+`)
+	require.NoError(t, err)
+
+	_, err = fixture.UserDB.ExecContext(ctx, `
+insert into [changefeed].[outbox:myservice.TestOutboxReader] (shard_id, time_hint, AggregateID, Version) values
+    (0, '2023-05-31 12:00:00', 1000, 1),
+    (0, '2023-05-31 12:00:01', 1000, 2),
+    (0, '2023-05-31 12:00:02', 1001, 1),
+    (1, '2023-05-31 12:00:03', 1002, 1);
+`)
+	require.NoError(t, err)
+
+	reader := NewOutboxReader(fixture.ReadUserDB, "myservice.TestOutboxReader")
+
+	page1, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page1))
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(1000), "Version": int64(1)}, page1[0].Values)
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(1000), "Version": int64(2)}, page1[1].Values)
+
+	page2, err := reader.ReadPage(ctx, 0, page1[1].ULID, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page2))
+	assert.Equal(t, map[string]interface{}{"AggregateID": int64(1001), "Version": int64(1)}, page2[0].Values)
+	assert.Less(t, page1[1].ULID.Compare(page2[0].ULID), 0)
+
+	page3, err := reader.ReadPage(ctx, 0, page2[0].ULID, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(page3))
+
+	shard1, err := reader.ReadPage(ctx, 1, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(shard1))
+	assert.Equal(t, int64(1002), shard1[0].Values["AggregateID"])
+
+	// Calling read_feed with #read gives the same pages
+	tempTableReader := NewOutboxReader(fixture.ReadUserDB, "myservice.TestOutboxReader")
+	tempTableReader.TempTable = true
+	page, err := tempTableReader.ReadPage(ctx, 0, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, page1, page)
+}
+
+func TestBlockingReader(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestBlockingReader', @blocking = 1;
+alter role [changefeed.writers:myservice.TestBlockingReader] add member myuser;
+`)
+	require.NoError(t, err)
+
+	_, err = fixture.UserDB.ExecContext(ctx, `
+set xact_abort on;
+begin transaction;
+exec [changefeed].[lock:myservice.TestBlockingReader] @shard_id = 0;
+insert into myservice.TestBlockingReader (Shard, ULID, Data) values
+    (0, [changefeed].[ulid:myservice.TestBlockingReader](0), 'a'),
+    (0, [changefeed].[ulid:myservice.TestBlockingReader](1), 'b'),
+    (0, [changefeed].[ulid:myservice.TestBlockingReader](2), 'c');
+commit;
+begin transaction;
+exec [changefeed].[lock:myservice.TestBlockingReader] @shard_id = 1;
+insert into myservice.TestBlockingReader (Shard, ULID, Data) values
+    (1, [changefeed].[ulid:myservice.TestBlockingReader](0), 'd');
+commit;
+`)
+	require.NoError(t, err)
+
+	reader := NewBlockingReader(fixture.ReadUserDB, "myservice.TestBlockingReader", "ULID", "Shard")
+
+	page1, err := reader.ReadPage(ctx, 0, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page1))
+	assert.Equal(t, "a", page1[0].Values["Data"])
+	assert.Equal(t, "b", page1[1].Values["Data"])
+
+	page2, err := reader.ReadPage(ctx, 0, page1[1].ULID, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page2))
+	assert.Equal(t, "c", page2[0].Values["Data"])
+
+	shard1, err := reader.ReadPage(ctx, 1, ulid.ULID{}, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(shard1))
+	assert.Equal(t, "d", shard1[0].Values["Data"])
+}
@@ -0,0 +1,183 @@
+// Package kafka is a relay.Sink that mirrors a feed into a Kafka topic.
+//
+// Each shard of the feed is mapped to one partition of the topic, so the
+// per-shard ordering of the feed becomes the per-partition ordering in
+// Kafka. The ULID of each event is used as the record key, and is also
+// stored in the "changefeed-ulid" header so that consumers can recover the
+// feed position from any record.
+//
+// Before the first write to a partition, and after every failed write, the
+// Sink reads the "changefeed-ulid" header of the last record in the
+// partition, and skips the events at or below it. A page that was stored by
+// the broker, but whose ack was lost, is therefore not produced again when
+// the same relay retries it. This is not a guarantee from the broker: relays
+// writing to the same partition concurrently can both see the same last
+// record and produce the same events, so delivery is at least once, and
+// consumers should skip records by ULID if they need exactly once.
+//
+// The package does not depend on a particular Kafka client; wrap your client
+// in the Producer interface. Use acks from all in-sync replicas, so that a
+// record read back by LastRecord is not lost later. LastRecord looks up the
+// end offset of the partition, e.g. with kadm.Client.ListEndOffsets in
+// franz-go, and returns the record at the offset before it, or nil if the
+// partition is empty. ProduceSync can be written like this with franz-go:
+//
+//	type kgoProducer struct{ client *kgo.Client }
+//
+//	func (p kgoProducer) ProduceSync(ctx context.Context, records ...kafka.Record) error {
+//		krs := make([]*kgo.Record, len(records))
+//		for i, r := range records {
+//			krs[i] = &kgo.Record{Topic: r.Topic, Partition: r.Partition, Key: r.Key, Value: r.Value}
+//			for _, h := range r.Headers {
+//				krs[i].Headers = append(krs[i].Headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+//			}
+//		}
+//		return p.client.ProduceSync(ctx, krs...).FirstErr()
+//	}
+//
+// where the client is created with kgo.RecordPartitioner(kgo.ManualPartitioner()).
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/oklog/ulid"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/relay"
+)
+
+const (
+	HeaderULID  = "changefeed-ulid"
+	HeaderShard = "changefeed-shard"
+)
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+type Record struct {
+	Topic     string
+	Partition int32
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+}
+
+// Producer is the produce API of a Kafka client. ProduceSync must not return
+// until all records have been acknowledged by the broker, and must preserve
+// the order of records within each partition. LastRecord returns the last
+// record of the partition, or nil if it is empty.
+type Producer interface {
+	ProduceSync(ctx context.Context, records ...Record) error
+	LastRecord(ctx context.Context, topic string, partition int32) (*Record, error)
+}
+
+type Sink struct {
+	Producer Producer
+	Topic    string
+	// Partition maps a shard ID to a partition of Topic; by default the shard ID is used as-is
+	Partition func(shardID int) int32
+	// Encode produces the record value for an event; by default the JSON encoding of Event.Values
+	Encode func(event changefeed.Event) ([]byte, error)
+
+	mu sync.Mutex
+	// produced is the ULID of the last record known to be stored in each partition
+	produced map[int32]ulid.ULID
+}
+
+var _ relay.Sink = &Sink{}
+
+func NewSink(producer Producer, topic string) *Sink {
+	return &Sink{Producer: producer, Topic: topic}
+}
+
+func (s *Sink) partition(shardID int) int32 {
+	if s.Partition == nil {
+		return int32(shardID)
+	}
+	return s.Partition(shardID)
+}
+
+func (s *Sink) encode(event changefeed.Event) ([]byte, error) {
+	if s.Encode == nil {
+		return json.Marshal(event.Values)
+	}
+	return s.Encode(event)
+}
+
+// lastProduced returns the ULID of the last record stored in the
+// partition, reading it from the broker unless it is known already
+func (s *Sink) lastProduced(ctx context.Context, partition int32) (ulid.ULID, error) {
+	if last, ok := s.produced[partition]; ok {
+		return last, nil
+	}
+	record, err := s.Producer.LastRecord(ctx, s.Topic, partition)
+	if err != nil {
+		return ulid.ULID{}, fmt.Errorf("reading last record of partition %d: %w", partition, err)
+	}
+	var last ulid.ULID
+	if record != nil {
+		for _, h := range record.Headers {
+			if h.Key == HeaderULID {
+				if last, err = ulid.Parse(string(h.Value)); err != nil {
+					return ulid.ULID{}, fmt.Errorf("parsing %s header of last record of partition %d: %w", HeaderULID, partition, err)
+				}
+			}
+		}
+	}
+	if s.produced == nil {
+		s.produced = make(map[int32]ulid.ULID)
+	}
+	s.produced[partition] = last
+	return last, nil
+}
+
+// Write produces one record per event, in feed order, to the partition of
+// the shard; and returns once the whole page has been acknowledged. Events
+// already stored in the partition are skipped.
+func (s *Sink) Write(ctx context.Context, shardID int, events []changefeed.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	partition := s.partition(shardID)
+	last, err := s.lastProduced(ctx, partition)
+	if err != nil {
+		return err
+	}
+	records := make([]Record, 0, len(events))
+	for _, e := range events {
+		if e.ULID.Compare(last) <= 0 {
+			continue
+		}
+		value, err := s.encode(e)
+		if err != nil {
+			return fmt.Errorf("encoding event %s: %w", e.ULID, err)
+		}
+		key := []byte(e.ULID.String())
+		records = append(records, Record{
+			Topic:     s.Topic,
+			Partition: partition,
+			Key:       key,
+			Value:     value,
+			Headers: []Header{
+				{Key: HeaderULID, Value: key},
+				{Key: HeaderShard, Value: []byte(fmt.Sprint(shardID))},
+			},
+		})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.Producer.ProduceSync(ctx, records...); err != nil {
+		// Some of the records may have been stored anyway; read back what was
+		// before producing again
+		delete(s.produced, partition)
+		return err
+	}
+	s.produced[partition] = events[len(events)-1].ULID
+	return nil
+}
@@ -0,0 +1,218 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+	"github.com/vippsas/mssql-changefeed/go/changefeed/relay"
+)
+
+// fakeBroker is an in-process stand-in for a Kafka cluster implementing the
+// produce API: records are appended to per-partition logs and acked.
+type fakeBroker struct {
+	mu         sync.Mutex
+	partitions map[string]map[int32][]Record
+	// failBeforeAppend fails the next produce request without storing anything
+	failBeforeAppend bool
+	// loseAck stores the next produce request, but fails to ack it
+	loseAck bool
+}
+
+var errBroker = errors.New("broker unavailable")
+
+func (b *fakeBroker) ProduceSync(ctx context.Context, records ...Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failBeforeAppend {
+		b.failBeforeAppend = false
+		return errBroker
+	}
+	if b.partitions == nil {
+		b.partitions = make(map[string]map[int32][]Record)
+	}
+	for _, r := range records {
+		if b.partitions[r.Topic] == nil {
+			b.partitions[r.Topic] = make(map[int32][]Record)
+		}
+		b.partitions[r.Topic][r.Partition] = append(b.partitions[r.Topic][r.Partition], r)
+	}
+	if b.loseAck {
+		b.loseAck = false
+		return errBroker
+	}
+	return nil
+}
+
+func (b *fakeBroker) LastRecord(ctx context.Context, topic string, partition int32) (*Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failBeforeAppend {
+		return nil, errBroker
+	}
+	log := b.partitions[topic][partition]
+	if len(log) == 0 {
+		return nil, nil
+	}
+	last := log[len(log)-1]
+	return &last, nil
+}
+
+func (b *fakeBroker) log(topic string, partition int32) []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.partitions[topic][partition]
+}
+
+type sliceReader struct {
+	events map[int][]changefeed.Event
+}
+
+func (r *sliceReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) (page []changefeed.Event, err error) {
+	for _, e := range r.events[shardID] {
+		if e.ULID.Compare(cursor) > 0 && len(page) < pageSize {
+			page = append(page, e)
+		}
+	}
+	return
+}
+
+func makeEvents(shardID, n int) (result []changefeed.Event) {
+	for i := 0; i != n; i++ {
+		var u ulid.ULID
+		u[0] = byte(shardID)
+		u[15] = byte(i + 1)
+		result = append(result, changefeed.Event{
+			ULID:   u,
+			Values: map[string]interface{}{"AggregateID": 1000 + shardID, "Version": i + 1},
+		})
+	}
+	return
+}
+
+func TestSinkPartitionsAndKeys(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	reader := &sliceReader{events: map[int][]changefeed.Event{0: makeEvents(0, 3), 1: makeEvents(1, 2)}}
+	cursors := &relay.MemoryCursorStore{}
+	sink := NewSink(broker, "myevents")
+	sink.Partition = func(shardID int) int32 { return int32(shardID) + 10 }
+
+	for _, shardID := range []int{0, 1} {
+		r := &relay.Relay{Reader: reader, Sink: sink, Cursors: cursors, ShardID: shardID}
+		n, err := r.RunOnce(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, len(reader.events[shardID]), n)
+	}
+
+	for _, shardID := range []int{0, 1} {
+		log := broker.log("myevents", int32(shardID)+10)
+		require.Equal(t, len(reader.events[shardID]), len(log))
+		for i, record := range log {
+			e := reader.events[shardID][i]
+			assert.Equal(t, e.ULID.String(), string(record.Key))
+			assert.Equal(t, []Header{
+				{Key: HeaderULID, Value: []byte(e.ULID.String())},
+				{Key: HeaderShard, Value: []byte{'0' + byte(shardID)}},
+			}, record.Headers)
+		}
+	}
+	assert.JSONEq(t, `{"AggregateID": 1000, "Version": 1}`, string(broker.log("myevents", 10)[0].Value))
+
+	cursor, err := cursors.LoadCursor(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, reader.events[1][1].ULID, cursor)
+}
+
+func TestCursorSavedOnlyAfterAck(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	reader := &sliceReader{events: map[int][]changefeed.Event{0: makeEvents(0, 4)}}
+	cursors := &relay.MemoryCursorStore{}
+	r := &relay.Relay{Reader: reader, Sink: NewSink(broker, "myevents"), Cursors: cursors, PageSize: 2}
+
+	// First page is relayed normally
+	_, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+
+	// Broker is down; nothing written and the cursor stays
+	broker.failBeforeAppend = true
+	_, err = r.RunOnce(ctx)
+	require.ErrorIs(t, err, errBroker)
+	cursor, err := cursors.LoadCursor(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, reader.events[0][1].ULID, cursor)
+	assert.Equal(t, 2, len(broker.log("myevents", 0)))
+
+	// Records are stored but the ack is lost; the cursor stays, so the page is
+	// written again, but the records already stored are not produced again
+	broker.loseAck = true
+	_, err = r.RunOnce(ctx)
+	require.ErrorIs(t, err, errBroker)
+	n, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"0", "1", "2", "3"}, eventIndexes(t, reader.events[0], broker.log("myevents", 0)))
+
+	cursor, err = cursors.LoadCursor(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, reader.events[0][3].ULID, cursor)
+
+	n, err = r.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+// eventIndexes returns the index in events of the event of each record
+func eventIndexes(t *testing.T, events []changefeed.Event, log []Record) (result []string) {
+	for _, record := range log {
+		i := -1
+		for j, e := range events {
+			if e.ULID.String() == string(record.Key) {
+				i = j
+			}
+		}
+		require.NotEqual(t, -1, i, "unknown record %s", record.Key)
+		result = append(result, fmt.Sprint(i))
+	}
+	return
+}
+
+func TestResumeSkipsProduced(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	reader := &sliceReader{events: map[int][]changefeed.Event{0: makeEvents(0, 4)}}
+
+	// A previous relay produced the first three events, but its cursor was lost
+	require.NoError(t, NewSink(broker, "myevents").Write(ctx, 0, reader.events[0][:3]))
+
+	r := &relay.Relay{Reader: reader, Sink: NewSink(broker, "myevents"), Cursors: &relay.MemoryCursorStore{}}
+	n, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []string{"0", "1", "2", "3"}, eventIndexes(t, reader.events[0], broker.log("myevents", 0)))
+}
+
+// TestConcurrentSinksDuplicate documents that skipping produced events is
+// done by each Sink, not the broker; delivery is at least once
+func TestConcurrentSinksDuplicate(t *testing.T) {
+	ctx := context.Background()
+	broker := &fakeBroker{}
+	events := makeEvents(0, 2)
+	// Two sinks that both read the partition while it was empty
+	first, second := NewSink(broker, "myevents"), NewSink(broker, "myevents")
+	_, err := first.lastProduced(ctx, 0)
+	require.NoError(t, err)
+	_, err = second.lastProduced(ctx, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, first.Write(ctx, 0, events))
+	require.NoError(t, second.Write(ctx, 0, events))
+	assert.Equal(t, []string{"0", "1", "0", "1"}, eventIndexes(t, events, broker.log("myevents", 0)))
+}
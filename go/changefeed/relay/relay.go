@@ -0,0 +1,218 @@
+// Package relay mirrors a shard of a feed into an external system.
+//
+// A Relay reads pages from a changefeed.Reader, hands them to a Sink, and
+// only saves the cursor once the Sink has returned successfully. A crash
+// between the two will cause the last page to be written again on restart,
+// so sinks should write in an idempotent manner (or let downstream
+// consumers de-duplicate on the ULID).
+//
+// By default a page that the Sink fails to write stops the Relay, and the
+// same page is tried again on the next run. With a DeadLetterPolicy, the
+// Relay instead retries the page a few times, then writes the events of the
+// page one at a time, hands the ones that still fail to a DeadLetterStore and
+// moves the cursor past them.
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+const (
+	DefaultPageSize     = 1000
+	DefaultPollInterval = time.Second
+	DefaultBackoff      = 100 * time.Millisecond
+	DefaultMaxBackoff   = 10 * time.Second
+)
+
+// Sink receives pages of events. Write must not return until the events are
+// durably stored, since the cursor is saved right after.
+type Sink interface {
+	Write(ctx context.Context, shardID int, events []changefeed.Event) error
+}
+
+// CursorStore persists the ULID of the last event relayed for each shard.
+type CursorStore interface {
+	LoadCursor(ctx context.Context, shardID int) (ulid.ULID, error)
+	SaveCursor(ctx context.Context, shardID int, cursor ulid.ULID) error
+}
+
+// DeadLetterStore records events that could not be written to the Sink;
+// changefeed.DeadLetterStore stores them in [deadletter:<table>].
+type DeadLetterStore interface {
+	DeadLetter(ctx context.Context, shardID int, event changefeed.Event, cause error, attempts int) error
+}
+
+var _ DeadLetterStore = &changefeed.DeadLetterStore{}
+
+// DeadLetterPolicy decides when the Relay gives up on events.
+type DeadLetterPolicy struct {
+	// Retries is how many times a failed write is retried, first for the
+	// whole page and then for each event on its own, before the event is
+	// dead-lettered
+	Retries int
+	// Backoff is the wait before the first retry, doubled for every retry after
+	// it up to MaxBackoff; defaults to DefaultBackoff and DefaultMaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Store      DeadLetterStore
+}
+
+func (p *DeadLetterPolicy) backoff(retry int) time.Duration {
+	backoff, maxBackoff := p.Backoff, p.MaxBackoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+type Relay struct {
+	Reader  changefeed.Reader
+	Sink    Sink
+	Cursors CursorStore
+	ShardID int
+	// PageSize passed to Reader.ReadPage; defaults to DefaultPageSize
+	PageSize int
+	// PollInterval is how long Run waits after reaching the head of the feed;
+	// defaults to DefaultPollInterval
+	PollInterval time.Duration
+	// DeadLetters is the policy for events the Sink fails to write; when nil,
+	// a failed write is returned from RunOnce and the cursor is not moved
+	DeadLetters *DeadLetterPolicy
+}
+
+func (r *Relay) pageSize() int {
+	if r.PageSize == 0 {
+		return DefaultPageSize
+	}
+	return r.PageSize
+}
+
+func (r *Relay) pollInterval() time.Duration {
+	if r.PollInterval == 0 {
+		return DefaultPollInterval
+	}
+	return r.PollInterval
+}
+
+// RunOnce relays a single page, returning the number of events relayed.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	cursor, err := r.Cursors.LoadCursor(ctx, r.ShardID)
+	if err != nil {
+		return 0, err
+	}
+	events, err := r.Reader.ReadPage(ctx, r.ShardID, cursor, r.pageSize())
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	if err := r.write(ctx, events); err != nil {
+		return 0, err
+	}
+	if err := r.Cursors.SaveCursor(ctx, r.ShardID, events[len(events)-1].ULID); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// write writes a page to the Sink, following the DeadLetters policy
+func (r *Relay) write(ctx context.Context, events []changefeed.Event) error {
+	if r.DeadLetters == nil {
+		return r.Sink.Write(ctx, r.ShardID, events)
+	}
+	attempts, err := r.writeWithRetries(ctx, events)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	for i := range events {
+		if len(events) > 1 {
+			attempts, err = r.writeWithRetries(ctx, events[i:i+1])
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+		}
+		if dlErr := r.DeadLetters.Store.DeadLetter(ctx, r.ShardID, events[i], err, attempts); dlErr != nil {
+			return errors.Join(err, dlErr)
+		}
+	}
+	return nil
+}
+
+// writeWithRetries returns the number of attempts made and the error of the last one
+func (r *Relay) writeWithRetries(ctx context.Context, events []changefeed.Event) (int, error) {
+	attempts := 0
+	for {
+		attempts++
+		err := r.Sink.Write(ctx, r.ShardID, events)
+		if err == nil || attempts > r.DeadLetters.Retries {
+			return attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-time.After(r.DeadLetters.backoff(attempts)):
+		}
+	}
+}
+
+// Run relays pages until ctx is cancelled or an error occurs.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RunOnce(ctx)
+		if err != nil {
+			return err
+		}
+		if n == r.pageSize() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval()):
+		}
+	}
+}
+
+// MemoryCursorStore keeps cursors in memory; useful for tests, or when the
+// sink itself can tell where to resume from.
+type MemoryCursorStore struct {
+	mu      sync.Mutex
+	cursors map[int]ulid.ULID
+}
+
+var _ CursorStore = &MemoryCursorStore{}
+
+func (s *MemoryCursorStore) LoadCursor(ctx context.Context, shardID int) (ulid.ULID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursors[shardID], nil
+}
+
+func (s *MemoryCursorStore) SaveCursor(ctx context.Context, shardID int, cursor ulid.ULID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursors == nil {
+		s.cursors = make(map[int]ulid.ULID)
+	}
+	s.cursors[shardID] = cursor
+	return nil
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+type sliceReader []changefeed.Event
+
+func (r sliceReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) (page []changefeed.Event, err error) {
+	for _, e := range r {
+		if e.ULID.Compare(cursor) > 0 && len(page) < pageSize {
+			page = append(page, e)
+		}
+	}
+	return
+}
+
+func makeEvents(n int) (result []changefeed.Event) {
+	for i := 0; i != n; i++ {
+		var u ulid.ULID
+		u[15] = byte(i + 1)
+		result = append(result, changefeed.Event{ULID: u, Values: map[string]interface{}{"ID": i + 1}})
+	}
+	return
+}
+
+var errPoison = errors.New("poison event")
+
+// poisonSink fails every write containing one of the poison IDs, and the
+// first writes of anything, as many as failures
+type poisonSink struct {
+	poison   map[int]bool
+	failures int
+	writes   int
+	written  []int
+}
+
+func (s *poisonSink) Write(ctx context.Context, shardID int, events []changefeed.Event) error {
+	s.writes++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("temporary failure")
+	}
+	for _, e := range events {
+		if s.poison[e.Values["ID"].(int)] {
+			return errPoison
+		}
+	}
+	for _, e := range events {
+		s.written = append(s.written, e.Values["ID"].(int))
+	}
+	return nil
+}
+
+type deadLetter struct {
+	id       int
+	cause    error
+	attempts int
+}
+
+type memoryDeadLetters []deadLetter
+
+func (m *memoryDeadLetters) DeadLetter(ctx context.Context, shardID int, event changefeed.Event, cause error, attempts int) error {
+	*m = append(*m, deadLetter{event.Values["ID"].(int), cause, attempts})
+	return nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	events := makeEvents(5)
+	sink := &poisonSink{poison: map[int]bool{2: true, 4: true}}
+	var deadLetters memoryDeadLetters
+	cursors := &MemoryCursorStore{}
+	r := &Relay{
+		Reader:  sliceReader(events),
+		Sink:    sink,
+		Cursors: cursors,
+		DeadLetters: &DeadLetterPolicy{
+			Retries: 2,
+			Backoff: time.Millisecond,
+			Store:   &deadLetters,
+		},
+	}
+
+	n, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []int{1, 3, 5}, sink.written)
+	assert.Equal(t, memoryDeadLetters{{2, errPoison, 3}, {4, errPoison, 3}}, deadLetters)
+	// 3 attempts for the page, 1 for each good event and 3 for each poison one
+	assert.Equal(t, 3+3+2*3, sink.writes)
+
+	cursor, err := cursors.LoadCursor(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, events[4].ULID, cursor)
+}
+
+func TestDeadLettersRetrySucceeds(t *testing.T) {
+	ctx := context.Background()
+	sink := &poisonSink{failures: 2}
+	var deadLetters memoryDeadLetters
+	r := &Relay{
+		Reader:      sliceReader(makeEvents(3)),
+		Sink:        sink,
+		Cursors:     &MemoryCursorStore{},
+		DeadLetters: &DeadLetterPolicy{Retries: 2, Backoff: time.Millisecond, Store: &deadLetters},
+	}
+	n, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []int{1, 2, 3}, sink.written)
+	assert.Empty(t, deadLetters)
+}
+
+func TestNoDeadLetterPolicy(t *testing.T) {
+	ctx := context.Background()
+	cursors := &MemoryCursorStore{}
+	r := &Relay{
+		Reader:  sliceReader(makeEvents(3)),
+		Sink:    &poisonSink{poison: map[int]bool{2: true}},
+		Cursors: cursors,
+	}
+	_, err := r.RunOnce(ctx)
+	assert.ErrorIs(t, err, errPoison)
+	cursor, err := cursors.LoadCursor(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, ulid.ULID{}, cursor)
+}
+
+func TestBackoff(t *testing.T) {
+	p := &DeadLetterPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	var backoffs []time.Duration
+	for retry := 1; retry <= 5; retry++ {
+		backoffs = append(backoffs, p.backoff(retry))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, backoffs)
+}
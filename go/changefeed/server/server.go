@@ -0,0 +1,165 @@
+// Package server exposes changefeed feeds over HTTP as server-sent events, so
+// that consumers can follow a feed without having database credentials.
+//
+// A subscription is a GET request to
+//
+//	/feeds/{feed}/shards/{shard}?cursor={ulid}
+//
+// which streams one SSE message per event. The id of each message is the ULID
+// of the event, so a disconnected client can resume by passing it back,
+// either as ?cursor= or in the standard Last-Event-ID header.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+const (
+	DefaultPageSize     = 1000
+	DefaultPollInterval = time.Second
+)
+
+type Server struct {
+	// Feeds maps feed names, as used in the URL, to readers
+	Feeds map[string]changefeed.Reader
+	// PageSize passed to Reader.ReadPage; defaults to DefaultPageSize
+	PageSize int
+	// PollInterval is how long to wait after reaching the head of the feed
+	// before reading again; defaults to DefaultPollInterval
+	PollInterval time.Duration
+
+	muxOnce sync.Once
+	mux     *http.ServeMux
+}
+
+// Message is the JSON payload in the data field of each SSE message.
+type Message struct {
+	ULID   string                 `json:"ulid"`
+	Values map[string]interface{} `json:"values"`
+}
+
+func New(feeds map[string]changefeed.Reader) *Server {
+	return &Server{Feeds: feeds}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.muxOnce.Do(func() {
+		s.mux = http.NewServeMux()
+		s.mux.HandleFunc("GET /feeds/{feed}/shards/{shard}", s.subscribe)
+	})
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) pageSize() int {
+	if s.PageSize == 0 {
+		return DefaultPageSize
+	}
+	return s.PageSize
+}
+
+func (s *Server) pollInterval() time.Duration {
+	if s.PollInterval == 0 {
+		return DefaultPollInterval
+	}
+	return s.PollInterval
+}
+
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	reader, ok := s.Feeds[r.PathValue("feed")]
+	if !ok {
+		http.Error(w, "feed not found", http.StatusNotFound)
+		return
+	}
+	shardID, err := strconv.Atoi(r.PathValue("shard"))
+	if err != nil {
+		http.Error(w, "shard must be an integer", http.StatusBadRequest)
+		return
+	}
+	cursor, err := parseCursor(r)
+	if err != nil {
+		http.Error(w, "invalid cursor: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = s.stream(r.Context(), reader, shardID, cursor, func(msg string) error {
+		if _, err := fmt.Fprint(w, msg); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		// Headers are already sent, so report the error in-band and end the stream
+		_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", jsonString(err.Error()))
+		flusher.Flush()
+	}
+}
+
+// stream reads pages from the feed until ctx is cancelled, passing each
+// formatted SSE message to write.
+func (s *Server) stream(ctx context.Context, reader changefeed.Reader, shardID int, cursor ulid.ULID, write func(string) error) error {
+	for {
+		events, err := reader.ReadPage(ctx, shardID, cursor, s.pageSize())
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			data, err := json.Marshal(Message{ULID: e.ULID.String(), Values: e.Values})
+			if err != nil {
+				return err
+			}
+			if err := write(fmt.Sprintf("id: %s\nevent: event\ndata: %s\n\n", e.ULID, data)); err != nil {
+				return err
+			}
+			cursor = e.ULID
+		}
+		if len(events) == s.pageSize() {
+			// Not at the head yet; read the next page right away
+			continue
+		}
+		// A comment line lets us detect clients that have gone away even when the feed is idle
+		if err := write(": idle\n\n"); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pollInterval()):
+		}
+	}
+}
+
+func parseCursor(r *http.Request) (ulid.ULID, error) {
+	s := r.URL.Query().Get("cursor")
+	if s == "" {
+		s = r.Header.Get("Last-Event-ID")
+	}
+	if s == "" {
+		return ulid.ULID{}, nil
+	}
+	return ulid.Parse(s)
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vippsas/mssql-changefeed/go/changefeed"
+)
+
+// sliceReader serves a fixed, growable list of events for shard 0
+type sliceReader struct {
+	mu     sync.Mutex
+	events []changefeed.Event
+}
+
+func (r *sliceReader) ReadPage(ctx context.Context, shardID int, cursor ulid.ULID, pageSize int) ([]changefeed.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var page []changefeed.Event
+	for _, e := range r.events {
+		if shardID == 0 && e.ULID.Compare(cursor) > 0 && len(page) < pageSize {
+			page = append(page, e)
+		}
+	}
+	return page, nil
+}
+
+func (r *sliceReader) add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i != n; i++ {
+		var u ulid.ULID
+		u[15] = byte(len(r.events) + 1)
+		r.events = append(r.events, changefeed.Event{
+			ULID:   u,
+			Values: map[string]interface{}{"AggregateID": len(r.events)},
+		})
+	}
+}
+
+type sseMessage struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readMessages reads n SSE messages (skipping comments) from the stream
+func readMessages(t *testing.T, scanner *bufio.Scanner, n int) (result []sseMessage) {
+	var msg sseMessage
+	for len(result) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if msg != (sseMessage{}) {
+				result = append(result, msg)
+			}
+			msg = sseMessage{}
+		case strings.HasPrefix(line, "id: "):
+			msg.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			msg.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			msg.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return
+}
+
+func subscribe(t *testing.T, ctx context.Context, url string, lastEventID string) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestSubscribe(t *testing.T) {
+	reader := &sliceReader{}
+	reader.add(5)
+
+	srv := New(map[string]changefeed.Reader{"myservice.MyEvent": reader})
+	srv.PageSize = 2
+	srv.PollInterval = 10 * time.Millisecond
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp := subscribe(t, ctx, ts.URL+"/feeds/myservice.MyEvent/shards/0", "")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	messages := readMessages(t, scanner, 5)
+	require.Equal(t, 5, len(messages))
+	for i, msg := range messages {
+		assert.Equal(t, "event", msg.Event)
+		assert.Equal(t, reader.events[i].ULID.String(), msg.ID)
+
+		var parsed Message
+		require.NoError(t, json.Unmarshal([]byte(msg.Data), &parsed))
+		assert.Equal(t, msg.ID, parsed.ULID)
+		assert.Equal(t, float64(i), parsed.Values["AggregateID"])
+	}
+
+	// Events published after reaching the head are picked up by polling
+	reader.add(1)
+	messages = readMessages(t, scanner, 1)
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, reader.events[5].ULID.String(), messages[0].ID)
+}
+
+func TestSubscribeResume(t *testing.T) {
+	reader := &sliceReader{}
+	reader.add(5)
+
+	srv := New(map[string]changefeed.Reader{"myservice.MyEvent": reader})
+	srv.PollInterval = 10 * time.Millisecond
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Using the query parameter
+	resp := subscribe(t, ctx, ts.URL+"/feeds/myservice.MyEvent/shards/0?cursor="+reader.events[2].ULID.String(), "")
+	messages := readMessages(t, bufio.NewScanner(resp.Body), 2)
+	resp.Body.Close()
+	require.Equal(t, 2, len(messages))
+	assert.Equal(t, reader.events[3].ULID.String(), messages[0].ID)
+
+	// Using the Last-Event-ID header that EventSource clients send on reconnect
+	resp = subscribe(t, ctx, ts.URL+"/feeds/myservice.MyEvent/shards/0", reader.events[3].ULID.String())
+	messages = readMessages(t, bufio.NewScanner(resp.Body), 1)
+	resp.Body.Close()
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, reader.events[4].ULID.String(), messages[0].ID)
+}
+
+func TestSubscribeBadRequests(t *testing.T) {
+	srv := New(map[string]changefeed.Reader{"myservice.MyEvent": &sliceReader{}})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/feeds/myservice.Unknown/shards/0", http.StatusNotFound},
+		{"/feeds/myservice.MyEvent/shards/x", http.StatusBadRequest},
+		{"/feeds/myservice.MyEvent/shards/0?cursor=notaulid", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(ts.URL + tc.path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.path)
+	}
+}
@@ -0,0 +1,149 @@
+package changefeed
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+)
+
+// Sharder chooses the shard of an event from the primary key of the row in
+// the source table; key is e.g. OutboxRow.Key or Event.Values. Every
+// Sharder returns the same shards as a function setup_feed generates, so that
+// shard_id can also be computed inside SQL:
+//
+//	ModuloSharder  [changefeed].[shard_modulo:<table>](pk..., @n)
+//	JumpSharder    [changefeed].[shard:<table>](pk..., @n)
+//
+// The functions take the primary key columns in order of name.
+type Sharder interface {
+	Shard(key map[string]interface{}, n int) (int, error)
+}
+
+// ModuloSharder puts an event in shard KeyHash(key) % n. Changing n moves
+// most keys to another shard.
+type ModuloSharder struct{}
+
+func (ModuloSharder) Shard(key map[string]interface{}, n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid number of shards: %d", n)
+	}
+	hash, err := KeyHash(key)
+	if err != nil {
+		return 0, err
+	}
+	return int(hash % int64(n)), nil
+}
+
+// JumpSharder uses the jump consistent hash of Lamping and Veach over
+// KeyHash(key). When n is increased, the only keys that change shard are those
+// moving to the new shards.
+type JumpSharder struct{}
+
+func (JumpSharder) Shard(key map[string]interface{}, n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid number of shards: %d", n)
+	}
+	hash, err := KeyHash(key)
+	if err != nil {
+		return 0, err
+	}
+	return jumpConsistentHash(uint64(hash), n), nil
+}
+
+// jumpConsistentHash is the same as [changefeed].jump_consistent_hash
+func jumpConsistentHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// KeyHash is the hash of a primary key that the shard is chosen from, the same
+// as [changefeed].key_hash computes in the generated shard functions: the
+// values, in order of column name, are converted to strings like SQL Server
+// converts them to nvarchar and joined by "|", and the first 8 bytes of the
+// SHA-256 of the UTF-16 encoding are taken as a non-negative int64.
+//
+// Supported values are integers and bool; strings, which are hashed case
+// sensitively even if the column collation is not; []byte and ulid.ULID for
+// binary columns; and mssql.UniqueIdentifier for uniqueidentifier columns,
+// which SQL Server converts to uppercase. Strings are hashed as they are, so
+// uniqueidentifier values must not be given as strings. Tables with primary
+// key columns of other types, such as decimal or datetime2, get no shard
+// functions.
+func KeyHash(key map[string]interface{}) (int64, error) {
+	if len(key) == 0 {
+		return 0, fmt.Errorf("empty key")
+	}
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	// like sql_primary_key_columns_joined_by_comma does with a case insensitive collation
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	var parts []string
+	for _, name := range names {
+		s, err := keyString(key[name])
+		if err != nil {
+			return 0, fmt.Errorf("column %s: %w", name, err)
+		}
+		parts = append(parts, s)
+	}
+	codes := utf16.Encode([]rune(strings.Join(parts, "|")))
+	buf := make([]byte, 2*len(codes))
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(buf[2*i:], c)
+	}
+	sum := sha256.Sum256(buf)
+	return int64(binary.BigEndian.Uint64(sum[:8]) & (1<<63 - 1)), nil
+}
+
+// keyString converts v like convert(nvarchar(max), v) does, with style 2 for binary values
+func keyString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int8:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case string:
+		return v, nil
+	case []byte:
+		return strings.ToUpper(hex.EncodeToString(v)), nil
+	case ulid.ULID:
+		return strings.ToUpper(hex.EncodeToString(v[:])), nil
+	case mssql.UniqueIdentifier:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T for shard key", v)
+	}
+}
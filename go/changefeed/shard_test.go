@@ -0,0 +1,135 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyHash(t *testing.T) {
+	// sha256 of the UTF-16LE encoding of "1|2"; columns are in order of name, ignoring case
+	hash, err := KeyHash(map[string]interface{}{"version": int32(2), "AggregateID": int64(1)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3541466824782995253), hash)
+
+	// ... of "ABCD|x"
+	hash, err = KeyHash(map[string]interface{}{"ID": []byte{0xab, 0xcd}, "Tenant": "x"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2788597889679962819), hash)
+
+	u := mssql.UniqueIdentifier{0xde, 0xad, 0xbe, 0xef}
+	s, err := keyString(u)
+	require.NoError(t, err)
+	assert.Equal(t, "DEADBEEF-0000-0000-0000-000000000000", s)
+	// strings are hashed verbatim, like convert(nvarchar(max), ...) leaves character columns
+	s, err = keyString("deadbeef-0000-0000-0000-00000000000a")
+	require.NoError(t, err)
+	assert.Equal(t, "deadbeef-0000-0000-0000-00000000000a", s)
+
+	_, err = KeyHash(map[string]interface{}{"Amount": 1.5})
+	assert.Error(t, err)
+	_, err = KeyHash(nil)
+	assert.Error(t, err)
+}
+
+func TestJumpSharder(t *testing.T) {
+	var sharder Sharder = JumpSharder{}
+	_, err := sharder.Shard(map[string]interface{}{"ID": 1}, 0)
+	assert.Error(t, err)
+
+	// When going from n to n+1 shards, keys either stay or move to the new shard
+	counts := make([]int, 10)
+	for i := 0; i != 1000; i++ {
+		key := map[string]interface{}{"ID": i}
+		previous := 0
+		for n := 1; n <= 10; n++ {
+			shard, err := sharder.Shard(key, n)
+			require.NoError(t, err)
+			require.True(t, shard == previous || shard == n-1, "key %d moved from %d to %d with %d shards", i, previous, shard, n)
+			previous = shard
+		}
+		counts[previous]++
+	}
+	for shard, count := range counts {
+		assert.InDelta(t, 100, count, 40, "shard %d", shard)
+	}
+	assert.Equal(t, 0, jumpConsistentHash(12345, 1))
+}
+
+func TestModuloSharder(t *testing.T) {
+	key := map[string]interface{}{"AggregateID": int64(1), "Version": 2}
+	shard, err := ModuloSharder{}.Shard(key, 7)
+	require.NoError(t, err)
+	assert.Equal(t, int(3541466824782995253%7), shard)
+	_, err = ModuloSharder{}.Shard(key, -1)
+	assert.Error(t, err)
+}
+
+// TestShardSQL checks that the generated shard functions agree with the sharders
+func TestShardSQL(t *testing.T) {
+	ctx := context.Background()
+	const table = "myservice.TestShard"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, table, Outbox))
+
+	for i := 0; i != 200; i++ {
+		var id ulid.ULID
+		binary.BigEndian.PutUint64(id[8:], uint64(i)*0x9e3779b97f4a7c15)
+		key := map[string]interface{}{
+			"Tenant":      fmt.Sprintf("tenant-ÆØÅ-%d", i%7),
+			"AggregateID": int64(i) * 1000003,
+			"ID":          id,
+		}
+		for _, n := range []int{1, 2, 3, 16, 100} {
+			var jump, modulo int
+			// the parameters are in order of column name: AggregateID, ID, Tenant
+			err := fixture.ReadUserDB.QueryRowContext(ctx,
+				`select [changefeed].[shard:myservice.TestShard](@p1, @p2, @p3, @p4), [changefeed].[shard_modulo:myservice.TestShard](@p1, @p2, @p3, @p4)`,
+				key["AggregateID"], id[:], key["Tenant"], n).Scan(&jump, &modulo)
+			require.NoError(t, err)
+
+			expected, err := JumpSharder{}.Shard(key, n)
+			require.NoError(t, err)
+			assert.Equal(t, expected, jump, "shard of %v with %d shards", key, n)
+			expected, err = ModuloSharder{}.Shard(key, n)
+			require.NoError(t, err)
+			assert.Equal(t, expected, modulo, "shard_modulo of %v with %d shards", key, n)
+		}
+	}
+
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, table, TeardownOptions{}))
+
+	// The sharders cannot hash a decimal like SQL Server converts it, so no shard
+	// functions are generated
+	const unsupported = "myservice.TestShardUnsupported"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, unsupported, Outbox))
+	var exists bool
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx,
+		`select iif(object_id(@p1) is null and object_id(@p2) is null, 0, 1)`,
+		feedObjectName("", "shard", unsupported), feedObjectName("", "shard_modulo", unsupported)).Scan(&exists))
+	assert.False(t, exists)
+	diffs, err := Verify(ctx, fixture.AdminDB, unsupported)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, unsupported, TeardownOptions{}))
+
+	const guidTable = "myservice.TestShardGuid"
+	require.NoError(t, SetupFeed(ctx, fixture.AdminDB, guidTable, Outbox))
+	// A uniqueidentifier is uppercased by SQL Server, while a varchar holding a
+	// lowercase GUID is hashed as it is; the parameters are in order Code, ID
+	for _, id := range []string{"0a1b2c3d-4e5f-6789-abcd-ef0123456789", "FFFFFFFF-0000-0000-0000-00000000000f"} {
+		key := map[string]interface{}{"Code": id, "ID": guid(id)}
+		var jump int
+		require.NoError(t, fixture.ReadUserDB.QueryRowContext(ctx,
+			`select [changefeed].[shard:myservice.TestShardGuid](@p1, @p2, 1000)`, key["Code"], key["ID"]).Scan(&jump))
+		expected, err := JumpSharder{}.Shard(key, 1000)
+		require.NoError(t, err)
+		assert.Equal(t, expected, jump, id)
+	}
+	require.NoError(t, TeardownFeed(ctx, fixture.AdminDB, guidTable, TeardownOptions{}))
+}
@@ -2,10 +2,8 @@
 create schema myservice;
 
 go
-create user myuser with password = 'UserPw1234';
+-- myuser and myreaduser are created by the test fixture
 grant select, insert on schema::myservice to myuser;
-
-create user myreaduser with password = 'UserPw1234';
 grant select, insert on schema::myservice to myreaduser;
 
 go
@@ -61,3 +59,148 @@ create table myservice.TestSerializeWriters (
     Data varchar(max) not null,
 );
 
+
+create table myservice.TestOutboxReader (
+    AggregateID bigint not null,
+    Version int not null,
+    Data varchar(max) not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestBlockingReader (
+    Shard int not null,
+    ULID binary(16) not null,
+    Data varchar(max) not null,
+    primary key (Shard, ULID)
+);
+
+create table myservice.TestOutboxWriter (
+    AggregateID bigint not null,
+    Version int not null,
+    Data varchar(max) not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestBlockingWriter (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
+
+create table myservice.TestInstall (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestTeardownOutbox (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestTeardownBlocking (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
+
+create table myservice.TestVerifyOutbox (
+    AggregateID bigint not null,
+    Version int not null,
+    Tenant varchar(10) not null default 'a',
+    constraint [pk:TestVerifyOutbox] primary key (AggregateID, Version)
+);
+
+create table myservice.TestVerifyBlocking (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
+
+create table myservice.TestMigratePrimaryKey (
+    AggregateID bigint not null,
+    Version int not null,
+    Tenant varchar(10) not null,
+    constraint [pk:TestMigratePrimaryKey] primary key (AggregateID, Version)
+);
+
+create table myservice.TestFeedsRegistry (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestRenderSetup (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestGrants (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestUpgradeSignature (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestDeadLetter (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestErrors (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestShardBusy (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
+
+create table myservice.TestWatchdog (
+    ULID binary(16) not null primary key,
+    Data varchar(max) not null
+);
+
+create table myservice.TestOutboxTrigger (
+    AggregateID bigint not null,
+    Version int not null,
+    Created datetime2(3) not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.TestShard (
+    Tenant nvarchar(20) not null,
+    AggregateID bigint not null,
+    ID binary(16) not null,
+    primary key (Tenant, AggregateID, ID)
+);
+
+create table myservice.TestShardUnsupported (
+    Amount decimal(10, 2) not null,
+    primary key (Amount)
+);
+
+create table myservice.TestShardGuid (
+    Code varchar(36) not null,
+    ID uniqueidentifier not null,
+    primary key (Code, ID)
+);
+
+create table myservice.TestPublishMany (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
+
+create table myservice.BenchmarkPublish (
+    AggregateID bigint not null,
+    Version int not null,
+    primary key (AggregateID, Version)
+);
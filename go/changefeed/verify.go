@@ -0,0 +1,276 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/vippsas/mssql-changefeed/go/changefeed/internal/sqlutil"
+)
+
+// Difference is a mismatch between an object created by setup_feed and what
+// the installed library would generate for the table now.
+type Difference struct {
+	// Object is the quoted name of the object, e.g. [changefeed].[outbox:myservice.MyEvent]
+	Object  string
+	Message string
+}
+
+func (d Difference) String() string {
+	return d.Object + ": " + d.Message
+}
+
+// generatedTables are checked by creating them in a scratch schema and comparing columns
+var generatedTables = []struct {
+	kind, generator string
+	outbox          bool
+	isType          bool
+	// name returns the name of the object, if it is not feedObjectName(schema, kind, table)
+	name func(schema, table string) string
+}{
+	{kind: "state", generator: "sql_create_state_table"},
+	{kind: "feed", generator: "sql_create_feed_table", outbox: true},
+	{kind: "outbox", generator: "sql_create_outbox_table", outbox: true},
+	{kind: "type:read", generator: "sql_create_read_type", outbox: true, isType: true},
+	{kind: "outbox_type", generator: "sql_create_outbox_type", outbox: true, isType: true, name: outboxTypeName},
+	{kind: "deadletter", generator: "sql_create_deadletter_table"},
+}
+
+// generatedCode is checked by comparing the definition text. If condition is
+// set, it names a function of the object_id of the table that is 0 when the
+// object is not generated, and the object should not exist.
+var generatedCode = []struct {
+	kind, generator  string
+	outbox, blocking bool
+	condition        string
+}{
+	{kind: "feed_write_lock", generator: "sql_create_feed_write_lock_procedure", outbox: true, blocking: true},
+	{kind: "update_state", generator: "sql_create_update_state_procedure", outbox: true, blocking: true},
+	{kind: "read_feed", generator: "sql_create_read_procedure", outbox: true},
+	{kind: "read_feed_rs", generator: "sql_create_read_result_set_procedure", outbox: true},
+	{kind: "publish", generator: "sql_create_publish_procedure", outbox: true},
+	{kind: "lock", generator: "sql_create_lock_procedure", blocking: true},
+	{kind: "shard", generator: "sql_create_shard_function", outbox: true, blocking: true, condition: "sql_shard_key_supported"},
+	{kind: "shard_modulo", generator: "sql_create_shard_modulo_function", outbox: true, blocking: true, condition: "sql_shard_key_supported"},
+}
+
+// Verify compares the tables, types, procedures and functions set up for a
+// feed against what the sql_create_* functions of the installed library
+// generate now, and returns every difference found. For instance, a column
+// added to the primary key of the source table after setup_feed shows up as
+// missing columns in [outbox:*] and [feed:*], and as outdated procedures.
+//
+// Tables are compared by generating them in a temporary schema inside a
+// transaction that is rolled back, so db must be allowed to create schemas.
+func Verify(ctx context.Context, db *sql.DB, table string, opts ...Option) (diffs []Difference, err error) {
+	schema := newOptions(opts).schema
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var objectID sql.NullInt64
+	var unquoted sql.NullString
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`select object_id(@p1, 'U'), %s.sql_unquoted_qualified_table_name(object_id(@p1, 'U'))`, schemaName(schema)), table).
+		Scan(&objectID, &unquoted)
+	if err != nil {
+		return nil, err
+	}
+	if !objectID.Valid {
+		return nil, fmt.Errorf("%w: table %s does not exist", ErrFeedNotFound, table)
+	}
+
+	objectExists := func(name string) (bool, error) {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `select iif(object_id(@p1) is null, 0, 1)`, name).Scan(&exists)
+		return exists, err
+	}
+	outbox, err := objectExists(feedObjectName(schema, "read_feed", unquoted.String))
+	if err != nil {
+		return nil, err
+	}
+	blocking, err := objectExists(feedObjectName(schema, "lock", unquoted.String))
+	if err != nil {
+		return nil, err
+	}
+	if !outbox && !blocking {
+		return nil, fmt.Errorf("%w: no feed set up for %s", ErrFeedNotFound, table)
+	}
+
+	scratch := "changefeed_verify_" + sqlutil.RandomHex(8)
+	if _, err := tx.ExecContext(ctx, `exec ('create schema ' + @p1)`, sqlutil.QuoteName(scratch)); err != nil {
+		return nil, fmt.Errorf("creating scratch schema: %w", err)
+	}
+
+	for _, gt := range generatedTables {
+		if gt.outbox && !outbox {
+			continue
+		}
+		objectName := func(schema, table string) string { return feedObjectName(schema, gt.kind, table) }
+		if gt.name != nil {
+			objectName = gt.name
+		}
+		live := objectName(schema, unquoted.String)
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`declare @sql nvarchar(max) = %s.%s(@p1, @p2); exec sp_executesql @sql;`, schemaName(schema), gt.generator),
+			objectID.Int64, scratch)
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %w", live, err)
+		}
+		liveColumns, err := queryColumns(ctx, tx, live, gt.isType)
+		if err != nil {
+			return nil, err
+		}
+		if liveColumns == nil {
+			diffs = append(diffs, Difference{Object: live, Message: "missing"})
+			continue
+		}
+		expectedColumns, err := queryColumns(ctx, tx, objectName(scratch, unquoted.String), gt.isType)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, compareColumns(live, liveColumns, expectedColumns)...)
+	}
+
+	for _, gc := range generatedCode {
+		if !(gc.outbox && outbox || gc.blocking && blocking) {
+			continue
+		}
+		name := feedObjectName(schema, gc.kind, unquoted.String)
+		generated := true
+		if gc.condition != "" {
+			err := tx.QueryRowContext(ctx, fmt.Sprintf(`select %s.%s(@p1)`, schemaName(schema), gc.condition), objectID.Int64).Scan(&generated)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var live, expected sql.NullString
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(`select object_definition(object_id(@p1)), %s.%s(@p2, @p3)`, schemaName(schema), gc.generator),
+			name, objectID.Int64, schema).Scan(&live, &expected)
+		if err != nil {
+			return nil, err
+		}
+		if !generated {
+			if live.Valid {
+				diffs = append(diffs, Difference{Object: name, Message: "should not exist for this primary key; run upgrade_feed"})
+			}
+			continue
+		}
+		diffs = append(diffs, compareDefinitions(name, live, expected)...)
+	}
+
+	if blocking {
+		name := feedObjectName(schema, "ulid", unquoted.String)
+		var live, expected sql.NullString
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(`select object_definition(object_id(@p1)), %s.sql_create_ulid_function(@p2, @p1)`, schemaName(schema)),
+			name, unquoted.String).Scan(&live, &expected)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, compareDefinitions(name, live, expected)...)
+	}
+	return diffs, nil
+}
+
+type column struct {
+	Name      string
+	Type      string
+	MaxLength int
+	Precision int
+	Scale     int
+	Collation string
+	Nullable  bool
+	// KeyOrdinal is the position in the primary key, or 0 if not part of it
+	KeyOrdinal int
+}
+
+func (c column) typeString() string {
+	s := fmt.Sprintf("%s(%d,%d,%d)", c.Type, c.MaxLength, c.Precision, c.Scale)
+	if c.Collation != "" {
+		s += " collate " + c.Collation
+	}
+	if c.Nullable {
+		s += " null"
+	} else {
+		s += " not null"
+	}
+	return s
+}
+
+// queryColumns returns the columns of a table or table type, or nil if it does not exist
+func queryColumns(ctx context.Context, tx *sql.Tx, name string, isType bool) ([]column, error) {
+	objectID := `object_id(@p1, 'U')`
+	if isType {
+		objectID = `(select type_table_object_id from sys.table_types where user_type_id = type_id(@p1))`
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+declare @object_id int = %s;
+select c.name, type_name(c.user_type_id), c.max_length, c.precision, c.scale,
+    isnull(c.collation_name, ''), c.is_nullable, isnull(ic.key_ordinal, 0)
+from sys.columns c
+left join sys.indexes i on i.object_id = c.object_id and i.is_primary_key = 1
+left join sys.index_columns ic on ic.object_id = i.object_id and ic.index_id = i.index_id and ic.column_id = c.column_id
+where c.object_id = @object_id
+order by c.column_id
+`, objectID), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.Name, &c.Type, &c.MaxLength, &c.Precision, &c.Scale, &c.Collation, &c.Nullable, &c.KeyOrdinal); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+func compareColumns(object string, live, expected []column) (diffs []Difference) {
+	report := func(format string, args ...interface{}) {
+		diffs = append(diffs, Difference{Object: object, Message: fmt.Sprintf(format, args...)})
+	}
+	liveByName := make(map[string]column, len(live))
+	for _, c := range live {
+		liveByName[strings.ToLower(c.Name)] = c
+	}
+	expectedByName := make(map[string]column, len(expected))
+	for _, e := range expected {
+		expectedByName[strings.ToLower(e.Name)] = e
+		c, ok := liveByName[strings.ToLower(e.Name)]
+		switch {
+		case !ok:
+			report("missing column %s %s", sqlutil.QuoteName(e.Name), e.typeString())
+		case c.typeString() != e.typeString():
+			report("column %s is %s, expected %s", sqlutil.QuoteName(e.Name), c.typeString(), e.typeString())
+		case c.KeyOrdinal != e.KeyOrdinal:
+			report("column %s has primary key position %d, expected %d", sqlutil.QuoteName(e.Name), c.KeyOrdinal, e.KeyOrdinal)
+		}
+	}
+	for _, c := range live {
+		if _, ok := expectedByName[strings.ToLower(c.Name)]; !ok {
+			report("unexpected column %s %s", sqlutil.QuoteName(c.Name), c.typeString())
+		}
+	}
+	return
+}
+
+func compareDefinitions(object string, live, expected sql.NullString) []Difference {
+	switch {
+	case !live.Valid:
+		return []Difference{{Object: object, Message: "missing"}}
+	case !expected.Valid:
+		return []Difference{{Object: object, Message: "could not be generated"}}
+	case normalizeSQL(live.String) != normalizeSQL(expected.String):
+		return []Difference{{Object: object, Message: "definition differs from what the installed library generates; run upgrade_feed"}}
+	}
+	return nil
+}
+
+// normalizeSQL ignores differences in whitespace
+func normalizeSQL(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
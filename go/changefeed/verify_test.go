@@ -0,0 +1,85 @@
+package changefeed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyOutbox(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed 'myservice.TestVerifyOutbox', @outbox = 1`)
+	require.NoError(t, err)
+
+	diffs, err := Verify(ctx, fixture.AdminDB, "myservice.TestVerifyOutbox")
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// Add a column to the primary key of the source table after setup_feed
+	_, err = fixture.AdminDB.ExecContext(ctx, `
+alter table myservice.TestVerifyOutbox drop constraint [pk:TestVerifyOutbox];
+alter table myservice.TestVerifyOutbox add constraint [pk:TestVerifyOutbox] primary key (AggregateID, Version, Tenant);
+`)
+	require.NoError(t, err)
+
+	diffs, err = Verify(ctx, fixture.AdminDB, "myservice.TestVerifyOutbox")
+	require.NoError(t, err)
+	var collation string
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, `select convert(nvarchar(max), databasepropertyex(db_name(), 'collation'))`).Scan(&collation))
+	expectedMissing := "missing column [Tenant] varchar(10,0,0) collate " + collation + " not null"
+	assert.Equal(t, []Difference{
+		{Object: "[changefeed].[feed:myservice.TestVerifyOutbox]", Message: expectedMissing},
+		{Object: "[changefeed].[outbox:myservice.TestVerifyOutbox]", Message: expectedMissing},
+		{Object: "[changefeed].[type:read:myservice.TestVerifyOutbox]", Message: expectedMissing},
+		{Object: "[changefeed].[outbox_type:myservice:TestVerifyOutbox]", Message: expectedMissing},
+		{Object: "[changefeed].[deadletter:myservice.TestVerifyOutbox]", Message: expectedMissing},
+		{Object: "[changefeed].[read_feed:myservice.TestVerifyOutbox]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+		{Object: "[changefeed].[read_feed_rs:myservice.TestVerifyOutbox]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+		{Object: "[changefeed].[publish:myservice.TestVerifyOutbox]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+		{Object: "[changefeed].[shard:myservice.TestVerifyOutbox]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+		{Object: "[changefeed].[shard_modulo:myservice.TestVerifyOutbox]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+	}, diffs)
+
+	// The scratch schema used for comparing tables is rolled back
+	var scratchSchemas int
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, `select count(*) from sys.schemas where name like 'changefeed[_]verify[_]%'`).Scan(&scratchSchemas))
+	assert.Equal(t, 0, scratchSchemas)
+}
+
+func TestVerifyBlocking(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `exec [changefeed].setup_feed 'myservice.TestVerifyBlocking', @blocking = 1`)
+	require.NoError(t, err)
+
+	diffs, err := Verify(ctx, fixture.AdminDB, "myservice.TestVerifyBlocking")
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	_, err = fixture.AdminDB.ExecContext(ctx, `
+create or alter function [changefeed].[ulid:myservice.TestVerifyBlocking](@i bigint) returns binary(16)
+as begin
+    return null
+end`)
+	require.NoError(t, err)
+	diffs, err = Verify(ctx, fixture.AdminDB, "myservice.TestVerifyBlocking")
+	require.NoError(t, err)
+	assert.Equal(t, []Difference{
+		{Object: "[changefeed].[ulid:myservice.TestVerifyBlocking]", Message: "definition differs from what the installed library generates; run upgrade_feed"},
+	}, diffs)
+
+	_, err = fixture.AdminDB.ExecContext(ctx, `exec [changefeed].upgrade_feed 'myservice.TestVerifyBlocking', @blocking = 1`)
+	require.NoError(t, err)
+	diffs, err = Verify(ctx, fixture.AdminDB, "myservice.TestVerifyBlocking")
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestVerifyNotAFeed(t *testing.T) {
+	_, err := Verify(context.Background(), fixture.AdminDB, "myservice.MyTable")
+	assert.ErrorContains(t, err, "no feed set up")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+	_, err = Verify(context.Background(), fixture.AdminDB, "myservice.DoesNotExist")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+}
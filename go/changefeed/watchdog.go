@@ -0,0 +1,212 @@
+package changefeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultIdleAfter is how long a session holding a feed lock may be idle
+// before the Watchdog reports it.
+const DefaultIdleAfter = 30 * time.Second
+
+// IdleSession is a session that is idle inside a transaction while holding a
+// lock on a feed, blocking other writers to the shard; typically a client
+// that lost its connection, or power, before ending its transaction.
+type IdleSession struct {
+	SessionID      int
+	Login          string
+	Host           string
+	Program        string
+	LastRequestEnd time.Time
+	Idle           time.Duration
+	// Resources are the feed locks held: the name of a [state:<table>] table
+	// the session has locked a row in, for blocking feeds and for outbox feeds
+	// while read_feed runs, or the changefeed/<object_id>/<shard> applock of
+	// [feed_write_lock:<table>]
+	Resources []string
+	// Killed is set if the Watchdog killed the session
+	Killed bool
+	// KillError is the reason a session that should be killed was not
+	KillError error
+}
+
+// Watchdog finds sessions that have been idle for longer than IdleAfter
+// while holding a feed lock, and optionally kills them. Every session found
+// is recorded in [changefeed].watchdog_log.
+//
+// The Watchdog needs the VIEW SERVER STATE permission to see the sessions and
+// locks of other logins, and ALTER ANY CONNECTION to kill them.
+type Watchdog struct {
+	DB *sql.DB
+	// Schema is the changefeed schema; defaults to DefaultSchema
+	Schema string
+	// IdleAfter defaults to DefaultIdleAfter
+	IdleAfter time.Duration
+	// Kill kills the sessions found, rolling back their transactions
+	Kill bool
+	// Report, if set, is called by Run for every session found
+	Report func(IdleSession)
+}
+
+func NewWatchdog(db *sql.DB, opts ...Option) *Watchdog {
+	return &Watchdog{DB: db, Schema: newOptions(opts).schema}
+}
+
+func (w *Watchdog) schema() string {
+	if w.Schema == "" {
+		return DefaultSchema
+	}
+	return w.Schema
+}
+
+func (w *Watchdog) idleAfter() time.Duration {
+	if w.IdleAfter == 0 {
+		return DefaultIdleAfter
+	}
+	return w.IdleAfter
+}
+
+// Check looks for idle sessions holding feed locks once, kills them if Kill
+// is set, and records them in the audit log.
+func (w *Watchdog) Check(ctx context.Context) ([]IdleSession, error) {
+	sessions, err := w.find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("finding idle sessions: %w", err)
+	}
+	for i := range sessions {
+		s := &sessions[i]
+		if w.Kill {
+			s.Killed, s.KillError = w.kill(ctx, s)
+		}
+		if err := w.audit(ctx, s); err != nil {
+			return sessions, fmt.Errorf("recording session %d in watchdog_log: %w", s.SessionID, err)
+		}
+	}
+	return sessions, nil
+}
+
+// Run calls Check every interval until ctx is cancelled or an error occurs.
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		sessions, err := w.Check(ctx)
+		if err != nil {
+			return err
+		}
+		if w.Report != nil {
+			for _, s := range sessions {
+				w.Report(s)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (w *Watchdog) find(ctx context.Context) ([]IdleSession, error) {
+	// Applocks are described as e.g. "0:[changefeed/1234/0]:(8194443284a0)"
+	rows, err := w.DB.QueryContext(ctx, `
+select
+    s.session_id,
+    s.login_name,
+    isnull(s.host_name, ''),
+    isnull(s.program_name, ''),
+    s.last_request_end_time,
+    datediff_big(millisecond, s.last_request_end_time, getdate()) as idle_ms,
+    case l.resource_type
+        when 'KEY' then concat(quotename(object_schema_name(p.object_id)), '.', quotename(object_name(p.object_id)))
+        else substring(l.resource_description,
+            charindex('[', l.resource_description) + 1,
+            charindex(']', l.resource_description) - charindex('[', l.resource_description) - 1)
+    end as resource
+from sys.dm_tran_locks as l
+join sys.dm_exec_sessions as s on s.session_id = l.request_session_id
+left join sys.partitions as p on l.resource_type = 'KEY' and p.hobt_id = l.resource_associated_entity_id
+where l.resource_database_id = db_id()
+    and l.request_status = 'GRANT'
+    and s.session_id <> @@spid
+    and s.status = 'sleeping'
+    and datediff_big(millisecond, s.last_request_end_time, getdate()) > @idle_ms
+    and exists (select 1 from sys.dm_tran_session_transactions as t where t.session_id = s.session_id)
+    and (
+        (l.resource_type = 'KEY' and l.request_mode in ('U', 'X')
+            and object_schema_name(p.object_id) = @schema and object_name(p.object_id) like 'state:%')
+        or (l.resource_type = 'APPLICATION' and l.resource_description like '%[[]changefeed/%')
+    )
+order by s.session_id, resource;
+`, sql.Named("idle_ms", w.idleAfter().Milliseconds()), sql.Named("schema", w.schema()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []IdleSession
+	for rows.Next() {
+		var s IdleSession
+		var idleMs int64
+		var resource string
+		if err := rows.Scan(&s.SessionID, &s.Login, &s.Host, &s.Program, &s.LastRequestEnd, &idleMs, &resource); err != nil {
+			return nil, err
+		}
+		if n := len(result); n > 0 && result[n-1].SessionID == s.SessionID {
+			if last := &result[n-1]; last.Resources[len(last.Resources)-1] != resource {
+				last.Resources = append(last.Resources, resource)
+			}
+			continue
+		}
+		s.Idle = time.Duration(idleMs) * time.Millisecond
+		s.Resources = []string{resource}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+// kill kills the session, unless it has run a request since it was found
+func (w *Watchdog) kill(ctx context.Context, s *IdleSession) (bool, error) {
+	var killed bool
+	err := w.DB.QueryRowContext(ctx, fmt.Sprintf(`
+if exists (
+    select 1 from sys.dm_exec_sessions
+    where session_id = @session_id and status = 'sleeping'
+        and last_request_end_time = cast(@last_request_end_time as datetime)
+)
+begin
+    kill %d;
+    select cast(1 as bit);
+end
+else
+    select cast(0 as bit);
+`, s.SessionID),
+		sql.Named("session_id", s.SessionID),
+		sql.Named("last_request_end_time", s.LastRequestEnd)).Scan(&killed)
+	if err != nil {
+		return false, err
+	}
+	if !killed {
+		return false, fmt.Errorf("session %d ran a request after it was found idle", s.SessionID)
+	}
+	return true, nil
+}
+
+func (w *Watchdog) audit(ctx context.Context, s *IdleSession) error {
+	var killError interface{}
+	if s.KillError != nil {
+		killError = s.KillError.Error()
+	}
+	_, err := w.DB.ExecContext(ctx, fmt.Sprintf(`
+insert into %s.watchdog_log (session_id, login_name, host_name, program_name, idle_ms, resources, killed, error)
+values (@session_id, @login_name, @host_name, @program_name, @idle_ms, @resources, @killed, @error);`, schemaName(w.Schema)),
+		sql.Named("session_id", s.SessionID),
+		sql.Named("login_name", s.Login),
+		sql.Named("host_name", s.Host),
+		sql.Named("program_name", s.Program),
+		sql.Named("idle_ms", s.Idle.Milliseconds()),
+		sql.Named("resources", strings.Join(s.Resources, "\n")),
+		sql.Named("killed", s.Killed),
+		sql.Named("error", killError))
+	return err
+}
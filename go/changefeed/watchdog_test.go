@@ -0,0 +1,80 @@
+package changefeed
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	_, err := fixture.AdminDB.ExecContext(ctx, `
+exec [changefeed].setup_feed 'myservice.TestWatchdog', @blocking = 1;
+alter role [changefeed.writers:myservice.TestWatchdog] add member myuser;
+`)
+	require.NoError(t, err)
+
+	// A writer that takes the lock and then stops responding
+	conn, err := fixture.UserDB.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	var sessionID int
+	require.NoError(t, tx.QueryRowContext(ctx, `select @@spid`).Scan(&sessionID))
+	_, err = NewBlockingWriter("myservice.TestWatchdog").Lock(ctx, tx, 0, time.Time{})
+	require.NoError(t, err)
+
+	find := func(sessions []IdleSession) *IdleSession {
+		for i := range sessions {
+			if sessions[i].SessionID == sessionID {
+				return &sessions[i]
+			}
+		}
+		return nil
+	}
+
+	watchdog := NewWatchdog(fixture.AdminDB)
+	watchdog.IdleAfter = time.Minute
+	sessions, err := watchdog.Check(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, find(sessions), "not idle for long enough yet")
+
+	time.Sleep(time.Second)
+	watchdog.IdleAfter = 500 * time.Millisecond
+	sessions, err = watchdog.Check(ctx)
+	require.NoError(t, err)
+	s := find(sessions)
+	require.NotNil(t, s)
+	assert.Equal(t, "myuser", s.Login)
+	assert.GreaterOrEqual(t, s.Idle, 500*time.Millisecond)
+	assert.Contains(t, s.Resources, "[changefeed].[state:myservice.TestWatchdog]")
+	assert.False(t, s.Killed)
+
+	watchdog.Kill = true
+	sessions, err = watchdog.Check(ctx)
+	require.NoError(t, err)
+	s = find(sessions)
+	require.NotNil(t, s)
+	assert.True(t, s.Killed)
+	assert.NoError(t, s.KillError)
+
+	// The transaction of the killed session is rolled back, and the shard is free again
+	assert.Error(t, tx.Commit())
+	tx2, err := fixture.UserDB.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	lockCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, err = NewBlockingWriter("myservice.TestWatchdog").Lock(lockCtx, tx2, 0, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, tx2.Commit())
+
+	var logged, killed int
+	require.NoError(t, fixture.AdminDB.QueryRowContext(ctx, `
+select count(*), sum(cast(killed as int)) from [changefeed].watchdog_log where session_id = @p1`, sessionID).Scan(&logged, &killed))
+	assert.Equal(t, 2, logged)
+	assert.Equal(t, 1, killed)
+}
@@ -2,6 +2,50 @@ create schema [changefeed];
 
 go
 
+-- library_version is bumped whenever a change to the generated code requires
+-- upgrade_feed to be run on existing feeds.
+create or alter function [changefeed].library_version()
+returns int
+as begin
+    return 8;
+end
+
+go
+
+-- feeds is a registry of the feeds set up, kept up to date by setup_feed/upgrade_feed,
+-- recording which library_version() generated the procedures of each feed.
+if object_id('[changefeed].feeds', 'U') is null
+create table [changefeed].feeds (
+    object_id int not null,
+    table_name nvarchar(300) not null,  -- unquoted, qualified name; see sql_unquoted_qualified_table_name
+    mode varchar(10) not null,  -- 'outbox' or 'blocking'
+    library_version int not null,
+    created_time datetime2(3) not null,
+    upgraded_time datetime2(3) not null,
+    constraint [pk:feeds] primary key (object_id)
+);
+
+go
+
+-- watchdog_log is the audit log of the Go changefeed.Watchdog, recording every idle
+-- session it found holding a lock on a feed, and whether the session was killed.
+if object_id('[changefeed].watchdog_log', 'U') is null
+create table [changefeed].watchdog_log (
+    id bigint not null identity,
+    logged_time datetime2(3) not null constraint [def:watchdog_log.logged_time] default sysutcdatetime(),
+    session_id int not null,
+    login_name nvarchar(128) not null,
+    host_name nvarchar(128) null,
+    program_name nvarchar(128) null,
+    idle_ms bigint not null,
+    resources nvarchar(max) not null,  -- the feed locks held, separated by newlines
+    killed bit not null,
+    error nvarchar(max) null,  -- why the session could not be killed
+    constraint [pk:watchdog_log] primary key (id)
+);
+
+go
+
 create or alter function [changefeed].sql_unquoted_qualified_table_name(@object_id int)
 returns nvarchar(max)
 as begin
@@ -27,6 +71,21 @@ end
 
 go
 
+-- The table type for [publish:<tablename>] has : instead of . between schema and table, since
+-- go-mssqldb splits the name of a table-valued parameter type on every . in it
+create or alter function [changefeed].sql_outbox_type_name(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    return concat(
+        quotename(@changefeed_schema),
+        '.',
+        quotename(concat('outbox_type:', replace([changefeed].sql_unquoted_qualified_table_name(@object_id), '.', ':'))))
+end
+
+go
+
 create or alter function [changefeed].sql_fully_quoted_name(@object_id int)
 returns nvarchar(max)
 as begin
@@ -44,7 +103,7 @@ create or alter function [changefeed].sql_primary_key_columns_joined_by_comma(
 )
 returns nvarchar(max)
 as begin
-    return (select string_agg(concat(@prefix, col.name), ', ') within group ( order by col.name)
+    return (select string_agg(concat(@prefix, quotename(col.name)), ', ') within group ( order by col.name)
             from sys.tables tab
             inner join sys.indexes pk on tab.object_id = pk.object_id
             inner join sys.index_columns ic on ic.object_id = pk.object_id and ic.index_id = pk.index_id
@@ -72,7 +131,7 @@ as begin
         select
             string_agg(
                 concat(
-                    @prefix, r.name, ' ', r.system_type_name,
+                    @prefix, quotename(r.name), ' ', r.system_type_name,
                     iif(collation_name is not null, concat(' collate ', r.collation_name), ''),
                     ' not null'),
                 concat(',', char(10)))
@@ -184,6 +243,271 @@ end
 
 go
 
+create or alter function [changefeed].sql_create_outbox_type(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @type nvarchar(max) = [changefeed].sql_outbox_type_name(@object_id, @changefeed_schema);
+
+    -- embedded in a string literal in the generated code, so quotes are escaped
+    declare @type_literal nvarchar(max) = replace(@type, '''', '''''');
+
+    -- Also created by upgrade_feed, since it did not exist in earlier versions
+    return concat('if type_id(N''', @type_literal, ''') is null
+create type ', @type, ' as table (
+    ordinal int not null primary key,
+    shard_id int not null,
+    time_hint datetime2(3) not null,
+', [changefeed].sql_primary_key_column_declarations(@object_id, '    '), '
+)');
+end
+
+go
+
+create or alter function [changefeed].sql_create_publish_procedure(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @publish_proc nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('publish:', [changefeed].sql_unquoted_qualified_table_name(@object_id))))
+    declare @sequence nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('sequence:', [changefeed].sql_unquoted_qualified_table_name(@object_id))))
+    declare @pklist nvarchar(max) = [changefeed].sql_primary_key_columns_joined_by_comma(@object_id, N'');
+
+    return concat('create or alter procedure ', @publish_proc, '(
+    @rows ', [changefeed].sql_outbox_type_name(@object_id, @changefeed_schema), ' readonly
+) as begin
+    set nocount on;
+
+    -- order_sequence is taken in the order of ordinal, so that the rows published in
+    -- one call are read from the feed in the order they were passed
+    insert into ', [changefeed].sql_outbox_table_name(@object_id, @changefeed_schema), ' (shard_id, order_sequence, time_hint, ', @pklist, ')
+    select shard_id, next value for ', @sequence, ' over (order by ordinal), time_hint, ', @pklist, '
+    from @rows;
+end
+');
+end
+
+go
+
+create or alter function [changefeed].sql_create_deadletter_table(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @table nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('deadletter:', [changefeed].sql_unquoted_qualified_table_name(@object_id))))
+    declare @pkname nvarchar(max) = quotename(concat('pk:deadletter:', [changefeed].sql_unquoted_qualified_table_name(@object_id)))
+    declare @time_constraint_name nvarchar(max) = quotename(concat('def:deadletter.dead_lettered_time:', [changefeed].sql_unquoted_qualified_table_name(@object_id)))
+
+    -- embedded in a string literal in the generated code, so quotes are escaped
+    declare @table_literal nvarchar(max) = replace(@table, '''', '''''');
+
+    -- Also created by upgrade_feed, since it did not exist in earlier versions
+    return concat('if object_id(N''', @table_literal, ''', ''U'') is null
+create table ', @table, '(
+    shard_id int not null,
+    ulid binary(16) not null,
+', [changefeed].sql_primary_key_column_declarations(@object_id, '    '), ',
+    error nvarchar(max) not null,
+    attempts int not null,
+    dead_lettered_time datetime2(3) not null constraint ', @time_constraint_name, ' default sysutcdatetime(),
+    constraint ', @pkname, ' primary key (shard_id, ulid)
+);
+');
+end
+
+go
+
+create or alter function [changefeed].sql_permissions_deadletter(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @unquoted_qualified_table_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
+
+    declare @role_name nvarchar(max) = concat(@changefeed_schema, '.readers:', @unquoted_qualified_table_name);
+    declare @table nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('deadletter:', @unquoted_qualified_table_name)))
+
+    -- Consumers of outbox feeds record the events they give up on; blocking feeds
+    -- have no readers role, so there permissions are left to the application.
+    return concat('if database_principal_id(N''', replace(@role_name, '''', ''''''), ''') is not null
+    grant select, insert, update, delete on ', @table, ' to ', quotename(@role_name), ';
+');
+end
+
+go
+
+create or alter function [changefeed].sql_create_outbox_trigger(
+    @object_id int,
+    @changefeed_schema nvarchar(max),
+    @shard_expr nvarchar(max),
+    @time_hint_expr nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @unquoted_qualified_table_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
+
+    -- Triggers live in the schema of their table
+    declare @trigger nvarchar(max) = concat(
+            quotename(object_schema_name(@object_id)),
+            '.',
+            quotename(concat(@changefeed_schema, '.outbox:', @unquoted_qualified_table_name)))
+    declare @outbox_table nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('outbox:', @unquoted_qualified_table_name)))
+    declare @columns nvarchar(max) = [changefeed].sql_primary_key_columns_joined_by_comma(@object_id, N'')
+
+    -- @shard_expr and @time_hint_expr are evaluated for each row of inserted, so they
+    -- can refer to the columns of the source table
+    return concat('
+-- Publishes every row inserted into the source table to the feed, so that
+-- publishers do not have to insert into ', @outbox_table, ' themselves.
+create or alter trigger ', @trigger, ' on ', [changefeed].sql_fully_quoted_name(@object_id), '
+after insert
+as begin
+    set nocount on;
+
+    insert into ', @outbox_table, ' (shard_id, time_hint, ', @columns, ')
+    select ', @shard_expr, ', ', @time_hint_expr, ', ', @columns, '
+    from inserted;
+end
+');
+end
+
+go
+
+-- key_hash hashes the key of an event for choosing its shard: the first 8 bytes of the
+-- SHA-256 of the key, as a non-negative bigint. The Go changefeed.KeyHash is the same.
+create or alter function [changefeed].key_hash(@key nvarchar(max))
+returns bigint
+as begin
+    return convert(bigint, substring(hashbytes('SHA2_256', @key), 1, 8)) & 9223372036854775807;
+end
+
+go
+
+-- jump_consistent_hash maps @hash to a shard in 0..@n-1 with the jump consistent hash of
+-- Lamping and Veach; when @n is increased, only the keys that move to the new shards
+-- change shard. The unsigned 64 bit arithmetic is done in decimal(38, 0), and the
+-- rest in float, to get exactly the same results as the Go changefeed.JumpSharder.
+create or alter function [changefeed].jump_consistent_hash(@hash bigint, @n int)
+returns int
+as begin
+    declare @key decimal(38, 0) = @hash;
+    declare @b bigint = -1, @j bigint = 0;
+    while @j < @n
+    begin
+        set @b = @j;
+        set @key = (@key * 2862933555777941757 + 1) % 18446744073709551616;
+        set @j = convert(bigint, (@b + 1) * (convert(float, 2147483648) / (convert(float, @key - @key % 8589934592) / 8589934592 + 1)));
+    end
+    return @b;
+end
+
+go
+
+-- sql_shard_key_supported is 1 if every primary key column has a type that the Go
+-- changefeed.KeyHash converts to the same string as convert(nvarchar(max), ...) does.
+-- For other tables, such as with decimal or date keys, no shard functions are generated.
+create or alter function [changefeed].sql_shard_key_supported(@object_id int)
+returns bit
+as begin
+    return iif(exists (
+        select 1
+        from sys.indexes pk
+        inner join sys.index_columns ic on ic.object_id = pk.object_id and ic.index_id = pk.index_id
+        inner join sys.columns col on pk.object_id = col.object_id and col.column_id = ic.column_id
+        where pk.object_id = @object_id and pk.is_primary_key = 1
+            and type_name(col.system_type_id) not in ('tinyint', 'smallint', 'int', 'bigint', 'bit',
+                'char', 'varchar', 'nchar', 'nvarchar', 'binary', 'varbinary', 'uniqueidentifier')
+    ), 0, 1);
+end
+
+go
+
+-- sql_shard_function generates [shard:<tablename>], or [shard_modulo:<tablename>] if @modulo = 1,
+-- taking the primary key columns in order of name and the number of shards. The key
+-- hashed is the primary key values converted to nvarchar, separated by |; binary
+-- values are converted to hex. If sql_shard_key_supported is 0, it drops the function instead.
+create or alter function [changefeed].sql_shard_function(
+    @object_id int,
+    @changefeed_schema nvarchar(max),
+    @modulo bit
+) returns nvarchar(max)
+as begin
+    declare @function nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat(iif(@modulo = 1, 'shard_modulo:', 'shard:'), [changefeed].sql_unquoted_qualified_table_name(@object_id))))
+
+    if [changefeed].sql_shard_key_supported(@object_id) = 0
+        return concat('-- the primary key has a type changefeed.KeyHash does not support
+drop function if exists ', @function, ';
+');
+
+    declare @qry nvarchar(max) = concat(
+        'select ',
+        [changefeed].sql_primary_key_columns_joined_by_comma(@object_id, N''),
+        ' from ',
+        [changefeed].sql_fully_quoted_name(@object_id))
+
+    declare @params nvarchar(max), @key nvarchar(max), @columns nvarchar(max);
+    select
+        @params = string_agg(concat('@pk', r.column_ordinal, ' ', r.system_type_name), ', ')
+            within group (order by r.column_ordinal),
+        @key = string_agg(concat('convert(nvarchar(max), @pk', r.column_ordinal, iif(r.system_type_name like '%binary%', ', 2', ''), ')'), ' + N''|'' + ')
+            within group (order by r.column_ordinal),
+        @columns = string_agg(quotename(r.name), ', ')
+            within group (order by r.column_ordinal)
+    from sys.dm_exec_describe_first_result_set(@qry, null, 0) r;
+
+    declare @hash nvarchar(max) = concat(quotename(@changefeed_schema), '.key_hash(', @key, ')');
+
+    return concat('create or alter function ', @function, '(', @params, ', @n int)
+returns int
+as begin
+    -- the primary key is ', @columns, '; see changefeed.', iif(@modulo = 1, 'ModuloSharder', 'JumpSharder'), '
+    return ', iif(@modulo = 1,
+        concat(@hash, ' % @n'),
+        concat(quotename(@changefeed_schema), '.jump_consistent_hash(', @hash, ', @n)')), ';
+end
+');
+end
+
+go
+
+create or alter function [changefeed].sql_create_shard_function(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    return [changefeed].sql_shard_function(@object_id, @changefeed_schema, 0);
+end
+
+go
+
+create or alter function [changefeed].sql_create_shard_modulo_function(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    return [changefeed].sql_shard_function(@object_id, @changefeed_schema, 1);
+end
+
+go
+
 create or alter function [changefeed].sql_create_feed_write_lock_procedure(
     @object_id int,
     @changefeed_schema nvarchar(max)
@@ -542,6 +866,48 @@ end
 
 go
 
+create or alter function [changefeed].sql_create_read_result_set_procedure(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+)
+returns nvarchar(max) as begin
+    declare @unquoted_qualified_table_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
+
+    declare @read_feed_proc nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('read_feed:', @unquoted_qualified_table_name)))
+
+    declare @read_feed_rs_proc nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('read_feed_rs:', @unquoted_qualified_table_name)))
+
+    return concat('
+-- read_feed_rs:* returns the page read by read_feed:* as a result set, so that the caller
+-- does not have to create #read in the same session first.
+create or alter procedure ', @read_feed_rs_proc, '(
+    @shard_id int,
+    @cursor binary(16),
+    @pagesize int = 1000
+)
+as begin
+    set nocount on;
+
+    create table #read (
+        ulid binary(16) not null,
+', [changefeed].sql_primary_key_column_declarations(@object_id, '        '), '
+    );
+
+    exec ', @read_feed_proc, ' @shard_id = @shard_id, @cursor = @cursor, @pagesize = @pagesize;
+
+    select * from #read order by ulid;
+end
+');
+end
+
+go
+
 create or alter function [changefeed].sql_create_lock_procedure(
     @object_id int,
     @changefeed_schema nvarchar(max)
@@ -564,9 +930,11 @@ create or alter function [changefeed].sql_create_lock_procedure(
             '.',
             quotename(concat('update_state:', @unquoted_qualified_table_name)))
 
-    declare @session_var_transaction nvarchar(max) = concat('changefeed.transaction_id/', @unquoted_qualified_table_name);
-    declare @session_var_high nvarchar(max) = concat('changefeed.ulid_high/', @unquoted_qualified_table_name);
-    declare @session_var_low nvarchar(max) = concat('changefeed.ulid_low/', @unquoted_qualified_table_name);
+    -- these are embedded in string literals in the generated code, so quotes are escaped
+    declare @session_var_transaction nvarchar(max) = replace(concat('changefeed.transaction_id/', @unquoted_qualified_table_name), '''', '''''');
+    declare @session_var_high nvarchar(max) = replace(concat('changefeed.ulid_high/', @unquoted_qualified_table_name), '''', '''''');
+    declare @session_var_low nvarchar(max) = replace(concat('changefeed.ulid_low/', @unquoted_qualified_table_name), '''', '''''');
+    declare @lock_proc_literal nvarchar(max) = replace(@lock_proc, '''', '''''');
 
     return concat('create or alter procedure ', @lock_proc, '(
     @shard_id int = 0,
@@ -574,11 +942,16 @@ create or alter function [changefeed].sql_create_lock_procedure(
     @session_context bit = 1,
     @ulid_high binary(8) = null output,
     @ulid_low bigint = null output,
-    @ulid binary(16) = null output
+    @ulid binary(16) = null output,
+    @lock_timeout_ms int = null
 ) as begin
     set xact_abort, nocount on;
     begin try
-        if @@trancount = 0 throw 77100, ''', @lock_proc, ': please call inside a transaction'', 0;
+        if @@trancount = 0 throw 77100, ''', @lock_proc_literal, ': please call inside a transaction'', 0;
+
+        -- Fail with error 1222 instead of waiting for a writer that does not finish its
+        -- transaction; lock_timeout is restored when the procedure returns.
+        if @lock_timeout_ms is not null set lock_timeout @lock_timeout_ms;
 
         if @time_hint is null set @time_hint = sysutcdatetime();
 
@@ -627,9 +1000,10 @@ create or alter function [changefeed].sql_create_ulid_function(
 )
     returns nvarchar(max) as begin
 
-    declare @session_var_transaction nvarchar(max) = concat('changefeed.transaction_id/', @feed_name);
-    declare @session_var_high nvarchar(max) = concat('changefeed.ulid_high/', @feed_name);
-    declare @session_var_low nvarchar(max) = concat('changefeed.ulid_low/', @feed_name);
+    -- these are embedded in string literals in the generated code, so quotes are escaped
+    declare @session_var_transaction nvarchar(max) = replace(concat('changefeed.transaction_id/', @feed_name), '''', '''''');
+    declare @session_var_high nvarchar(max) = replace(concat('changefeed.ulid_high/', @feed_name), '''', '''''');
+    declare @session_var_low nvarchar(max) = replace(concat('changefeed.ulid_low/', @feed_name), '''', '''''');
 
     return concat('create or alter function ', @ulid_func_name, '(@i bigint) returns binary(16)
 as begin
@@ -648,16 +1022,17 @@ end
 
 go
 
-create or alter function [changefeed].sql_permissions_outbox_reader(
+create or alter function [changefeed].sql_sign_read_procedure(
     @object_id int,
     @changefeed_schema nvarchar(max)
 ) returns nvarchar(max)
 as begin
     declare @unquoted_qualified_table_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
 
-    declare @role nvarchar(max) = quotename(concat(@changefeed_schema, '.readers:', @unquoted_qualified_table_name));
-    declare @cert nvarchar(max) = quotename(concat(@changefeed_schema, '.cert.readers:', @unquoted_qualified_table_name));
-    declare @user nvarchar(max) = quotename(concat(@changefeed_schema, '.user.readers:', @unquoted_qualified_table_name));
+    declare @cert_name nvarchar(max) = concat(@changefeed_schema, '.cert.readers:', @unquoted_qualified_table_name);
+    declare @user_name nvarchar(max) = concat(@changefeed_schema, '.user.readers:', @unquoted_qualified_table_name);
+    declare @cert nvarchar(max) = quotename(@cert_name);
+    declare @user nvarchar(max) = quotename(@user_name);
     declare @state_table nvarchar(max) = concat(
             quotename(@changefeed_schema),
             '.',
@@ -667,21 +1042,57 @@ as begin
             '.',
             quotename(concat('read_feed:', @unquoted_qualified_table_name)))
 
+    -- these are embedded in string literals in the generated code, so quotes are escaped
+    declare @cert_name_literal nvarchar(max) = replace(@cert_name, '''', '''''');
+    declare @user_name_literal nvarchar(max) = replace(@user_name, '''', '''''');
+    declare @cert_literal nvarchar(max) = replace(@cert, '''', '''''');
+    declare @user_literal nvarchar(max) = replace(@user, '''', '''''');
+    declare @state_table_literal nvarchar(max) = replace(@state_table, '''', '''''');
+    declare @read_feed_proc_literal nvarchar(max) = replace(@read_feed_proc, '''', '''''');
 
-    return concat(
-'
--- 1) Use a certificate to essentially grant the read_feed: procedure write permissions, as itself, to the state table.
--- This disallows changing the state table directly but allows using read_feed to change it..
+    return concat('
+-- Use a certificate to essentially grant the read_feed: procedure write permissions, as itself, to the state table.
+-- This disallows changing the state table directly but allows using read_feed to change it.
+--
+-- Altering read_feed drops the signature, and the private key of the certificate is removed after signing,
+-- so the certificate is re-created, with a new random password, every time read_feed is created.
+declare @read_feed_proc_id int = object_id(N''', @read_feed_proc_literal, ''');
+declare @previous_thumbprint varbinary(32) = (select thumbprint from sys.certificates where name = N''', @cert_name_literal, ''');
+if exists (select 1 from sys.crypt_properties where major_id = @read_feed_proc_id and thumbprint = @previous_thumbprint)
+    drop signature from ', @read_feed_proc, ' by certificate ', @cert, ';
+if database_principal_id(N''', @user_name_literal, ''') is not null drop user ', @user, ';
+if @previous_thumbprint is not null drop certificate ', @cert, ';
+
+declare @password nvarchar(max) = concat(convert(nvarchar(max), crypt_gen_random(32), 2), N''cf%a'');
+declare @sql nvarchar(max) = concat(N''
+create certificate ', @cert_literal, ' encryption by password = '', quotename(@password, ''''''''), N'' with subject = ''''"changefeed"'''';
+add signature to ', @read_feed_proc_literal, ' by certificate ', @cert_literal, ' with password = '', quotename(@password, ''''''''), N'';
+create user ', @user_literal, ' from certificate ', @cert_literal, ';
+grant select, insert, update on ', @state_table_literal, ' to ', @user_literal, ';
+alter certificate ', @cert_literal, ' remove private key; -- password no longer usable after this
+'');
+exec sp_executesql @sql;
+');
+end
 
-create certificate ', @cert, ' encryption by password = ''SqlCodePw1%'' with subject = ''"changefeed"'';
-add signature to ', @read_feed_proc, ' by certificate ', @cert, ' with password = ''SqlCodePw1%'';
-create user ', @user, ' from certificate ', @cert, ';
+go
 
-grant select, insert, update on ', @state_table,' to ', @user, ';
+create or alter function [changefeed].sql_permissions_outbox_reader(
+    @object_id int,
+    @changefeed_schema nvarchar(max)
+) returns nvarchar(max)
+as begin
+    declare @unquoted_qualified_table_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
 
-alter certificate ', @cert, ' remove private key; -- password no longer usable after this
+    declare @role nvarchar(max) = quotename(concat(@changefeed_schema, '.readers:', @unquoted_qualified_table_name));
+    declare @read_feed_proc nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('read_feed:', @unquoted_qualified_table_name)))
 
--- 2) Create a role that can execute read_feed
+    -- read_feed itself is signed by sql_sign_read_procedure, every time it is created
+    return concat('
+-- Create a role that can execute read_feed
 
 create role ', @role, ';
 grant execute on ', @read_feed_proc, ' to ', @role, ';
@@ -731,77 +1142,180 @@ end
 
 go
 
--- upgrade_feed is called if setup_feed has earlier been called to upgrade to a new version.
--- right now this only supports to re-run all stored procedures as `create or alter`, allowing
--- code updates in the stored procedures without affecting the tables created
-create or alter procedure [changefeed].upgrade_feed(
-    @table_name nvarchar(max),
-    @outbox bit = 0,
-    @blocking bit = 0
+-- sql_setup_feed_batches returns, in order, the batches that setup_feed (@upgrade = 0) or
+-- upgrade_feed (@upgrade = 1) executes for a table. Each batch must be executed separately,
+-- since they contain "create procedure" and similar statements. This is also used to
+-- render the script for review without executing it.
+create or alter function [changefeed].sql_setup_feed_batches(
+    @object_id int,
+    @changefeed_schema nvarchar(max),
+    @outbox bit,
+    @blocking bit,
+    @upgrade bit
+)
+returns @batches table (
+    ordinal int identity(1, 1) primary key,
+    description nvarchar(max) not null,
+    sql nvarchar(max) not null
 )
 as begin
-    declare @object_id int = object_id(@table_name, 'U');
-    if @object_id is null throw 71000, 'Could not find @table_name', 0;
-
-    if (@outbox = 0 and @blocking = 0) or (@outbox = 1 and @blocking = 1)
-        throw 55000, '[changefeed].setup_feed: please pass *either* @outbox=1 *or* @blocking=1', 1;
+    declare @feed_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id);
+    declare @ulid_func_name nvarchar(max) = concat(
+            quotename(@changefeed_schema),
+            '.',
+            quotename(concat('ulid:', @feed_name)));
 
-    -- in order to be able to search/replace [changefeed] in this script, this is bit weird:
-    declare @quoted_changefeed_schema nvarchar(max) = '[changefeed]';
-    declare @changefeed_schema nvarchar(max) = substring(@quoted_changefeed_schema, 2, len(@quoted_changefeed_schema) - 2);
+    if @upgrade = 0
+    begin
+        insert into @batches (description, sql)
+        values ('create [state:<tablename>]', [changefeed].sql_create_state_table(@object_id, @changefeed_schema));
 
-    declare @sql nvarchar(max);
+        if @outbox = 1
+        begin
+            insert into @batches (description, sql)
+            values
+                ('create [feed:<tablename>]', [changefeed].sql_create_feed_table(@object_id, @changefeed_schema)),
+                ('create [outbox:<tablename>]', [changefeed].sql_create_outbox_table(@object_id, @changefeed_schema)),
+                ('create [type:read:<tablename>]', [changefeed].sql_create_read_type(@object_id, @changefeed_schema));
+        end
+    end
 
-    -- create [feed_write_lock:<tablename>]
-    set @sql = [changefeed].sql_create_feed_write_lock_procedure(
-            @object_id,
-            @changefeed_schema);
-    exec sp_executesql @sql;
+    insert into @batches (description, sql)
+    values ('create [deadletter:<tablename>]', [changefeed].sql_create_deadletter_table(@object_id, @changefeed_schema));
 
-    -- create [update_state:<tablename>]
-    set @sql = [changefeed].sql_create_update_state_procedure(
-            @object_id,
-            @changefeed_schema);
-    exec sp_executesql @sql;
+    -- Stored procedures are (re-)created both by setup_feed and upgrade_feed
+    insert into @batches (description, sql)
+    values
+        ('create [feed_write_lock:<tablename>]', [changefeed].sql_create_feed_write_lock_procedure(@object_id, @changefeed_schema)),
+        ('create [update_state:<tablename>]', [changefeed].sql_create_update_state_procedure(@object_id, @changefeed_schema));
 
     if @outbox = 1
     begin
-        -- create [read_feed:<tablename>]
-        set @sql = [changefeed].sql_create_read_procedure(
-                @object_id,
-                @changefeed_schema);
-        exec sp_executesql @sql;
+        -- altering read_feed drops its signature, so it is always signed again
+        insert into @batches (description, sql)
+        values
+            ('create [read_feed:<tablename>]', [changefeed].sql_create_read_procedure(@object_id, @changefeed_schema)),
+            ('sign [read_feed:<tablename>]', [changefeed].sql_sign_read_procedure(@object_id, @changefeed_schema)),
+            ('create [read_feed_rs:<tablename>]', [changefeed].sql_create_read_result_set_procedure(@object_id, @changefeed_schema)),
+            ('create [outbox_type:<tablename>]', [changefeed].sql_create_outbox_type(@object_id, @changefeed_schema)),
+            ('create [publish:<tablename>]', [changefeed].sql_create_publish_procedure(@object_id, @changefeed_schema));
     end
 
     if @blocking = 1
     begin
-        set @sql = [changefeed].sql_create_lock_procedure(@object_id, @changefeed_schema);
-        exec sp_executesql @sql;
+        insert into @batches (description, sql)
+        values
+            ('create [lock:<tablename>]', [changefeed].sql_create_lock_procedure(@object_id, @changefeed_schema)),
+            ('create [ulid:<tablename>]', [changefeed].sql_create_ulid_function(@feed_name, @ulid_func_name)),
+            ('grant execute on [ulid:<tablename>]', concat('grant execute on ', @ulid_func_name, ' to public;'));
+    end
 
-        declare @feed_name nvarchar(max) = [changefeed].sql_unquoted_qualified_table_name(@object_id)
+    -- Publishers and consumers both need to agree on the shard of an event, so the shard
+    -- functions are available to everyone, like [ulid:<tablename>]
+    insert into @batches (description, sql)
+    values
+        ('create [shard:<tablename>]', [changefeed].sql_create_shard_function(@object_id, @changefeed_schema)),
+        ('create [shard_modulo:<tablename>]', [changefeed].sql_create_shard_modulo_function(@object_id, @changefeed_schema));
+    if [changefeed].sql_shard_key_supported(@object_id) = 1
+        insert into @batches (description, sql)
+        values ('grant execute on [shard:<tablename>]', concat(
+            'grant execute on ', quotename(@changefeed_schema), '.', quotename(concat('shard:', @feed_name)), ' to public;', char(10),
+            'grant execute on ', quotename(@changefeed_schema), '.', quotename(concat('shard_modulo:', @feed_name)), ' to public;'));
+
+    if @upgrade = 0
+    begin
+        if @outbox = 1
+        begin
+            insert into @batches (description, sql)
+            values ('permissions for [changefeed.readers:<tablename>]', [changefeed].sql_permissions_outbox_reader(@object_id, @changefeed_schema));
+        end
 
-        declare @ulid_func_name nvarchar(max) = concat(
-                quotename(@changefeed_schema),
-                '.',
-                quotename(concat('ulid:', @feed_name)))
+        insert into @batches (description, sql)
+        values ('permissions for [changefeed.writers:<tablename>]', [changefeed].sql_permissions_writer(@object_id, @changefeed_schema, @outbox));
+    end
 
-        set @sql = [changefeed].sql_create_ulid_function(@feed_name, @ulid_func_name);
-        exec sp_executesql @sql;
+    if @outbox = 1
+    begin
+        -- also when upgrading, since read_feed_rs did not exist in earlier versions
+        insert into @batches (description, sql)
+        values ('grant execute on [read_feed_rs:<tablename>]', concat(
+            'grant execute on ',
+            quotename(@changefeed_schema), '.', quotename(concat('read_feed_rs:', @feed_name)),
+            ' to ',
+            quotename(concat(@changefeed_schema, '.readers:', @feed_name)), ';'));
+
+        -- also when upgrading, since publish did not exist in earlier versions
+        insert into @batches (description, sql)
+        values ('grant execute on [publish:<tablename>]', concat(
+            'grant execute on ', quotename(@changefeed_schema), '.', quotename(concat('publish:', @feed_name)),
+            ' to ', quotename(concat(@changefeed_schema, '.writers:', @feed_name)), ';', char(10),
+            'grant execute on type::', [changefeed].sql_outbox_type_name(@object_id, @changefeed_schema),
+            ' to ', quotename(concat(@changefeed_schema, '.writers:', @feed_name)), ';'));
+    end
 
-        set @sql = concat('grant execute on ', @ulid_func_name, ' to public;')
-        exec sp_executesql @sql;
+    insert into @batches (description, sql)
+    values ('permissions on [deadletter:<tablename>]', [changefeed].sql_permissions_deadletter(@object_id, @changefeed_schema));
 
-    end
+    insert into @batches (description, sql)
+    values ('register in [changefeed].feeds', concat(
+        'exec ', quotename(@changefeed_schema), '.register_feed N''',
+        replace([changefeed].sql_fully_quoted_name(@object_id), '''', ''''''),
+        ''', @outbox = ', @outbox, ', @blocking = ', @blocking, ';'));
 
+    return
 end
 
 go
 
-create or alter procedure [changefeed].setup_feed(
+-- register_feed records a feed in [changefeed].feeds; called at the end of setup_feed and upgrade_feed
+create or alter procedure [changefeed].register_feed(
     @table_name nvarchar(max),
     @outbox bit = 0,
     @blocking bit = 0
 )
+as begin
+    set nocount on;
+    declare @object_id int = object_id(@table_name, 'U');
+    if @object_id is null throw 71000, 'Could not find @table_name', 0;
+
+    declare @mode varchar(10) = iif(@outbox = 1, 'outbox', 'blocking');
+    declare @now datetime2(3) = sysutcdatetime();
+    merge [changefeed].feeds with (holdlock) as f
+    using (select @object_id as object_id) as src
+    on f.object_id = src.object_id
+    when matched then
+        update set
+            table_name = [changefeed].sql_unquoted_qualified_table_name(@object_id),
+            mode = @mode,
+            library_version = [changefeed].library_version(),
+            upgraded_time = @now
+    when not matched then
+        insert (object_id, table_name, mode, library_version, created_time, upgraded_time)
+        values (@object_id, [changefeed].sql_unquoted_qualified_table_name(@object_id), @mode, [changefeed].library_version(), @now, @now);
+end
+
+go
+
+-- Feeds set up before [changefeed].feeds existed are registered from their [state:<tablename>]
+-- table, with library_version 0 so that the Go changefeed.UpgradeAll upgrades them.
+insert into [changefeed].feeds (object_id, table_name, mode, library_version, created_time, upgraded_time)
+select t.object_id, n.table_name,
+    iif(object_id(concat('[changefeed].', quotename(concat('outbox:', n.table_name))), 'U') is null, 'blocking', 'outbox'),
+    0, st.create_date, st.create_date
+from sys.tables as t
+cross apply (select [changefeed].sql_unquoted_qualified_table_name(t.object_id) as table_name) as n
+join sys.tables as st on st.object_id = object_id(concat('[changefeed].', quotename(concat('state:', n.table_name))), 'U')
+where not exists (select 1 from [changefeed].feeds as f where f.object_id = t.object_id);
+
+go
+
+-- run_setup_feed_batches executes the batches returned by sql_setup_feed_batches
+create or alter procedure [changefeed].run_setup_feed_batches(
+    @table_name nvarchar(max),
+    @outbox bit,
+    @blocking bit,
+    @upgrade bit
+)
 as begin
     declare @object_id int = object_id(@table_name, 'U');
     if @object_id is null throw 71000, 'Could not find @table_name', 0;
@@ -814,44 +1328,169 @@ as begin
     declare @changefeed_schema nvarchar(max) = substring(@quoted_changefeed_schema, 2, len(@quoted_changefeed_schema) - 2);
 
     declare @sql nvarchar(max);
+    declare batches cursor local fast_forward for
+        select sql
+        from [changefeed].sql_setup_feed_batches(@object_id, @changefeed_schema, @outbox, @blocking, @upgrade)
+        order by ordinal;
+    open batches;
+    fetch next from batches into @sql;
+    while @@fetch_status = 0
+    begin
+        exec sp_executesql @sql;
+        fetch next from batches into @sql;
+    end
+    close batches;
+    deallocate batches;
+end
+
+go
+
+-- upgrade_feed is called if setup_feed has earlier been called to upgrade to a new version.
+-- right now this only supports to re-run all stored procedures as `create or alter`, allowing
+-- code updates in the stored procedures without affecting the tables created
+create or alter procedure [changefeed].upgrade_feed(
+    @table_name nvarchar(max),
+    @outbox bit = 0,
+    @blocking bit = 0
+)
+as begin
+    exec [changefeed].run_setup_feed_batches @table_name, @outbox = @outbox, @blocking = @blocking, @upgrade = 1;
+end
+
+go
+
+-- install_outbox_trigger creates an `after insert` trigger on the source table of an
+-- outbox feed that inserts the primary key of every new row into [outbox:<tablename>].
+-- @shard_expr and @time_hint_expr are expressions over the columns of the source table,
+-- e.g. N'AggregateID % 4' and N'CreatedTime'. Call it again to change them, or after
+-- changing the primary key of the source table.
+create or alter procedure [changefeed].install_outbox_trigger(
+    @table_name nvarchar(max),
+    @shard_expr nvarchar(max) = N'0',
+    @time_hint_expr nvarchar(max) = N'sysutcdatetime()'
+)
+as begin
+    set nocount on;
 
-    -- create [state:<tablename>]
-    set @sql = [changefeed].sql_create_state_table(
-            @object_id,
-            @changefeed_schema);
+    declare @object_id int = object_id(@table_name, 'U');
+    if @object_id is null throw 71000, 'Could not find @table_name', 0;
+
+    -- in order to be able to search/replace [changefeed] in this script, this is bit weird:
+    declare @quoted_changefeed_schema nvarchar(max) = '[changefeed]';
+    declare @changefeed_schema nvarchar(max) = substring(@quoted_changefeed_schema, 2, len(@quoted_changefeed_schema) - 2);
+
+    if object_id(concat(@quoted_changefeed_schema, '.', quotename(concat('outbox:', [changefeed].sql_unquoted_qualified_table_name(@object_id)))), 'U') is null
+        throw 55001, '[changefeed].install_outbox_trigger: @table_name does not have an outbox feed', 1;
+
+    declare @sql nvarchar(max) = [changefeed].sql_create_outbox_trigger(@object_id, @changefeed_schema, @shard_expr, @time_hint_expr);
     exec sp_executesql @sql;
+end
 
-    if @outbox = 1
-    begin
-        -- create [feed:<tablename>]
-        set @sql = [changefeed].sql_create_feed_table(
-                @object_id,
-                @changefeed_schema);
-        exec sp_executesql @sql;
+go
 
-        -- create [outbox:read:<tablename>]
-        set @sql = [changefeed].sql_create_outbox_table(
-                @object_id,
-                @changefeed_schema);
-        exec sp_executesql @sql;
+-- With @with_trigger = 1, setup_feed also calls install_outbox_trigger with
+-- @trigger_shard_expr and @trigger_time_hint_expr.
+create or alter procedure [changefeed].setup_feed(
+    @table_name nvarchar(max),
+    @outbox bit = 0,
+    @blocking bit = 0,
+    @with_trigger bit = 0,
+    @trigger_shard_expr nvarchar(max) = N'0',
+    @trigger_time_hint_expr nvarchar(max) = N'sysutcdatetime()'
+)
+as begin
+    if @with_trigger = 1 and @outbox = 0
+        throw 55000, '[changefeed].setup_feed: @with_trigger=1 requires @outbox=1', 1;
 
-        -- create [type:read:<tablename>]
-        set @sql = [changefeed].sql_create_read_type(
-                @object_id,
-                @changefeed_schema);
-        exec sp_executesql @sql;
+    exec [changefeed].run_setup_feed_batches @table_name, @outbox = @outbox, @blocking = @blocking, @upgrade = 0;
 
-    end
+    if @with_trigger = 1
+        exec [changefeed].install_outbox_trigger @table_name,
+            @shard_expr = @trigger_shard_expr,
+            @time_hint_expr = @trigger_time_hint_expr;
+end
 
-    -- Stored procedures done by upgrade_feed...
-    exec [changefeed].upgrade_feed @table_name, @outbox = @outbox, @blocking = @blocking;
+go
 
-    if @outbox = 1
-    begin
-        set @sql = [changefeed].sql_permissions_outbox_reader(@object_id, @changefeed_schema);
-        exec sp_executesql @sql;
-    end
+-- drop_feed drops everything created by setup_feed. With @keep_data = 1 the [feed:<tablename>] table
+-- is kept, e.g. for archiving. The source table may already have been dropped; in that case
+-- pass the unquoted, qualified name (e.g. myservice.MyTable) as @table_name.
+create or alter procedure [changefeed].drop_feed(
+    @table_name nvarchar(max),
+    @keep_data bit = 0
+)
+as begin
+    set xact_abort, nocount on;
+
+    declare @unquoted_qualified_table_name nvarchar(max) = isnull(
+        [changefeed].sql_unquoted_qualified_table_name(object_id(@table_name, 'U')),
+        @table_name);
+
+    -- in order to be able to search/replace [changefeed] in this script, this is bit weird:
+    declare @quoted_changefeed_schema nvarchar(max) = '[changefeed]';
+    declare @changefeed_schema nvarchar(max) = substring(@quoted_changefeed_schema, 2, len(@quoted_changefeed_schema) - 2);
+
+    declare @prefix nvarchar(max) = concat(quotename(@changefeed_schema), '.');
+    declare @state_table nvarchar(max) = concat(@prefix, quotename(concat('state:', @unquoted_qualified_table_name)));
+
+    if object_id(@state_table, 'U') is null
+        throw 71000, 'Could not find a feed for @table_name', 0;
+
+    declare @readers_role sysname = concat(@changefeed_schema, '.readers:', @unquoted_qualified_table_name);
+    declare @writers_role sysname = concat(@changefeed_schema, '.writers:', @unquoted_qualified_table_name);
+    declare @cert sysname = concat(@changefeed_schema, '.cert.readers:', @unquoted_qualified_table_name);
+    declare @user sysname = concat(@changefeed_schema, '.user.readers:', @unquoted_qualified_table_name);
+
+    declare @sql nvarchar(max) = '';
+
+    -- Roles cannot be dropped while they have members
+    select @sql = concat(@sql, 'alter role ', quotename(r.name), ' drop member ', quotename(m.name), ';', char(10))
+    from sys.database_role_members rm
+    join sys.database_principals r on r.principal_id = rm.role_principal_id
+    join sys.database_principals m on m.principal_id = rm.member_principal_id
+    where r.name in (@readers_role, @writers_role);
+
+    -- The outbox trigger of install_outbox_trigger is dropped with the source table
+    if object_id(@table_name, 'U') is not null
+        set @sql = concat(@sql, 'drop trigger if exists ',
+            quotename(object_schema_name(object_id(@table_name, 'U'))), '.',
+            quotename(concat(@changefeed_schema, '.outbox:', @unquoted_qualified_table_name)), ';', char(10));
+
+    set @sql = concat(@sql, '
+drop role if exists ', quotename(@readers_role), ';
+drop role if exists ', quotename(@writers_role), ';
+
+drop procedure if exists ', @prefix, quotename(concat('read_feed_rs:', @unquoted_qualified_table_name)), ';
+drop procedure if exists ', @prefix, quotename(concat('publish:', @unquoted_qualified_table_name)), ';
+drop procedure if exists ', @prefix, quotename(concat('read_feed:', @unquoted_qualified_table_name)), ';
+drop procedure if exists ', @prefix, quotename(concat('lock:', @unquoted_qualified_table_name)), ';
+drop procedure if exists ', @prefix, quotename(concat('feed_write_lock:', @unquoted_qualified_table_name)), ';
+drop procedure if exists ', @prefix, quotename(concat('update_state:', @unquoted_qualified_table_name)), ';
+drop function if exists ', @prefix, quotename(concat('ulid:', @unquoted_qualified_table_name)), ';
+drop function if exists ', @prefix, quotename(concat('shard:', @unquoted_qualified_table_name)), ';
+drop function if exists ', @prefix, quotename(concat('shard_modulo:', @unquoted_qualified_table_name)), ';
+
+drop user if exists ', quotename(@user), ';
+');
+
+    if exists (select 1 from sys.certificates where name = @cert)
+        set @sql = concat(@sql, 'drop certificate ', quotename(@cert), ';', char(10));
+
+    set @sql = concat(@sql, '
+drop table if exists ', @prefix, quotename(concat('outbox:', @unquoted_qualified_table_name)), ';
+drop sequence if exists ', @prefix, quotename(concat('sequence:', @unquoted_qualified_table_name)), ';
+drop type if exists ', @prefix, quotename(concat('type:read:', @unquoted_qualified_table_name)), ';
+drop type if exists ', @prefix, quotename(concat('outbox_type:', replace(@unquoted_qualified_table_name, '.', ':'))), ';
+drop table if exists ', @state_table, ';
+');
+
+    if @keep_data = 0
+        set @sql = concat(@sql,
+            'drop table if exists ', @prefix, quotename(concat('feed:', @unquoted_qualified_table_name)), ';', char(10),
+            'drop table if exists ', @prefix, quotename(concat('deadletter:', @unquoted_qualified_table_name)), ';', char(10));
 
-    set @sql = [changefeed].sql_permissions_writer(@object_id, @changefeed_schema, @outbox);
+    begin transaction;
     exec sp_executesql @sql;
+    delete from [changefeed].feeds where table_name = @unquoted_qualified_table_name;
+    commit;
 end